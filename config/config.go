@@ -0,0 +1,665 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/delivery"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/sources"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultPath is where the configuration file is looked for when
+// FORWARDLYTICS_CONFIG is not set
+const DefaultPath = "forwardlytics.yml"
+
+// Config is the whole setup of Forwardlytics. It's read from a YAML file, or
+// from the environment variables when there is none.
+type Config struct {
+	// APIKey clients use to call the API, as the default source. It's also
+	// the key of the admin endpoints.
+	APIKey string `yaml:"apiKey"`
+
+	// Keys of the default source, on top of APIKey, to rotate them
+	Keys []Key `yaml:"keys"`
+
+	// RateLimit limits the requests of the default source
+	RateLimit sources.RateLimit `yaml:"rateLimit"`
+
+	// Sources are the applications calling the API, by name, each with its
+	// own key, integrations and rules
+	Sources map[string]Source `yaml:"sources"`
+
+	// SignatureSkew is how far the timestamp of a signed request can be from
+	// the current time, as a duration (e.g. 5m)
+	SignatureSkew string `yaml:"signatureSkew"`
+
+	// PixelMaxAge is how long a signed pixel is accepted after its
+	// timestamp, as a duration (e.g. 720h)
+	PixelMaxAge string `yaml:"pixelMaxAge"`
+
+	// TrustedProxies are the proxies in front of the API, like a load
+	// balancer, as IPs or CIDR ranges (e.g. 10.0.0.0/8). The IP of the
+	// client is only read from the X-Forwarded-For header they set, as
+	// anyone else can set it to anything.
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	// Port the API listens on
+	Port string `yaml:"port"`
+
+	// Retries is the number of times a call to an integration is retried on
+	// error, unless its retry policy under delivery sets the attempts
+	Retries int `yaml:"retries"`
+
+	// DeadLetterDir keeps the messages integrations failed to get, when set
+	DeadLetterDir string `yaml:"deadLetterDir"`
+
+	Queue Queue `yaml:"queue"`
+	Dedup Dedup `yaml:"dedup"`
+
+	// Integrations holds the settings of each integration instance, by name.
+	// The type of an instance is its name, unless set with a "type" setting,
+	// so the same integration can be used several times. Only the instances
+	// listed are enabled. It's nil when reading from the environment, each
+	// integration reading its own variables.
+	Integrations map[string]map[string]string `yaml:"integrations"`
+
+	// Delivery holds how to call each integration instance, by name, like
+	// its rate limit or its retry policy
+	Delivery map[string]delivery.Settings `yaml:"delivery"`
+
+	// fromEnv is set when the configuration comes from the environment
+	fromEnv bool
+}
+
+// Source configures an application calling the API
+type Source struct {
+	// APIKey the source calls the API with
+	APIKey string `yaml:"apiKey"`
+
+	// Keys of the source, on top of APIKey, to rotate them
+	Keys []Key `yaml:"keys"`
+
+	// RequireSignature only accepts signed requests from the source
+	RequireSignature bool `yaml:"requireSignature"`
+
+	// Integrations are the instances receiving the messages of the source,
+	// all of them when empty
+	Integrations []string `yaml:"integrations"`
+
+	// Rules transform the messages of the source, in order
+	Rules []sources.Rule `yaml:"rules"`
+
+	// RateLimit limits the requests of each key of the source, and the
+	// messages about each user
+	RateLimit sources.RateLimit `yaml:"rateLimit"`
+}
+
+// Key is one of the API keys of a source. Several are valid at once while
+// clients move to a new one, the old one expiring.
+type Key struct {
+	// ID names the key in the logs
+	ID string `yaml:"id"`
+
+	// Key is the API key itself
+	Key string `yaml:"key"`
+
+	// ExpiresAt is when the key stops being valid, as an RFC 3339 time.
+	// Optional.
+	ExpiresAt string `yaml:"expiresAt"`
+
+	// Public keys can be embedded in web pages. They only send page and
+	// track calls, from the Origins.
+	Public bool `yaml:"public"`
+
+	// Origins of the pages using the public key, like https://example.com
+	Origins []string `yaml:"origins"`
+
+	// Types of messages the public key can send, page and track when empty
+	Types []string `yaml:"types"`
+}
+
+// apiKeyID is the ID of the key set with apiKey, in the logs
+const apiKeyID = "apiKey"
+
+// Queue configures the durable queue
+type Queue struct {
+	// Dir holds the queue, messages are delivered synchronously when empty
+	Dir string `yaml:"dir"`
+
+	// Workers is the number of messages delivered to the integrations at the
+	// same time, across all of them
+	Workers int `yaml:"workers"`
+}
+
+// Dedup configures the window of message IDs used to ignore duplicates
+type Dedup struct {
+	// Size is the number of IDs kept
+	Size int `yaml:"size"`
+
+	// Window is how long IDs are kept, as a duration (e.g. 24h)
+	Window string `yaml:"window"`
+
+	// Dir keeps the IDs on disk, so they survive restarts
+	Dir string `yaml:"dir"`
+}
+
+// Error lists the problems of a configuration
+type Error struct {
+	Path     string
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid configuration %s: %s", e.Path, strings.Join(e.Problems, "; "))
+}
+
+// ${NAME} references in the configuration file
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Path returns the configuration file to use: FORWARDLYTICS_CONFIG when set,
+// DefaultPath when it exists, and an empty string otherwise.
+func Path() string {
+	if path := os.Getenv("FORWARDLYTICS_CONFIG"); path != "" {
+		return path
+	}
+	if _, err := os.Stat(DefaultPath); err == nil {
+		return DefaultPath
+	}
+	return ""
+}
+
+// Load reads the configuration from the file at path, or from the
+// environment variables when path is empty. It fails when the configuration
+// has any of the problems reported by Check.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		return FromEnv()
+	}
+	config, problems, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, config.Validate()...)
+	if len(problems) != 0 {
+		return nil, &Error{Path: path, Problems: problems}
+	}
+	return config, nil
+}
+
+// Check returns every problem of the configuration file: unknown keys,
+// environment variables that are not set, and missing or invalid settings.
+func Check(path string) ([]string, error) {
+	config, problems, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, config.Validate()...), nil
+}
+
+// parse reads the file, replacing ${NAME} in its strings with the environment
+// variable NAME. Unknown keys and unset variables are reported as problems.
+func parse(path string) (*Config, []string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &Config{}
+	err = yaml.UnmarshalStrict(data, config)
+	var typeErrors []string
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		// Unknown keys and invalid values, everything else was read
+		typeErrors = typeError.Errors
+	} else if err != nil {
+		return nil, nil, err
+	}
+	// Once the file is parsed, so that the values are taken as they are,
+	// whatever they contain
+	var problems []string
+	interpolate(reflect.ValueOf(config).Elem(), &problems)
+	problems = append(problems, typeErrors...)
+	if config.Integrations == nil {
+		// Nothing enabled, rather than falling back to the environment
+		config.Integrations = make(map[string]map[string]string)
+	}
+	config.setDefaults()
+	return config, problems, nil
+}
+
+// interpolate replaces the ${NAME} references in the strings of the value,
+// reporting the variables that are not set
+func interpolate(value reflect.Value, problems *[]string) {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(envReference.ReplaceAllStringFunc(value.String(), func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			env, ok := os.LookupEnv(name)
+			if !ok {
+				*problems = append(*problems, fmt.Sprintf("environment variable %s is not set", name))
+			}
+			return env
+		}))
+	case reflect.Ptr:
+		if !value.IsNil() {
+			interpolate(value.Elem(), problems)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			// Unexported fields are not read from the file
+			if field := value.Field(i); field.CanSet() {
+				interpolate(field, problems)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			interpolate(value.Index(i), problems)
+		}
+	case reflect.Map:
+		keys := value.MapKeys()
+		// In a stable order, for the problems
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, key := range keys {
+			// Map values can't be set in place
+			element := reflect.New(value.Type().Elem()).Elem()
+			element.Set(value.MapIndex(key))
+			interpolate(element, problems)
+			value.SetMapIndex(key, element)
+		}
+	}
+}
+
+// FromEnv reads the configuration from the environment variables
+// Forwardlytics historically used. The integrations read their own.
+func FromEnv() (*Config, error) {
+	config := &Config{
+		APIKey:        os.Getenv("FORWARDLYTICS_API_KEY"),
+		Port:          os.Getenv("PORT"),
+		DeadLetterDir: os.Getenv("DEAD_LETTER_DIR"),
+		Queue:         Queue{Dir: os.Getenv("QUEUE_DIR")},
+		Dedup:         Dedup{Window: os.Getenv("DEDUP_WINDOW"), Dir: os.Getenv("DEDUP_DIR")},
+		SignatureSkew: os.Getenv("SIGNATURE_SKEW"),
+		PixelMaxAge:   os.Getenv("PIXEL_MAX_AGE"),
+		fromEnv:       true,
+	}
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			config.TrustedProxies = append(config.TrustedProxies, proxy)
+		}
+	}
+
+	var problems []string
+	ints := map[string]*int{
+		"NUM_RETRIES_ON_ERROR":  &config.Retries,
+		"QUEUE_WORKERS":         &config.Queue.Workers,
+		"DEDUP_SIZE":            &config.Dedup.Size,
+		"RATE_LIMIT_BURST":      &config.RateLimit.Burst,
+		"USER_RATE_LIMIT_BURST": &config.RateLimit.UserBurst,
+	}
+	for name, value := range ints {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		var err error
+		if *value, err = strconv.Atoi(os.Getenv(name)); err != nil {
+			problems = append(problems, fmt.Sprintf("env variable %s should be an integer", name))
+		}
+	}
+	floats := map[string]*float64{
+		"RATE_LIMIT":      &config.RateLimit.Rate,
+		"USER_RATE_LIMIT": &config.RateLimit.UserRate,
+	}
+	for name, value := range floats {
+		if os.Getenv(name) == "" {
+			continue
+		}
+		var err error
+		if *value, err = strconv.ParseFloat(os.Getenv(name), 64); err != nil {
+			problems = append(problems, fmt.Sprintf("env variable %s should be a number", name))
+		}
+	}
+	config.setDefaults()
+
+	problems = append(problems, config.Validate()...)
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return nil, &Error{Path: "from environment", Problems: problems}
+	}
+	return config, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.Port == "" {
+		c.Port = "3000"
+	}
+	if c.Queue.Workers == 0 {
+		c.Queue.Workers = 8
+	}
+	if c.Dedup.Size == 0 {
+		c.Dedup.Size = 10000
+	}
+	if c.Dedup.Window == "" {
+		c.Dedup.Window = "24h"
+	}
+	if c.SignatureSkew == "" {
+		c.SignatureSkew = "5m"
+	}
+	if c.PixelMaxAge == "" {
+		c.PixelMaxAge = "720h"
+	}
+}
+
+// Validate returns the missing and invalid settings
+func (c *Config) Validate() (problems []string) {
+	// The API checks FORWARDLYTICS_API_KEY itself, commands like replay don't
+	// need it
+	if c.APIKey == "" && len(c.Keys) == 0 && len(c.Sources) == 0 && !c.fromEnv {
+		problems = append(problems, "apiKey or keys is required, unless there are sources")
+	}
+	if _, err := strconv.Atoi(c.Port); err != nil {
+		problems = append(problems, fmt.Sprintf("port should be a number, got %q", c.Port))
+	}
+	if c.Retries < 0 {
+		problems = append(problems, "retries should not be negative")
+	}
+	if c.Queue.Workers < 1 {
+		problems = append(problems, "queue.workers should be a positive integer")
+	}
+	if c.Dedup.Size < 1 {
+		problems = append(problems, "dedup.size should be a positive integer")
+	}
+	if window, err := time.ParseDuration(c.Dedup.Window); err != nil || window <= 0 {
+		problems = append(problems, fmt.Sprintf("dedup.window should be a positive duration, like 24h, got %q", c.Dedup.Window))
+	}
+	if skew, err := time.ParseDuration(c.SignatureSkew); err != nil || skew <= 0 {
+		problems = append(problems, fmt.Sprintf("signatureSkew should be a positive duration, like 5m, got %q", c.SignatureSkew))
+	}
+	if maxAge, err := time.ParseDuration(c.PixelMaxAge); err != nil || maxAge <= 0 {
+		problems = append(problems, fmt.Sprintf("pixelMaxAge should be a positive duration, like 720h, got %q", c.PixelMaxAge))
+	}
+	for i, proxy := range c.TrustedProxies {
+		if _, err := parseNetwork(proxy); err != nil {
+			problems = append(problems, fmt.Sprintf("trustedProxies[%d] should be an IP or a CIDR range, like 10.0.0.0/8, got %q", i, proxy))
+		}
+	}
+
+	names := make([]string, 0, len(c.Integrations))
+	for name := range c.Integrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, validateIntegration(name, c.Integrations[name])...)
+	}
+
+	problems = append(problems, c.validateSources()...)
+	problems = append(problems, c.validateDelivery()...)
+	return
+}
+
+// validateDelivery checks the delivery settings are for configured
+// integrations
+func (c *Config) validateDelivery() (problems []string) {
+	names := make([]string, 0, len(c.Delivery))
+	for name := range c.Delivery {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := c.Integrations[name]; !ok {
+			problems = append(problems, fmt.Sprintf("delivery: unknown integration %q", name))
+		}
+		for _, problem := range c.Delivery[name].Validate() {
+			problems = append(problems, fmt.Sprintf("delivery.%s.%s", name, problem))
+		}
+	}
+	return
+}
+
+// validateSources checks the sources have keys of their own and only use
+// configured integrations
+func (c *Config) validateSources() (problems []string) {
+	if _, ok := c.Sources[sources.Default]; ok && (c.APIKey != "" || len(c.Keys) != 0) {
+		problems = append(problems, fmt.Sprintf("sources.%s is the source of apiKey and keys, it can't be configured as well", sources.Default))
+	}
+
+	usedBy := make(map[string]string)
+	problems = append(problems, validateKeys("", c.APIKey, c.Keys, sources.Default, usedBy)...)
+	for _, problem := range c.RateLimit.Validate() {
+		problems = append(problems, "rateLimit: "+problem)
+	}
+
+	names := make([]string, 0, len(c.Sources))
+	for name := range c.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := c.Sources[name]
+		prefix := fmt.Sprintf("sources.%s.", name)
+		if source.APIKey == "" && len(source.Keys) == 0 {
+			problems = append(problems, fmt.Sprintf("%sapiKey or %skeys is required", prefix, prefix))
+		}
+		problems = append(problems, validateKeys(prefix, source.APIKey, source.Keys, name, usedBy)...)
+		if source.RequireSignature {
+			for i, key := range source.Keys {
+				if key.Public {
+					problems = append(problems, fmt.Sprintf("%skeys[%d] can't be public, as the source requires signed requests", prefix, i))
+				}
+			}
+		}
+
+		for _, integration := range source.Integrations {
+			if _, ok := c.Integrations[integration]; !ok {
+				problems = append(problems, fmt.Sprintf("sources.%s.integrations: unknown integration %q", name, integration))
+			}
+		}
+		for i, rule := range source.Rules {
+			for _, problem := range rule.Validate() {
+				problems = append(problems, fmt.Sprintf("sources.%s.rules[%d]: %s", name, i, problem))
+			}
+		}
+		for _, problem := range source.RateLimit.Validate() {
+			problems = append(problems, fmt.Sprintf("sources.%s.rateLimit: %s", name, problem))
+		}
+	}
+	return
+}
+
+// validateKeys checks the keys of a source are complete, and not used by
+// another source. usedBy tells which source uses each key, and gets the ones
+// of this source.
+func validateKeys(prefix string, apiKey string, keys []Key, source string, usedBy map[string]string) (problems []string) {
+	use := func(setting string, key string) {
+		if other, ok := usedBy[key]; ok {
+			problems = append(problems, fmt.Sprintf("%s%s is already used by %s", prefix, setting, other))
+			return
+		}
+		usedBy[key] = source
+	}
+
+	if apiKey != "" {
+		use("apiKey", apiKey)
+	}
+	ids := map[string]bool{apiKeyID: apiKey != ""}
+	for i, key := range keys {
+		setting := fmt.Sprintf("%skeys[%d]", prefix, i)
+		switch {
+		case key.ID == "":
+			problems = append(problems, setting+".id is required")
+		case ids[key.ID]:
+			problems = append(problems, fmt.Sprintf("%s.id %q is already used", setting, key.ID))
+		}
+		ids[key.ID] = true
+
+		if key.Key == "" {
+			problems = append(problems, setting+".key is required")
+		} else {
+			use(fmt.Sprintf("keys[%d].key", i), key.Key)
+		}
+		if _, err := parseExpiry(key.ExpiresAt); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.expiresAt should be an RFC 3339 time, like 2016-04-01T00:00:00Z, got %q", setting, key.ExpiresAt))
+		}
+		problems = append(problems, validatePublicKey(setting, key)...)
+	}
+	return
+}
+
+// validatePublicKey checks the origins and types limiting a public key
+func validatePublicKey(setting string, key Key) (problems []string) {
+	if !key.Public {
+		if len(key.Origins) != 0 || len(key.Types) != 0 {
+			problems = append(problems, setting+".origins and types only apply to public keys")
+		}
+		return
+	}
+	if len(key.Origins) == 0 {
+		problems = append(problems, setting+".origins is required for public keys")
+	}
+	for i, origin := range key.Origins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			problems = append(problems, fmt.Sprintf("%s.origins[%d] should be a scheme and host, like https://example.com, got %q", setting, i, origin))
+		}
+	}
+	for i, messageType := range key.Types {
+		if messageType != integrations.TypeTrack && messageType != integrations.TypePage {
+			problems = append(problems, fmt.Sprintf("%s.types[%d] should be track or page, public keys can't send %q", setting, i, messageType))
+		}
+	}
+	return
+}
+
+// SourceList returns the sources calling the API, including the default one
+// using APIKey and Keys when they're set. It fails when the expiry of a key
+// can't be read.
+func (c *Config) SourceList() ([]*sources.Source, error) {
+	var list []*sources.Source
+	if c.APIKey != "" || len(c.Keys) != 0 {
+		keys, err := keyList(c.APIKey, c.Keys)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &sources.Source{Name: sources.Default, Keys: keys, RateLimit: c.RateLimit})
+	}
+	for name, source := range c.Sources {
+		keys, err := keyList(source.APIKey, source.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("sources.%s.%v", name, err)
+		}
+		list = append(list, &sources.Source{
+			Name:             name,
+			Keys:             keys,
+			RequireSignature: source.RequireSignature,
+			Integrations:     source.Integrations,
+			Rules:            source.Rules,
+			RateLimit:        source.RateLimit,
+		})
+	}
+	return list, nil
+}
+
+// TrustedProxyList returns the networks of the trusted proxies
+func (c *Config) TrustedProxyList() ([]*net.IPNet, error) {
+	var list []*net.IPNet
+	for i, proxy := range c.TrustedProxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trustedProxies[%d]: %v", i, err)
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+// parseNetwork reads a CIDR range, or a single IP as the range holding only
+// it
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func keyList(apiKey string, keys []Key) ([]sources.Key, error) {
+	var list []sources.Key
+	if apiKey != "" {
+		list = append(list, sources.Key{ID: apiKeyID, Secret: apiKey})
+	}
+	for i, key := range keys {
+		expiresAt, err := parseExpiry(key.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d].expiresAt: %v", i, err)
+		}
+		list = append(list, sources.Key{
+			ID:        key.ID,
+			Secret:    key.Key,
+			ExpiresAt: expiresAt,
+			Public:    key.Public,
+			Origins:   key.Origins,
+			Types:     key.Types,
+		})
+	}
+	return list, nil
+}
+
+// parseExpiry reads the expiry of a key, the zero time meaning it doesn't
+// expire
+func parseExpiry(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// validateIntegration checks the settings of the instance against the ones its
+// integration declared
+func validateIntegration(name string, values map[string]string) (problems []string) {
+	typeName := integrations.InstanceType(name, values)
+	declared := integrations.Settings(typeName)
+	if declared == nil {
+		expecting := strings.Join(integrations.SettingsList(), ", ")
+		if typeName != name {
+			return []string{fmt.Sprintf("unknown type %q for integrations.%s, expecting one of %s", typeName, name, expecting)}
+		}
+		return []string{fmt.Sprintf("unknown integration %q, expecting one of %s, or an instance with a type", name, expecting)}
+	}
+
+	known := map[string]bool{integrations.TypeSetting: true}
+	for _, setting := range declared {
+		known[setting.Name] = true
+		if setting.Required && values[setting.Name] == "" {
+			problems = append(problems, fmt.Sprintf("integrations.%s.%s is required", name, setting.Name))
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] {
+			problems = append(problems, fmt.Sprintf("unknown setting integrations.%s.%s", name, key))
+		}
+	}
+	return
+}
@@ -0,0 +1,459 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/sources"
+)
+
+func init() {
+	integrations.RegisterSettings("test-only-integration-config", []integrations.Setting{
+		{Name: "apiKey", Env: "TEST_ONLY_API_KEY", Required: true},
+		{Name: "region", Env: "TEST_ONLY_REGION"},
+	})
+}
+
+func writeConfig(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "forwardlytics-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestLoad(t *testing.T) {
+	os.Setenv("TEST_ONLY_SECRET", "s3cr3t")
+	defer os.Unsetenv("TEST_ONLY_SECRET")
+	path := writeConfig(t, `
+apiKey: abc
+port: 8080
+retries: 3
+queue:
+  dir: /var/lib/forwardlytics/queue
+integrations:
+  test-only-integration-config:
+    apiKey: ${TEST_ONLY_SECRET}
+`)
+	defer os.Remove(path)
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.APIKey != "abc" || config.Port != "8080" || config.Retries != 3 {
+		t.Errorf("Wrong configuration: %#v", config)
+	}
+	if config.Queue.Dir != "/var/lib/forwardlytics/queue" || config.Queue.Workers != 8 {
+		t.Errorf("Wrong queue configuration: %#v", config.Queue)
+	}
+	if config.Dedup.Size != 10000 || config.Dedup.Window != "24h" {
+		t.Errorf("Expected the dedup defaults, got %#v", config.Dedup)
+	}
+	expected := map[string]map[string]string{
+		"test-only-integration-config": {"apiKey": "s3cr3t"},
+	}
+	if !reflect.DeepEqual(config.Integrations, expected) {
+		t.Errorf("Wrong integrations. Expected %v but got %v", expected, config.Integrations)
+	}
+}
+
+func TestLoadTakesEnvironmentValuesAsIs(t *testing.T) {
+	secret := "s3#cr: 3t\n'\"port: 9999"
+	os.Setenv("TEST_ONLY_SECRET", secret)
+	defer os.Unsetenv("TEST_ONLY_SECRET")
+	path := writeConfig(t, `
+apiKey: ${TEST_ONLY_SECRET}
+sources:
+  web:
+    apiKey: "web-${TEST_ONLY_SECRET}"
+    rules:
+      - set:
+          plan: ${TEST_ONLY_SECRET}
+integrations:
+  test-only-integration-config:
+    apiKey: ${TEST_ONLY_SECRET}
+`)
+	defer os.Remove(path)
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.APIKey != secret || config.Port != "3000" {
+		t.Errorf("Expected the variable to be taken as is, got %q on port %q", config.APIKey, config.Port)
+	}
+	if config.Sources["web"].APIKey != "web-"+secret {
+		t.Errorf("Expected the variable to be replaced within the value, got %q", config.Sources["web"].APIKey)
+	}
+	if plan := config.Sources["web"].Rules[0].Set["plan"]; plan != secret {
+		t.Errorf("Expected the variable to be replaced in the rules, got %q", plan)
+	}
+	if config.Integrations["test-only-integration-config"]["apiKey"] != secret {
+		t.Errorf("Expected the variable to be replaced in the integrations, got %v", config.Integrations)
+	}
+}
+
+func TestLoadWhenInvalid(t *testing.T) {
+	path := writeConfig(t, `apiKey: abc
+integrations:
+  test-only-integration-config:
+    region: eu
+`)
+	defer os.Remove(path)
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("Expected an error for the missing setting")
+	}
+	if _, ok := err.(*Error); !ok {
+		t.Errorf("Expected a configuration error, got %#v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	os.Unsetenv("TEST_ONLY_UNSET")
+	path := writeConfig(t, `
+prot: 8080
+dedup:
+  window: forever
+integrations:
+  test-only-integration-config:
+    apiKey: ${TEST_ONLY_UNSET}
+    colour: blue
+  unknown-integration:
+    apiKey: abc
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"environment variable TEST_ONLY_UNSET is not set",
+		"line 2: field prot not found in type config.Config",
+		"apiKey or keys is required, unless there are sources",
+		`dedup.window should be a positive duration, like 24h, got "forever"`,
+		"integrations.test-only-integration-config.apiKey is required",
+		"unknown setting integrations.test-only-integration-config.colour",
+	}
+	for i, problem := range expected {
+		if i >= len(problems) || problems[i] != problem {
+			t.Errorf("Expected problem %v to be %q, got %q", i, problem, problems)
+		}
+	}
+	if len(problems) != len(expected)+1 {
+		t.Errorf("Expected %v problems, got %q", len(expected)+1, problems)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	os.Setenv("PORT", "4000")
+	os.Setenv("QUEUE_WORKERS", "4")
+	defer os.Unsetenv("PORT")
+	defer os.Unsetenv("QUEUE_WORKERS")
+
+	config, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != "4000" || config.Queue.Workers != 4 {
+		t.Errorf("Wrong configuration: %#v", config)
+	}
+	if config.Integrations != nil {
+		t.Error("The integrations should read their own environment variables")
+	}
+
+	os.Setenv("QUEUE_WORKERS", "many")
+	if _, err = FromEnv(); err == nil {
+		t.Error("Expected an error when QUEUE_WORKERS is not a number")
+	}
+}
+
+func TestCheckInstancesWithType(t *testing.T) {
+	path := writeConfig(t, `apiKey: abc
+integrations:
+  test-only-eu:
+    type: test-only-integration-config
+    apiKey: eu-key
+  test-only-us:
+    type: test-only-integration-unknown
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], `unknown type "test-only-integration-unknown" for integrations.test-only-us`) {
+		t.Errorf("Expected only the unknown type to be reported, got %q", problems)
+	}
+}
+
+func TestCheckSources(t *testing.T) {
+	path := writeConfig(t, `
+integrations:
+  test-only-integration-config:
+    apiKey: abc
+sources:
+  web:
+    apiKey: web-key
+    integrations: [test-only-integration-config]
+    rules:
+      - events: [debug.ping]
+        drop: true
+  mobile:
+    apiKey: web-key
+    integrations: [mixpanel]
+  server:
+    rules:
+      - types: [screen]
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`sources.mobile.integrations: unknown integration "mixpanel"`,
+		"sources.server.apiKey or sources.server.keys is required",
+		`sources.server.rules[0]: unknown type "screen", expecting identify, track, page, alias or group`,
+		"sources.web.apiKey is already used by mobile",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestSourceListWithKeys(t *testing.T) {
+	path := writeConfig(t, `
+apiKey: admin-key
+sources:
+  web:
+    keys:
+      - id: "2016-04"
+        key: new-key
+      - id: "2016-01"
+        key: old-key
+        expiresAt: 2016-05-01T00:00:00Z
+`)
+	defer os.Remove(path)
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := config.SourceList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected the default and web sources, got %v", len(list))
+	}
+	for _, source := range list {
+		if source.Name == sources.Default && !reflect.DeepEqual(source.Keys, []sources.Key{{ID: "apiKey", Secret: "admin-key"}}) {
+			t.Errorf("Wrong keys for the default source: %v", source.Keys)
+		}
+		if source.Name != "web" {
+			continue
+		}
+		expected := []sources.Key{
+			{ID: "2016-04", Secret: "new-key"},
+			{ID: "2016-01", Secret: "old-key", ExpiresAt: time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)},
+		}
+		if !reflect.DeepEqual(source.Keys, expected) {
+			t.Errorf("Wrong keys for web. Expected %v but got %v", expected, source.Keys)
+		}
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	path := writeConfig(t, `
+keys:
+  - id: a
+    key: shared-key
+  - id: a
+    expiresAt: tomorrow
+sources:
+  web:
+    keys:
+      - key: shared-key
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`keys[1].id "a" is already used`,
+		"keys[1].key is required",
+		`keys[1].expiresAt should be an RFC 3339 time, like 2016-04-01T00:00:00Z, got "tomorrow"`,
+		"sources.web.keys[0].id is required",
+		"sources.web.keys[0].key is already used by default",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestCheckPublicKeys(t *testing.T) {
+	path := writeConfig(t, `
+sources:
+  server:
+    requireSignature: true
+    keys:
+      - id: browser
+        key: server-public-key
+        public: true
+        origins: ["https://example.com"]
+  web:
+    keys:
+      - id: secret
+        key: web-key
+        origins: ["https://example.com"]
+      - id: browser
+        key: web-public-key
+        public: true
+        types: [track, identify]
+      - id: landing
+        key: web-landing-key
+        public: true
+        origins: ["https://example.com/landing", "example.com", "http://localhost:3000"]
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"sources.server.keys[0] can't be public, as the source requires signed requests",
+		"sources.web.keys[0].origins and types only apply to public keys",
+		"sources.web.keys[1].origins is required for public keys",
+		`sources.web.keys[1].types[1] should be track or page, public keys can't send "identify"`,
+		`sources.web.keys[2].origins[0] should be a scheme and host, like https://example.com, got "https://example.com/landing"`,
+		`sources.web.keys[2].origins[1] should be a scheme and host, like https://example.com, got "example.com"`,
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestCheckRateLimits(t *testing.T) {
+	path := writeConfig(t, `
+apiKey: abc
+rateLimit:
+  rate: -1
+sources:
+  jobs:
+    apiKey: def
+    rateLimit:
+      rate: 10
+      burst: 20
+      userBurst: 5
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"rateLimit: rate and userRate can't be negative",
+		"sources.jobs.rateLimit: a burst needs a rate",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestCheckDelivery(t *testing.T) {
+	path := writeConfig(t, `
+apiKey: abc
+integrations:
+  test-only-integration-config:
+    apiKey: def
+delivery:
+  test-only-integration-config:
+    rateLimit: -2
+    concurrency: -1
+    failureThreshold: 3
+    openFor: soon
+    retry:
+      maxAttempts: 3
+      initialBackoff: 1m
+      maxBackoff: 10s
+      jitter: 2
+      deadline: -5m
+  test-only-integration-missing:
+    rateLimit: 10
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"delivery.test-only-integration-config.rateLimit can't be negative",
+		"delivery.test-only-integration-config.concurrency can't be negative",
+		`delivery.test-only-integration-config.openFor should be a positive duration, like 30s, got "soon"`,
+		`delivery.test-only-integration-config.retry.deadline should be a positive duration, like 5m, got "-5m"`,
+		"delivery.test-only-integration-config.retry.initialBackoff can't be longer than maxBackoff",
+		"delivery.test-only-integration-config.retry.jitter should be between 0 and 1",
+		`delivery: unknown integration "test-only-integration-missing"`,
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestTrustedProxyList(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 1.2.3.4")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+
+	config, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := config.TrustedProxyList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 2 || proxies[0].String() != "10.0.0.0/8" || proxies[1].String() != "1.2.3.4/32" {
+		t.Errorf("Wrong trusted proxies: %v", proxies)
+	}
+
+	path := writeConfig(t, `
+apiKey: abc
+trustedProxies:
+  - 10.0.0.0/8
+  - heroku
+`)
+	defer os.Remove(path)
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`trustedProxies[1] should be an IP or a CIDR range, like 10.0.0.0/8, got "heroku"`}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jipiboily/forwardlytics/config"
+)
+
+const configUsage = `Usage: forwardlytics config validate [file]
+
+Checks the configuration file, FORWARDLYTICS_CONFIG or forwardlytics.yml by
+default, and reports unknown keys, environment variables that are not set and
+missing or invalid settings.
+`
+
+// configCommand runs the config subcommand and returns the exit code
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" || len(args) > 2 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+
+	path := config.Path()
+	if len(args) == 2 {
+		path = args[1]
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "No configuration file, set FORWARDLYTICS_CONFIG or create "+config.DefaultPath)
+		return 1
+	}
+
+	problems, err := config.Check(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the configuration:", err)
+		return 1
+	}
+	if len(problems) != 0 {
+		fmt.Printf("%s has %d problems:\n", path, len(problems))
+		for _, problem := range problems {
+			fmt.Println("- " + problem)
+		}
+		return 1
+	}
+	fmt.Printf("%s is valid\n", path)
+	return 0
+}
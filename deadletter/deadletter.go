@@ -0,0 +1,213 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+// ErrNotFound is returned when a dead letter doesn't exist
+var ErrNotFound = errors.New("deadletter: not found")
+
+// Letter is a message an integration could not receive, even after retrying
+type Letter struct {
+	ID          string               `json:"id"`
+	Integration string               `json:"integration"`
+	Message     integrations.Message `json:"message"`
+	Error       string               `json:"error"`
+	// ErrorKind tells if replaying the letter can help, see
+	// integrations.ErrorKind
+	ErrorKind integrations.ErrorKind `json:"errorKind,omitempty"`
+	// Attempts is the number of calls made to the integration before giving
+	// up
+	Attempts int   `json:"attempts,omitempty"`
+	FailedAt int64 `json:"failedAt"`
+}
+
+// Filter selects dead letters. Zero values match everything.
+type Filter struct {
+	Integration string
+	ID          string
+	// Since and Until are unix timestamps bounding FailedAt, both inclusive
+	Since int64
+	Until int64
+}
+
+// Match tells if the letter is selected by the filter
+func (f Filter) Match(l Letter) bool {
+	if f.Integration != "" && f.Integration != l.Integration {
+		return false
+	}
+	if f.ID != "" && f.ID != l.ID {
+		return false
+	}
+	if f.Since != 0 && l.FailedAt < f.Since {
+		return false
+	}
+	if f.Until != 0 && l.FailedAt > f.Until {
+		return false
+	}
+	return true
+}
+
+// Store keeps the dead letters on disk, one file per letter in a directory per
+// integration.
+type Store struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// Open returns the store kept in dir, creating the directory if needed
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Add stores the message that the integration failed to receive, after that
+// many attempts
+func (s *Store) Add(integration string, message integrations.Message, deliveryError error, attempts int) (letter Letter, err error) {
+	id, err := integrations.NewID()
+	if err != nil {
+		return
+	}
+	letter = Letter{
+		ID:          id,
+		Integration: integration,
+		Message:     message,
+		Error:       deliveryError.Error(),
+		ErrorKind:   integrations.Kind(deliveryError),
+		Attempts:    attempts,
+		FailedAt:    time.Now().Unix(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.write(letter)
+	return
+}
+
+// List returns the letters matching the filter, oldest first
+func (s *Store) List(filter Filter) (letters []Letter, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	integrationDirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, integrationDir := range integrationDirs {
+		if !integrationDir.IsDir() {
+			continue
+		}
+		if filter.Integration != "" && integrationDir.Name() != filter.Integration {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, integrationDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			letter, err := s.read(filepath.Join(s.dir, integrationDir.Name(), file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if filter.Match(letter) {
+				letters = append(letters, letter)
+			}
+		}
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].FailedAt == letters[j].FailedAt {
+			return letters[i].ID < letters[j].ID
+		}
+		return letters[i].FailedAt < letters[j].FailedAt
+	})
+	return
+}
+
+// Remove discards a letter, once replayed or when it's not wanted anymore
+func (s *Store) Remove(integration string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(integration, id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *Store) path(integration string, id string) string {
+	// Names come from the API, don't let them escape the store.
+	return filepath.Join(s.dir, filepath.Base(integration), filepath.Base(id)+".json")
+}
+
+func (s *Store) read(path string) (letter Letter, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &letter)
+	return
+}
+
+// write stores the letter in a temporary file first, so a crash never leaves
+// half a letter behind.
+func (s *Store) write(letter Letter) error {
+	dir := filepath.Join(s.dir, filepath.Base(letter.Integration))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	content, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	path := s.path(letter.Integration, letter.ID)
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ParseTime reads a time given either as a unix timestamp or in RFC 3339
+// format. An empty string is the zero timestamp.
+func ParseTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return timestamp, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expecting a unix timestamp or RFC 3339", value)
+	}
+	return t.Unix(), nil
+}
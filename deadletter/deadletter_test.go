@@ -0,0 +1,135 @@
+package deadletter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func openStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "forwardlytics-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+func testMessage() integrations.Message {
+	return integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+}
+
+func TestAddAndList(t *testing.T) {
+	store, dir := openStore(t)
+	defer os.RemoveAll(dir)
+
+	added, err := store.Add("drip", testMessage(), errors.New("some random error"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Add("intercom", testMessage(), errors.New("some other error"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := store.List(Filter{Integration: "drip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter for drip, got %v", len(letters))
+	}
+	if letters[0].ID != added.ID {
+		t.Errorf("Expected dead letter %v, got %v", added.ID, letters[0].ID)
+	}
+	if letters[0].Error != "some random error" {
+		t.Errorf("Expected the error to be kept, got %v", letters[0].Error)
+	}
+	if letters[0].Message.Event.Name != "account.created" {
+		t.Errorf("Expected the message to be kept, got %#v", letters[0].Message)
+	}
+	if letters[0].Attempts != 3 {
+		t.Errorf("Expected the attempts to be kept, got %v", letters[0].Attempts)
+	}
+
+	all, err := store.List(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Errorf("Expected 2 dead letters, got %v", len(all))
+	}
+}
+
+func TestFilterMatchesTimeRange(t *testing.T) {
+	letter := Letter{ID: "abc", Integration: "drip", FailedAt: 1000}
+
+	filters := map[Filter]bool{
+		Filter{}:                               true,
+		Filter{Since: 1000, Until: 1000}:       true,
+		Filter{Since: 1001}:                    false,
+		Filter{Until: 999}:                     false,
+		Filter{Integration: "intercom"}:        false,
+		Filter{Integration: "drip"}:            true,
+		Filter{ID: "def"}:                      false,
+		Filter{Integration: "drip", ID: "abc"}: true,
+	}
+	for filter, expected := range filters {
+		if filter.Match(letter) != expected {
+			t.Errorf("Expected %#v to match: %v", filter, expected)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	store, dir := openStore(t)
+	defer os.RemoveAll(dir)
+
+	letter, err := store.Add("drip", testMessage(), errors.New("some random error"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Remove("drip", letter.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Remove("drip", letter.ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound removing twice, got %v", err)
+	}
+
+	letters, err := store.List(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 0 {
+		t.Errorf("Expected no dead letters, got %v", len(letters))
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	times := map[string]int64{
+		"":                     0,
+		"1459532831":           1459532831,
+		"2016-04-01T17:47:11Z": 1459532831,
+	}
+	for value, expected := range times {
+		parsed, err := ParseTime(value)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", value, err)
+		}
+		if parsed != expected {
+			t.Errorf("Expected %q to be %v, got %v", value, expected, parsed)
+		}
+	}
+
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Error("Expected an error parsing an invalid time")
+	}
+}
@@ -0,0 +1,255 @@
+package dedup
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const logName = "dedup.log"
+
+// Window remembers the IDs of the messages received recently, so that a
+// message sent again by a client retrying is not forwarded twice. IDs are
+// remembered for each source, as different sources may use the same ones.
+// It's bounded both in size, the IDs being evicted in the order they were
+// first seen, as seeing one again doesn't refresh it, and in time, IDs older
+// than the window being forgotten.
+type Window struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[key]*list.Element
+	now     func() time.Time
+
+	// Only set when the window is persisted to disk
+	dir     string
+	file    *os.File
+	written int
+}
+
+// key identifies a message within the window
+type key struct {
+	source string
+	id     string
+}
+
+// record is a single line of the log
+type record struct {
+	Source string `json:"source,omitempty"`
+	ID     string `json:"id"`
+	SeenAt int64  `json:"seenAt,omitempty"`
+	Forget bool   `json:"forget,omitempty"`
+}
+
+func (r record) key() key {
+	return key{source: r.Source, id: r.ID}
+}
+
+// New returns a window kept in memory only, holding at most size IDs for ttl.
+// A ttl of zero keeps IDs until they're evicted.
+func New(size int, ttl time.Duration) *Window {
+	return &Window{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[key]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Open returns a window persisted in dir, so that it survives restarts. The IDs
+// seen before the last shutdown are loaded back.
+func Open(dir string, size int, ttl time.Duration) (*Window, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := New(size, ttl)
+	w.dir = dir
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	if err := w.compact(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Seen records the ID of the message from the source and tells if it was
+// already seen within the window. It's safe to call concurrently: only one of
+// the callers with the same source and ID gets false.
+func (w *Window) Seen(source, id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	if element, ok := w.entries[key{source: source, id: id}]; ok {
+		if !w.expired(element.Value.(record), now) {
+			return true
+		}
+		w.remove(element)
+	}
+
+	r := record{Source: source, ID: id, SeenAt: now.Unix()}
+	w.add(r)
+	w.persist(r)
+	return false
+}
+
+// Forget removes the ID of the message from the source from the window, e.g.
+// when the message could not be delivered and the client should be able to
+// send it again.
+func (w *Window) Forget(source, id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	element, ok := w.entries[key{source: source, id: id}]
+	if !ok {
+		return
+	}
+	w.remove(element)
+	w.persist(record{Source: source, ID: id, Forget: true})
+}
+
+// Len returns the number of IDs in the window
+func (w *Window) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.entries)
+}
+
+// Close closes the file of a persisted window
+func (w *Window) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Window) expired(r record, now time.Time) bool {
+	return w.ttl > 0 && now.Sub(time.Unix(r.SeenAt, 0)) > w.ttl
+}
+
+// add puts the record in front of the window, evicting the oldest ones when
+// it's full
+func (w *Window) add(r record) {
+	w.entries[r.key()] = w.order.PushFront(r)
+	for w.size > 0 && w.order.Len() > w.size {
+		w.remove(w.order.Back())
+	}
+}
+
+func (w *Window) remove(element *list.Element) {
+	delete(w.entries, element.Value.(record).key())
+	w.order.Remove(element)
+}
+
+// persist appends the record to the log of a persisted window. Failing to do
+// so only means a duplicate might get through after a restart, so errors are
+// logged and the window keeps working in memory.
+func (w *Window) persist(r record) {
+	if w.file == nil {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err == nil {
+		_, err = w.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("source", r.Source).WithField("id", r.ID).Error("Error writing to the dedup log")
+		return
+	}
+
+	// Evicted and forgotten IDs stay in the log until it's rewritten
+	w.written++
+	if w.written > 2*w.size {
+		if err = w.compact(); err != nil {
+			logrus.WithError(err).Error("Error compacting the dedup log")
+		}
+	}
+}
+
+func (w *Window) path() string {
+	return filepath.Join(w.dir, logName)
+}
+
+// load replays the log to rebuild the window
+func (w *Window) load() error {
+	file, err := os.Open(w.path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := w.now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			logrus.WithError(err).WithField("record", scanner.Text()).Warn("Skipping unreadable record in the dedup log")
+			continue
+		}
+		if element, ok := w.entries[r.key()]; ok {
+			w.remove(element)
+		}
+		if !r.Forget && !w.expired(r, now) {
+			w.add(r)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log so it only holds the IDs in the window, and
+// reopens it for appending
+func (w *Window) compact() error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+
+	tmpPath := w.path() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	// Oldest first, so that loading it back keeps the same order
+	for element := w.order.Back(); element != nil; element = element.Prev() {
+		if err = encoder.Encode(element.Value.(record)); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, w.path()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.written = 0
+	return nil
+}
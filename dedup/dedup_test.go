@@ -0,0 +1,128 @@
+package dedup
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSeen(t *testing.T) {
+	w := New(10, time.Hour)
+	if w.Seen("web", "abc") {
+		t.Error("abc should not be seen the first time")
+	}
+	if !w.Seen("web", "abc") {
+		t.Error("abc should be seen the second time")
+	}
+	if w.Seen("web", "def") {
+		t.Error("def should not be seen the first time")
+	}
+}
+
+func TestSeenEvictsOldestIDs(t *testing.T) {
+	w := New(2, time.Hour)
+	w.Seen("web", "a")
+	w.Seen("web", "b")
+	w.Seen("web", "c")
+	if w.Len() != 2 {
+		t.Errorf("Expected 2 IDs in the window, got %v", w.Len())
+	}
+	if w.Seen("web", "a") {
+		t.Error("a should have been evicted")
+	}
+	if !w.Seen("web", "c") {
+		t.Error("c should still be in the window")
+	}
+}
+
+func TestSeenForgetsExpiredIDs(t *testing.T) {
+	now := time.Now()
+	w := New(10, time.Minute)
+	w.now = func() time.Time { return now }
+	w.Seen("web", "abc")
+
+	now = now.Add(2 * time.Minute)
+	if w.Seen("web", "abc") {
+		t.Error("abc should have expired")
+	}
+}
+
+func TestForget(t *testing.T) {
+	w := New(10, time.Hour)
+	w.Seen("web", "abc")
+	w.Forget("web", "abc")
+	if w.Seen("web", "abc") {
+		t.Error("abc should have been forgotten")
+	}
+}
+
+func TestOpenLoadsPersistedIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Seen("web", "abc")
+	w.Seen("web", "def")
+	w.Forget("web", "def")
+	w.Close()
+
+	w, err = Open(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if !w.Seen("web", "abc") {
+		t.Error("abc should be seen after reopening")
+	}
+	if w.Seen("web", "def") {
+		t.Error("def was forgotten, it should not be seen after reopening")
+	}
+}
+
+func TestPersistedLogIsCompacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		w.Seen("web", id)
+	}
+	w.Close()
+
+	w, err = Open(dir, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Len() != 2 {
+		t.Errorf("Expected 2 IDs after reopening, got %v", w.Len())
+	}
+	if !w.Seen("web", "f") || w.Seen("web", "a") {
+		t.Error("Expected only the most recent IDs to be kept")
+	}
+}
+
+func TestSeenBySource(t *testing.T) {
+	w := New(10, time.Hour)
+	w.Seen("web", "abc")
+	if w.Seen("jobs", "abc") {
+		t.Error("abc from another source should not be seen")
+	}
+	w.Forget("jobs", "abc")
+	if !w.Seen("web", "abc") {
+		t.Error("Forgetting abc from another source should keep it")
+	}
+}
@@ -0,0 +1,216 @@
+package delivery
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/metrics"
+)
+
+// States of the circuit breaker of an integration
+const (
+	// CircuitClosed means the calls go through
+	CircuitClosed = "closed"
+	// CircuitOpen means the integration keeps failing, calls are not made
+	CircuitOpen = "open"
+	// CircuitHalfOpen means a call is let through to probe the integration,
+	// the others wait for its outcome
+	CircuitHalfOpen = "half-open"
+)
+
+// Defaults of the circuit breakers, when the settings don't tell
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenFor          = 30 * time.Second
+)
+
+// metricCircuitsOpened counts the times the circuit of each integration opened
+const metricCircuitsOpened = "circuitsOpened"
+
+// probeWait is how long to wait for the probe of a half-open circuit before
+// checking it again
+const probeWait = time.Second
+
+// ErrCircuitOpen is returned instead of calling an integration that keeps
+// failing. It's retryable, the message can be delivered once the integration
+// recovers.
+var ErrCircuitOpen = integrations.Retryable(errors.New("circuit open, the integration keeps failing"))
+
+// BreakerState is the state of the circuit breaker of an integration
+type BreakerState struct {
+	Integration string `json:"integration"`
+	State       string `json:"state"`
+	// Failures is the number of calls that failed in a row
+	Failures int `json:"failures"`
+	// OpenedAt is when the circuit last opened, as a Unix timestamp
+	OpenedAt int64 `json:"openedAt,omitempty"`
+	// ProbeAt is when an open circuit lets a call through again, as a Unix
+	// timestamp
+	ProbeAt int64 `json:"probeAt,omitempty"`
+}
+
+// breaker stops calling an integration after consecutive failures, for a
+// while, then lets a single call through to see if it recovered
+type breaker struct {
+	mu        sync.Mutex
+	name      string
+	threshold int
+	openFor   time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+var breakers = struct {
+	sync.Mutex
+	byName map[string]*breaker
+}{byName: make(map[string]*breaker)}
+
+// configureBreakers applies the settings of each integration instance to its
+// circuit breaker, keeping its state
+func configureBreakers(configs map[string]config) {
+	breakers.Lock()
+	defer breakers.Unlock()
+	for name, b := range breakers.byName {
+		b.configure(configs[name])
+	}
+	for name, c := range configs {
+		if breakers.byName[name] == nil {
+			b := newBreaker(name)
+			b.configure(c)
+			breakers.byName[name] = b
+		}
+	}
+}
+
+// breakerFor returns the circuit breaker of the integration
+func breakerFor(name string) *breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b := breakers.byName[name]
+	if b == nil {
+		b = newBreaker(name)
+		breakers.byName[name] = b
+	}
+	return b
+}
+
+// Breakers returns the state of the circuit breakers of the enabled
+// integrations, sorted by name
+func Breakers() []BreakerState {
+	names := integrations.IntegrationList()
+	states := make([]BreakerState, 0, len(names))
+	for _, name := range names {
+		states = append(states, breakerFor(name).snapshot())
+	}
+	return states
+}
+
+func newBreaker(name string) *breaker {
+	return &breaker{
+		name:      name,
+		threshold: DefaultFailureThreshold,
+		openFor:   DefaultOpenFor,
+		state:     CircuitClosed,
+	}
+}
+
+func (b *breaker) configure(c config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = DefaultFailureThreshold
+	if c.FailureThreshold > 0 {
+		b.threshold = c.FailureThreshold
+	}
+	b.openFor = DefaultOpenFor
+	if c.openFor > 0 {
+		b.openFor = c.openFor
+	}
+}
+
+// allow tells if a call can be made to the integration. When the circuit is
+// open, it returns how long until it can be probed. Once it can, a single
+// call is allowed until its outcome is recorded.
+func (b *breaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if wait := b.openedAt.Add(b.openFor).Sub(now()); wait > 0 {
+			return false, wait
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		logrus.WithField("integration", b.name).Info("Circuit half-open, probing the integration")
+		return true, 0
+	case CircuitHalfOpen:
+		if b.probing {
+			return false, probeWait
+		}
+		b.probing = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// wait returns how long until a call could be made to the integration,
+// without taking the probe of the circuit
+func (b *breaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == CircuitOpen:
+		if wait := b.openedAt.Add(b.openFor).Sub(now()); wait > 0 {
+			return wait
+		}
+	case b.state == CircuitHalfOpen && b.probing:
+		return probeWait
+	}
+	return 0
+}
+
+// record updates the circuit with the outcome of a call. Errors telling that
+// the integration is down, or refuses its credentials, count as failures.
+// Any other answer means it's up.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kind := integrations.Kind(err)
+	if err == nil || err == integrations.ErrUnsupported || (kind != integrations.ErrorRetryable && kind != integrations.ErrorAuth) {
+		if b.state != CircuitClosed {
+			logrus.WithField("integration", b.name).Info("Circuit closed, the integration recovered")
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		if b.state == CircuitClosed {
+			metrics.Add(metricCircuitsOpened, b.name, 1)
+		}
+		logrus.WithField("integration", b.name).WithField("failures", b.failures).WithField("openFor", b.openFor).Warn("Circuit open, the integration keeps failing")
+		b.state = CircuitOpen
+		b.openedAt = now()
+		b.probing = false
+	}
+}
+
+func (b *breaker) snapshot() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := BreakerState{Integration: b.name, State: b.state, Failures: b.failures}
+	if !b.openedAt.IsZero() {
+		state.OpenedAt = b.openedAt.Unix()
+	}
+	if b.state == CircuitOpen {
+		state.ProbeAt = b.openedAt.Add(b.openFor).Unix()
+	}
+	return state
+}
@@ -0,0 +1,353 @@
+package delivery
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/deadletter"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/metrics"
+	"github.com/jipiboily/forwardlytics/queue"
+	"github.com/jipiboily/forwardlytics/sources"
+)
+
+// States of a message for a given integration
+const (
+	// StatusAccepted means the integration received the message
+	StatusAccepted = "accepted"
+	// StatusFailed means the integration could not receive the message
+	StatusFailed = "failed"
+	// StatusSkipped means the integration is not enabled
+	StatusSkipped = "skipped"
+	// StatusQueued means the message will be delivered in the background
+	StatusQueued = "queued"
+	// StatusUnsupported means the integration doesn't handle this type of
+	// message, or anonymous messages
+	StatusUnsupported = "unsupported"
+	// StatusRateLimited means the integration asked to wait before getting
+	// more messages, this one was stored as a dead letter to be replayed
+	StatusRateLimited = "rate_limited"
+)
+
+// Counters of the messages of each integration instance
+const (
+	metricDelivered    = "delivered"
+	metricFailed       = "failed"
+	metricDeadLettered = "deadLettered"
+)
+
+// DeadLetters receives the messages integrations failed to get, once retries
+// are exhausted. Failures are only logged when it's nil.
+var DeadLetters *deadletter.Store
+
+// DrainInterval is how often Drain checks if the retired integrations are done
+var DrainInterval = time.Second
+
+// inFlight counts the messages being delivered, per integration
+var inFlight = struct {
+	sync.Mutex
+	count map[string]int
+}{count: make(map[string]int)}
+
+// Status is the outcome of a message for one integration
+type Status struct {
+	Integration string `json:"integration"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	// Attempts is the number of calls made to the integration
+	Attempts int `json:"attempts,omitempty"`
+	// DeadLetter is the ID of the dead letter created for a failed message
+	DeadLetter string `json:"deadLetter,omitempty"`
+}
+
+// Deliver sends the message to every enabled integration of its source, at
+// the same time. Each of them gets the message independently, so one failing
+// or being slow doesn't prevent the others from receiving it.
+func Deliver(message integrations.Message) (statuses []Status) {
+	source := sources.Get(message.Source)
+	var deliveries []integrations.Instance
+	var indexes []int
+	for _, instance := range integrations.Instances() {
+		integrationName, integration := instance.Name, instance.Integration
+		if !source.Enabled(integrationName) {
+			// Other sources' integrations are not mentioned
+			continue
+		}
+		if !integration.Enabled() {
+			statuses = append(statuses, Status{Integration: integrationName, Status: StatusSkipped})
+			continue
+		}
+		if !message.SupportedBy(integration) {
+			statuses = append(statuses, Status{Integration: integrationName, Status: StatusUnsupported})
+			continue
+		}
+		deliveries = append(deliveries, instance)
+		indexes = append(indexes, len(statuses))
+		statuses = append(statuses, Status{Integration: integrationName})
+	}
+
+	var wg sync.WaitGroup
+	for i, instance := range deliveries {
+		wg.Add(1)
+		go func(index int, instance integrations.Instance) {
+			defer wg.Done()
+			// Out of the request, a panic would take the process down
+			defer func() {
+				if r := recover(); r != nil {
+					err := panicError(instance.Name, r)
+					statuses[index] = Status{Integration: instance.Name, Status: StatusFailed, Error: err.Error()}
+					count(statuses[index])
+				}
+			}()
+			statuses[index] = deliver(instance.Name, instance.Integration, message, false)
+			count(statuses[index])
+		}(indexes[i], instance)
+	}
+	wg.Wait()
+	return
+}
+
+// deliver forwards the message to a single integration and reports how it
+// went, once the integration is delivered fewer messages than its
+// concurrency. When the circuit of the integration is open, or it asked to
+// wait, a queued message is reported as still queued, to be delivered later,
+// instead of failing. Otherwise, a message the integration asked to wait for
+// is reported as rate limited, as waiting would hold the request.
+func deliver(integrationName string, integration integrations.Integration, message integrations.Message, queued bool) Status {
+	throttle := throttleFor(integrationName)
+	throttle.acquire()
+	defer throttle.release()
+
+	inFlight.Lock()
+	inFlight.count[integrationName]++
+	inFlight.Unlock()
+	defer func() {
+		inFlight.Lock()
+		if inFlight.count[integrationName]--; inFlight.count[integrationName] == 0 {
+			delete(inFlight.count, integrationName)
+		}
+		inFlight.Unlock()
+	}()
+
+	logrus.WithField("source", message.Source).Infof("Forwarding %s to %s", message.Type, integrationName)
+	attempts, err := Forward(integrationName, integration, message.Copy())
+	if err == integrations.ErrUnsupported {
+		// e.g. an anonymous message for an integration that only knows users
+		logrus.WithField("integration", integrationName).WithField("source", message.Source).WithField("type", message.Type).Info("Message not supported by integration")
+		return Status{Integration: integrationName, Status: StatusUnsupported, Attempts: attempts}
+	}
+	if err == ErrCircuitOpen && queued {
+		logrus.WithField("integration", integrationName).WithField("source", message.Source).WithField("type", message.Type).Info("Circuit open, keeping the message queued")
+		return Status{Integration: integrationName, Status: StatusQueued, Attempts: attempts}
+	}
+	if err != nil && integrations.Kind(err) == integrations.ErrorRateLimited {
+		if queued {
+			logrus.WithField("integration", integrationName).WithField("source", message.Source).WithField("type", message.Type).Info("Integration paused, keeping the message queued")
+			return Status{Integration: integrationName, Status: StatusQueued, Attempts: attempts}
+		}
+		logrus.WithField("integration", integrationName).WithField("source", message.Source).WithField("type", message.Type).WithField("attempts", attempts).Warn("Integration paused, storing the message as a dead letter")
+		return Status{Integration: integrationName, Status: StatusRateLimited, Error: err.Error(), Attempts: attempts, DeadLetter: deadLetter(integrationName, message, err, attempts)}
+	}
+	if err != nil {
+		kind := integrations.Kind(err)
+		logrus.WithField("integration", integrationName).WithField("source", message.Source).WithField("message", message).WithField("err", err).WithField("kind", kind).WithField("attempts", attempts).Errorf("Fatal error during %s", message.Type)
+		if kind == integrations.ErrorAuth {
+			logrus.WithField("integration", integrationName).Error("The integration refused its credentials, check its settings")
+		}
+		return Status{Integration: integrationName, Status: StatusFailed, Error: err.Error(), Attempts: attempts, DeadLetter: deadLetter(integrationName, message, err, attempts)}
+	}
+	logrus.WithField("integration", integrationName).WithField("source", message.Source).WithField("type", message.Type).WithField("attempts", attempts).Info("Message accepted by integration")
+	return Status{Integration: integrationName, Status: StatusAccepted, Attempts: attempts}
+}
+
+// count adds the outcome of a delivery to the counters of its integration
+// instance
+func count(status Status) {
+	switch status.Status {
+	case StatusAccepted:
+		metrics.Add(metricDelivered, status.Integration, 1)
+	case StatusFailed, StatusRateLimited:
+		metrics.Add(metricFailed, status.Integration, 1)
+	}
+	if status.DeadLetter != "" {
+		metrics.Add(metricDeadLettered, status.Integration, 1)
+	}
+}
+
+// deadLetter stores the message the integration failed to get, and returns the
+// ID of the letter. It's empty without a dead letter store.
+func deadLetter(integrationName string, message integrations.Message, err error, attempts int) string {
+	if DeadLetters == nil {
+		return ""
+	}
+	letter, dlErr := DeadLetters.Add(integrationName, message, err, attempts)
+	if dlErr != nil {
+		logrus.WithField("integration", integrationName).WithField("message", message).WithField("err", dlErr).Error("Error storing dead letter")
+		return ""
+	}
+	return letter.ID
+}
+
+// Replay sends a dead letter to its integration again. The letter is removed
+// from the store once the integration accepts it, and kept otherwise.
+func Replay(store *deadletter.Store, letter deadletter.Letter) Status {
+	status := Status{Integration: letter.Integration, DeadLetter: letter.ID}
+	integration := integrations.GetIntegration(letter.Integration)
+	if integration == nil {
+		status.Status = StatusFailed
+		status.Error = "unknown integration"
+		return status
+	}
+
+	logrus.Infof("Replaying %s %s to %s", letter.Message.Type, letter.ID, letter.Integration)
+	throttle := throttleFor(letter.Integration)
+	throttle.acquire()
+	attempts, err := Forward(letter.Integration, integration, letter.Message.Copy())
+	throttle.release()
+	status.Attempts = attempts
+	if err != nil {
+		logrus.WithField("integration", letter.Integration).WithField("deadLetter", letter.ID).WithField("err", err).Error("Error replaying dead letter")
+		status.Status = StatusFailed
+		status.Error = err.Error()
+		return status
+	}
+
+	status.Status = StatusAccepted
+	if err = store.Remove(letter.Integration, letter.ID); err != nil {
+		logrus.WithField("integration", letter.Integration).WithField("deadLetter", letter.ID).WithField("err", err).Error("Error removing replayed dead letter")
+	}
+	return status
+}
+
+// Forward sends the message to the integration, within its rate limit, and
+// returns the number of calls made. Retryable errors are retried as the retry
+// policy of the integration says, while permanent and authentication errors
+// are returned right away. A rate limited error pauses every call to the
+// integration for the delay it asked for, or the backoff when it didn't tell,
+// and is returned without waiting for it: it can take up to an hour.
+// ErrPaused is returned without calling the integration during the pause,
+// and ErrCircuitOpen while its circuit is open.
+func Forward(integrationName string, integration integrations.Integration, message integrations.Message) (attempts int, err error) {
+	policy := policyFor(integrationName)
+	breaker := breakerFor(integrationName)
+	throttle := throttleFor(integrationName)
+	start := now()
+	for attempt := 0; ; attempt++ {
+		if throttle.paused() > 0 {
+			return attempt, ErrPaused
+		}
+		if ok, _ := breaker.allow(); !ok {
+			return attempt, ErrCircuitOpen
+		}
+		for {
+			ok, wait := throttle.allow()
+			if ok {
+				break
+			}
+			sleep(wait)
+		}
+
+		err = send(integrationName, integration, message)
+		breaker.record(err)
+		if err == nil || err == integrations.ErrUnsupported {
+			return attempt + 1, err
+		}
+		kind := integrations.Kind(err)
+		wait := policy.backoff(attempt)
+		if kind == integrations.ErrorRateLimited {
+			if retryAfter := integrations.RetryAfter(err); retryAfter > 0 {
+				wait = retryAfter
+			}
+			logrus.WithField("integration", integrationName).WithField("wait", wait).Warn("Integration rate limited, pausing its calls")
+			throttle.pause(wait)
+			return attempt + 1, err
+		}
+		if attempt+1 >= policy.attempts() || kind != integrations.ErrorRetryable {
+			return attempt + 1, err
+		}
+		if policy.expired(start, wait) {
+			logrus.WithField("integration", integrationName).WithField("error", err).WithField("attempt", attempt+1).Error("Retry deadline reached, giving up")
+			return attempt + 1, err
+		}
+
+		logrus.WithField("error", err).WithField("kind", kind).WithField("attempt", attempt+1).WithField("wait", wait).Error("Error sending request, retrying")
+		sleep(wait)
+	}
+}
+
+// send makes the call to the integration. A panic of the integration, like on
+// a message missing something it expects, is returned as a permanent error.
+func send(integrationName string, integration integrations.Integration, message integrations.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(integrationName, r)
+		}
+	}()
+	return message.Send(integration)
+}
+
+// panicError logs the panic that happened delivering to the integration, with
+// its stack, and returns it as a permanent error
+func panicError(integrationName string, r interface{}) error {
+	logrus.WithField("integration", integrationName).WithField("panic", r).WithField("stack", string(debug.Stack())).Error("Panic during delivery")
+	return integrations.Permanent(fmt.Errorf("panic: %v", r))
+}
+
+// deliverQueued delivers a queued message. While the circuit of the
+// integration is open or its calls are paused, it's reported as still queued
+// instead, along with how long to wait before delivering it again.
+func deliverQueued(integrationName string, integration integrations.Integration, message integrations.Message) (Status, time.Duration) {
+	status := deliver(integrationName, integration, message, true)
+	if status.Status != StatusQueued {
+		return status, 0
+	}
+	wait := holdOff(integrationName)
+	if wait <= 0 {
+		// Another delivery is probing the integration
+		wait = probeWait
+	}
+	return status, wait
+}
+
+// holdOff returns how long until the integration can be called, while its
+// circuit is open or its calls are paused
+func holdOff(integrationName string) time.Duration {
+	wait := breakerFor(integrationName).wait()
+	if paused := throttleFor(integrationName).paused(); paused > wait {
+		wait = paused
+	}
+	return wait
+}
+
+// Drain waits in the background for the integrations retired by reloading the
+// configuration to be done with their messages: the ones being delivered, and
+// the ones waiting in the queue when there is one. Each is then forgotten. It
+// returns right away.
+func Drain(q *queue.Queue, names []string) {
+	for _, name := range names {
+		go drain(q, name)
+	}
+}
+
+func drain(q *queue.Queue, name string) {
+	logrus.WithField("integration", name).Info("Draining removed integration")
+	// Waiting once first, for the deliveries that just got the integration
+	// before it was removed
+	time.Sleep(DrainInterval)
+	for busy(q, name) {
+		time.Sleep(DrainInterval)
+	}
+	integrations.Drained(name)
+	logrus.WithField("integration", name).Info("Removed integration drained")
+}
+
+// busy tells if the integration still has messages to deliver
+func busy(q *queue.Queue, name string) bool {
+	inFlight.Lock()
+	delivering := inFlight.count[name]
+	inFlight.Unlock()
+	return delivering > 0 || (q != nil && q.Pending(name) > 0)
+}
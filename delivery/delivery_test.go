@@ -0,0 +1,1150 @@
+package delivery
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/deadletter"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/metrics"
+	"github.com/jipiboily/forwardlytics/queue"
+)
+
+func TestWorkDeliversQueuedMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	integration := &recordingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-recording", integration)
+	defer integrations.RemoveIntegration("test-only-integration-recording")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	_, err = q.Enqueue(message, []string{"test-only-integration-recording"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Work(q, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Fatal("Queued message was not acknowledged")
+	}
+	if integration.tracked() != "account.created" {
+		t.Errorf("Expected account.created to be tracked, got %q", integration.tracked())
+	}
+}
+
+func TestWorkAcknowledgesMessagesWhenTheIntegrationPanics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	integrations.RegisterIntegration("test-only-integration-panicking", &panickingIntegration{})
+	defer integrations.RemoveIntegration("test-only-integration-panicking")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	_, err = q.Enqueue(message, []string{"test-only-integration-panicking"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Work(q, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Fatal("Expected the message to be acknowledged, not replayed after a crash")
+	}
+}
+
+type recordingIntegration struct {
+	mu    sync.Mutex
+	event string
+}
+
+func (i *recordingIntegration) Identify(identification integrations.Identification) error {
+	return nil
+}
+
+func (i *recordingIntegration) Track(event integrations.Event) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.event = event.Name
+	return nil
+}
+
+func (i *recordingIntegration) Page(page integrations.Page) error {
+	return nil
+}
+
+func (i *recordingIntegration) Enabled() bool {
+	return true
+}
+
+func (i *recordingIntegration) tracked() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.event
+}
+
+func TestWorkDeadLettersMessagesInterruptingTheirDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	lettersDir, err := ioutil.TempDir("", "forwardlytics-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(lettersDir)
+	DeadLetters, err = deadletter.Open(lettersDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { DeadLetters = nil }()
+
+	integration := &recordingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-interrupted", integration)
+	defer integrations.RemoveIntegration("test-only-integration-interrupted")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	id, err := q.Enqueue(message, []string{"test-only-integration-interrupted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As if the process crashed delivering it every time
+	for i := 0; i < maxInterrupted; i++ {
+		if err = q.Start(id, "test-only-integration-interrupted"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Work(q, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Fatal("Queued message was not acknowledged")
+	}
+	if integration.tracked() != "" {
+		t.Errorf("Expected the message not to be delivered again, got %q", integration.tracked())
+	}
+	letters, err := DeadLetters.List(deadletter.Filter{Integration: "test-only-integration-interrupted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Error != "delivery interrupted 3 times" {
+		t.Errorf("Expected the message in the dead letters, got %#v", letters)
+	}
+}
+
+func TestDeliverStoresDeadLetterOnFailure(t *testing.T) {
+	defer Reset()
+	dir, err := ioutil.TempDir("", "forwardlytics-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	DeadLetters, err = deadletter.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { DeadLetters = nil }()
+
+	integration := &failingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-failing", integration)
+	defer integrations.RemoveIntegration("test-only-integration-failing")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	statuses := Deliver(message)
+	if len(statuses) != 1 || statuses[0].Status != StatusFailed {
+		t.Fatalf("Expected the delivery to fail, got %#v", statuses)
+	}
+
+	letters, err := DeadLetters.List(deadletter.Filter{Integration: "test-only-integration-failing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %v", len(letters))
+	}
+	if statuses[0].DeadLetter != letters[0].ID {
+		t.Errorf("Expected the status to point to dead letter %v, got %v", letters[0].ID, statuses[0].DeadLetter)
+	}
+
+	// Replaying keeps the letter while the integration keeps failing...
+	status := Replay(DeadLetters, letters[0])
+	if status.Status != StatusFailed {
+		t.Errorf("Expected the replay to fail, got %v", status.Status)
+	}
+	if letters, _ = DeadLetters.List(deadletter.Filter{}); len(letters) != 1 {
+		t.Fatalf("Expected the dead letter to be kept, got %v", len(letters))
+	}
+
+	// ...and removes it once accepted.
+	integration.recovered = true
+	status = Replay(DeadLetters, letters[0])
+	if status.Status != StatusAccepted {
+		t.Errorf("Expected the replay to be accepted, got %v", status.Status)
+	}
+	if letters, _ = DeadLetters.List(deadletter.Filter{}); len(letters) != 0 {
+		t.Errorf("Expected the dead letter to be removed, got %v", len(letters))
+	}
+}
+
+func TestDeliverReportsUnsupportedAnonymousMessages(t *testing.T) {
+	integration := &usersOnlyIntegration{}
+	integrations.RegisterIntegration("test-only-integration-users-only", integration)
+	defer integrations.RemoveIntegration("test-only-integration-users-only")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", AnonymousID: "anonymous-456", Timestamp: 1234567},
+	}
+	statuses := Deliver(message)
+	if len(statuses) != 1 || statuses[0].Status != StatusUnsupported {
+		t.Errorf("Expected the anonymous event to be unsupported, got %#v", statuses)
+	}
+}
+
+// usersOnlyIntegration skips the messages of anonymous visitors
+type usersOnlyIntegration struct {
+	recordingIntegration
+}
+
+func (i *usersOnlyIntegration) Track(event integrations.Event) error {
+	if event.UserID == "" {
+		return integrations.ErrUnsupported
+	}
+	return nil
+}
+
+type failingIntegration struct {
+	recordingIntegration
+	recovered bool
+}
+
+func (i *failingIntegration) Track(event integrations.Event) error {
+	if i.recovered {
+		return nil
+	}
+	return errors.New("some random error")
+}
+
+func TestDeliverCountsTheMessagesOfEachInstance(t *testing.T) {
+	defer Reset()
+	defer metrics.Reset()
+	dir, err := ioutil.TempDir("", "forwardlytics-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	DeadLetters, err = deadletter.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { DeadLetters = nil }()
+
+	integrations.RegisterIntegration("test-only-integration-us", &failingIntegration{recovered: true})
+	defer integrations.RemoveIntegration("test-only-integration-us")
+	integrations.RegisterIntegration("test-only-integration-eu", &failingIntegration{})
+	defer integrations.RemoveIntegration("test-only-integration-eu")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	Deliver(message)
+	Deliver(message)
+
+	counters := []struct {
+		name     string
+		instance string
+		expected int64
+	}{
+		{metricDelivered, "test-only-integration-us", 2},
+		{metricFailed, "test-only-integration-us", 0},
+		{metricDelivered, "test-only-integration-eu", 0},
+		{metricFailed, "test-only-integration-eu", 2},
+		{metricDeadLettered, "test-only-integration-eu", 2},
+	}
+	for _, counter := range counters {
+		if value := metrics.Get(counter.name, counter.instance); value != counter.expected {
+			t.Errorf("Expected %s of %s to be %d, got %d", counter.name, counter.instance, counter.expected, value)
+		}
+	}
+}
+
+func TestDeliverFailsWhenTheIntegrationPanics(t *testing.T) {
+	integrations.RegisterIntegration("test-only-integration-panicking", &panickingIntegration{})
+	defer integrations.RemoveIntegration("test-only-integration-panicking")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	statuses := Deliver(message)
+	if len(statuses) != 1 || statuses[0].Status != StatusFailed {
+		t.Fatalf("Expected the delivery to fail, got %#v", statuses)
+	}
+	if statuses[0].Error != "panic: assignment to entry in nil map" {
+		t.Errorf("Expected the panic as the error, got %q", statuses[0].Error)
+	}
+	if statuses[0].Attempts != 1 {
+		t.Errorf("Expected a panic not to be retried, got %d attempts", statuses[0].Attempts)
+	}
+}
+
+// panickingIntegration panics on every event, like on a message missing
+// something it expects
+type panickingIntegration struct {
+	recordingIntegration
+}
+
+func (i *panickingIntegration) Track(event integrations.Event) error {
+	var properties map[string]interface{}
+	properties["name"] = event.Name
+	return nil
+}
+
+func TestDrainKeepsRemovedIntegrationUntilQueueIsDelivered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stops the worker too
+	defer q.Close()
+
+	integration := &recordingIntegration{}
+	drainingIntegration = integration
+	registerDraining.Do(func() {
+		integrations.RegisterFactory("test-only-integration-draining", func(name string) integrations.Integration {
+			return drainingIntegration
+		})
+	})
+	integrations.Configure(map[string]map[string]string{"test-only-integration-draining": {}})
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	if _, err = q.Enqueue(message, []string{"test-only-integration-draining"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(previous time.Duration) { DrainInterval = previous }(DrainInterval)
+	DrainInterval = 10 * time.Millisecond
+	removed := integrations.Configure(map[string]map[string]string{})
+	if len(removed) != 1 || removed[0] != "test-only-integration-draining" {
+		t.Fatalf("Expected the integration to be removed, got %v", removed)
+	}
+	Drain(q, removed)
+
+	time.Sleep(50 * time.Millisecond)
+	if integrations.GetIntegration("test-only-integration-draining") == nil {
+		t.Fatal("The removed integration should be kept until its queued messages are delivered")
+	}
+
+	Work(q, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(integrations.RetiredList()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if integrations.GetIntegration("test-only-integration-draining") != nil {
+		t.Error("The removed integration should be forgotten once drained")
+	}
+	if integration.tracked() != "account.created" {
+		t.Errorf("Expected account.created to be tracked, got %q", integration.tracked())
+	}
+}
+
+// drainingIntegration is made by the test-only-integration-draining factory,
+// registered once for every run of the test
+var (
+	drainingIntegration integrations.Integration
+	registerDraining    sync.Once
+)
+
+// erroringIntegration fails its first calls with the given errors
+type erroringIntegration struct {
+	recordingIntegration
+	errors []error
+	calls  int
+}
+
+func (i *erroringIntegration) Track(event integrations.Event) error {
+	i.calls++
+	if i.calls <= len(i.errors) {
+		return i.errors[i.calls-1]
+	}
+	return nil
+}
+
+func TestForwardRetriesByKindOfError(t *testing.T) {
+	defer Reset()
+	Retries = 3
+	var waits []time.Duration
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	sleep = func(wait time.Duration) {
+		waits = append(waits, wait)
+		clock = clock.Add(wait)
+	}
+	defer func() {
+		Retries = 0
+		sleep = time.Sleep
+		now = time.Now
+	}()
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+
+	tests := []struct {
+		description   string
+		errors        []error
+		expectedCalls int
+		expectedWaits []time.Duration
+		expectedError bool
+	}{
+		{"retryable", []error{errors.New("timeout"), integrations.Retryable(errors.New("server error"))}, 3, []time.Duration{10 * time.Second, 12 * time.Second}, false},
+		{"rate limited", []error{integrations.RateLimited(errors.New("slow down"), time.Minute)}, 1, nil, true},
+		{"permanent", []error{integrations.Permanent(errors.New("email invalid"))}, 1, nil, true},
+		{"auth", []error{integrations.AuthFailure(errors.New("unauthorized"))}, 1, nil, true},
+		{"exhausted", []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout"), errors.New("timeout")}, 4, []time.Duration{10 * time.Second, 12 * time.Second, 28 * time.Second}, true},
+	}
+	for _, test := range tests {
+		// Without the pause or the failures of the previous test
+		Reset()
+		waits = nil
+		integration := &erroringIntegration{errors: test.errors}
+
+		attempts, err := Forward("test-only-integration-erroring", integration, message)
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("Unexpected error when %s: %v", test.description, err)
+		}
+		if integration.calls != test.expectedCalls || attempts != test.expectedCalls {
+			t.Errorf("Expected %d calls when %s, got %d, reporting %d attempts", test.expectedCalls, test.description, integration.calls, attempts)
+		}
+		if len(waits) != len(test.expectedWaits) {
+			t.Errorf("Expected to wait %v when %s, got %v", test.expectedWaits, test.description, waits)
+			continue
+		}
+		for i := range waits {
+			if waits[i] != test.expectedWaits[i] {
+				t.Errorf("Expected to wait %v when %s, got %v", test.expectedWaits, test.description, waits)
+			}
+		}
+	}
+}
+
+func TestForwardWaitsForTheRateLimit(t *testing.T) {
+	Configure(map[string]Settings{"test-only-integration-throttled": {RateLimit: 20}})
+	defer Reset()
+	var waits []time.Duration
+	sleep = func(wait time.Duration) {
+		waits = append(waits, wait)
+		time.Sleep(wait)
+	}
+	defer func() { sleep = time.Sleep }()
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+
+	integration := &erroringIntegration{}
+	for i := 0; i < 21; i++ {
+		if _, err := Forward("test-only-integration-throttled", integration, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if integration.calls != 21 {
+		t.Errorf("Expected 21 calls, got %d", integration.calls)
+	}
+	if len(waits) == 0 {
+		t.Fatal("Expected the calls over the rate limit to wait")
+	}
+	for _, wait := range waits {
+		if wait > 50*time.Millisecond {
+			t.Errorf("Expected to wait at most 50ms between calls, waited %v", wait)
+		}
+	}
+}
+
+func TestForwardPausesRateLimitedIntegration(t *testing.T) {
+	defer Reset()
+	var waits []time.Duration
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	sleep = func(wait time.Duration) {
+		waits = append(waits, wait)
+		clock = clock.Add(wait)
+	}
+	defer func() {
+		sleep = time.Sleep
+		now = time.Now
+	}()
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+
+	limited := &erroringIntegration{errors: []error{integrations.RateLimited(errors.New("slow down"), time.Minute)}}
+	if _, err := Forward("test-only-integration-paused", limited, message); err == nil {
+		t.Fatal("Expected the rate limited call to fail without retries")
+	}
+
+	// The next message is not sent during the pause, the other integrations
+	// are not paused
+	integration := &erroringIntegration{}
+	if attempts, err := Forward("test-only-integration-paused", integration, message); err != ErrPaused || attempts != 0 {
+		t.Errorf("Expected the integration to be paused, got %v after %d attempts", err, attempts)
+	}
+	if _, err := Forward("test-only-integration-not-paused", integration, message); err != nil {
+		t.Fatal(err)
+	}
+	if integration.calls != 1 {
+		t.Errorf("Expected only the other integration to be called, got %d calls", integration.calls)
+	}
+	if len(waits) != 0 {
+		t.Errorf("Expected nothing to wait for the pause, got %v", waits)
+	}
+
+	clock = clock.Add(time.Minute)
+	if _, err := Forward("test-only-integration-paused", integration, message); err != nil {
+		t.Errorf("Expected the integration to be called after the pause, got %v", err)
+	}
+}
+
+func TestWorkKeepsDeliveringWhileAnIntegrationIsPaused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	defer Reset()
+
+	paused := &recordingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-paused", paused)
+	defer integrations.RemoveIntegration("test-only-integration-paused")
+	available := &recordingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-available", available)
+	defer integrations.RemoveIntegration("test-only-integration-available")
+	throttleFor("test-only-integration-paused").pause(200 * time.Millisecond)
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	if _, err = q.Enqueue(message, []string{"test-only-integration-paused"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Enqueue(message, []string{"test-only-integration-available"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single worker, which the paused integration must not hold
+	Work(q, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for available.tracked() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if available.tracked() != "account.created" {
+		t.Fatal("Expected the other integration to get its message during the pause")
+	}
+	if paused.tracked() != "" || q.Pending("test-only-integration-paused") != 1 {
+		t.Error("Expected the message of the paused integration to stay queued")
+	}
+
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 || paused.tracked() != "account.created" {
+		t.Error("Expected the message to be delivered once the pause ended")
+	}
+}
+
+func TestForwardOpensCircuitAfterConsecutiveFailures(t *testing.T) {
+	Configure(map[string]Settings{"test-only-integration-breaking": {FailureThreshold: 2, OpenFor: "1m"}})
+	defer Reset()
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+
+	timeout := errors.New("timeout")
+	integration := &erroringIntegration{errors: []error{timeout, integrations.Permanent(errors.New("email invalid")), timeout, timeout, timeout}}
+	for i := 0; i < 4; i++ {
+		Forward("test-only-integration-breaking", integration, message)
+	}
+	// The permanent error shows the integration is up, only the last 2
+	// timeouts are in a row
+	if integration.calls != 4 {
+		t.Errorf("Expected 4 calls before opening the circuit, got %d", integration.calls)
+	}
+	if _, err := Forward("test-only-integration-breaking", integration, message); err != ErrCircuitOpen {
+		t.Errorf("Expected the circuit to be open, got %v", err)
+	}
+	if integration.calls != 4 {
+		t.Errorf("Expected no call while the circuit is open, got %d", integration.calls)
+	}
+	if state := breakerFor("test-only-integration-breaking").snapshot(); state.State != CircuitOpen || state.ProbeAt != clock.Add(time.Minute).Unix() {
+		t.Errorf("Expected the circuit to be open for a minute, got %#v", state)
+	}
+
+	// The probe fails, opening the circuit again...
+	clock = clock.Add(time.Minute)
+	if _, err := Forward("test-only-integration-breaking", integration, message); err != timeout {
+		t.Errorf("Expected the probe to fail, got %v", err)
+	}
+	if _, err := Forward("test-only-integration-breaking", integration, message); err != ErrCircuitOpen {
+		t.Errorf("Expected the circuit to be open again, got %v", err)
+	}
+
+	// ...until it succeeds
+	clock = clock.Add(time.Minute)
+	if _, err := Forward("test-only-integration-breaking", integration, message); err != nil {
+		t.Errorf("Expected the probe to succeed, got %v", err)
+	}
+	if state := breakerFor("test-only-integration-breaking").snapshot(); state.State != CircuitClosed || state.Failures != 0 {
+		t.Errorf("Expected the circuit to be closed, got %#v", state)
+	}
+}
+
+func TestConfigureFailsWithoutChangesOnInvalidDurations(t *testing.T) {
+	defer Reset()
+	if err := Configure(map[string]Settings{"test-only-integration-configured": {FailureThreshold: 2, OpenFor: "1m"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Configure(map[string]Settings{"test-only-integration-configured": {FailureThreshold: 3, Retry: RetryPolicy{Deadline: "soon"}}})
+	if err == nil || err.Error() != `delivery.test-only-integration-configured.retry.deadline: time: invalid duration "soon"` {
+		t.Errorf("Expected the invalid deadline to be reported, got %v", err)
+	}
+	b := breakerFor("test-only-integration-configured")
+	if b.threshold != 2 || b.openFor != time.Minute {
+		t.Errorf("Expected the settings to be kept, got a threshold of %d and %v open", b.threshold, b.openFor)
+	}
+}
+
+func TestHalfOpenCircuitLetsASingleProbeThrough(t *testing.T) {
+	b := newBreaker("test-only-integration-probed")
+	b.configure(config{Settings: Settings{FailureThreshold: 1}})
+	b.record(errors.New("timeout"))
+	b.openedAt = b.openedAt.Add(-DefaultOpenFor)
+
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("Expected the probe to be allowed")
+	}
+	if ok, wait := b.allow(); ok || wait != probeWait {
+		t.Errorf("Expected other calls to wait for the probe, got %v, %v", ok, wait)
+	}
+	if wait := b.wait(); wait != probeWait {
+		t.Errorf("Expected to wait for the probe, got %v", wait)
+	}
+	b.record(nil)
+	if ok, _ := b.allow(); !ok {
+		t.Error("Expected calls to go through once the probe succeeded")
+	}
+}
+
+func TestWorkKeepsMessagesQueuedWhileCircuitIsOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	var mu sync.Mutex
+	clock := time.Now()
+	var waited time.Duration
+	now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	}
+	sleep = func(wait time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		waited += wait
+		clock = clock.Add(wait)
+	}
+	defer func() {
+		now = time.Now
+		sleep = time.Sleep
+	}()
+
+	integration := &recordingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-circuit-open", integration)
+	defer integrations.RemoveIntegration("test-only-integration-circuit-open")
+	Configure(map[string]Settings{"test-only-integration-circuit-open": {FailureThreshold: 1, OpenFor: "1m"}})
+	defer Reset()
+	breakerFor("test-only-integration-circuit-open").record(errors.New("timeout"))
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	if _, err = q.Enqueue(message, []string{"test-only-integration-circuit-open"}); err != nil {
+		t.Fatal(err)
+	}
+
+	Work(q, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Fatal("Queued message was not acknowledged")
+	}
+	if integration.tracked() != "account.created" {
+		t.Errorf("Expected account.created to be tracked once the circuit closed, got %q", integration.tracked())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if waited != time.Minute {
+		t.Errorf("Expected to wait a minute for the circuit, waited %v", waited)
+	}
+}
+
+func TestForwardFollowsTheRetryPolicyOfTheIntegration(t *testing.T) {
+	Configure(map[string]Settings{
+		"test-only-integration-policy":   {Retry: RetryPolicy{MaxAttempts: 5, InitialBackoff: "1s", MaxBackoff: "3s", Jitter: 0.5}},
+		"test-only-integration-deadline": {Retry: RetryPolicy{MaxAttempts: 10, InitialBackoff: "1s", Deadline: "5s"}},
+	})
+	defer Reset()
+	var waits []time.Duration
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	sleep = func(wait time.Duration) {
+		waits = append(waits, wait)
+		clock = clock.Add(wait)
+	}
+	random = func() float64 { return 0.5 }
+	defer func() {
+		sleep = time.Sleep
+		now = time.Now
+		random = rand.Float64
+	}()
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	timeouts := func(n int) []error {
+		errs := make([]error, n)
+		for i := range errs {
+			errs[i] = errors.New("timeout")
+		}
+		return errs
+	}
+
+	tests := []struct {
+		integration      string
+		expectedAttempts int
+		expectedWaits    []time.Duration
+	}{
+		// Doubling from 1s, capped at 3s, shortened by a quarter
+		{"test-only-integration-policy", 5, []time.Duration{750 * time.Millisecond, 1500 * time.Millisecond, 2250 * time.Millisecond, 2250 * time.Millisecond}},
+		// 1s, 2s, then 4s more would end after the 5s deadline
+		{"test-only-integration-deadline", 3, []time.Duration{time.Second, 2 * time.Second}},
+	}
+	for _, test := range tests {
+		waits = nil
+		integration := &erroringIntegration{errors: timeouts(10)}
+
+		attempts, err := Forward(test.integration, integration, message)
+
+		if err == nil {
+			t.Errorf("Expected %s to give up", test.integration)
+		}
+		if attempts != test.expectedAttempts || integration.calls != test.expectedAttempts {
+			t.Errorf("Expected %d attempts for %s, got %d, with %d calls", test.expectedAttempts, test.integration, attempts, integration.calls)
+		}
+		if !reflect.DeepEqual(waits, test.expectedWaits) {
+			t.Errorf("Expected %s to wait %v, got %v", test.integration, test.expectedWaits, waits)
+		}
+	}
+}
+
+// blockingIntegration tracks events once released, telling when it starts
+type blockingIntegration struct {
+	recordingIntegration
+	started chan string
+	release chan struct{}
+}
+
+func (i *blockingIntegration) Track(event integrations.Event) error {
+	i.started <- event.Name
+	<-i.release
+	return nil
+}
+
+func TestDeliverCallsIntegrationsConcurrently(t *testing.T) {
+	started := make(chan string)
+	release := make(chan struct{})
+	integrations.RegisterIntegration("test-only-integration-blocking-1", &blockingIntegration{started: started, release: release})
+	defer integrations.RemoveIntegration("test-only-integration-blocking-1")
+	integrations.RegisterIntegration("test-only-integration-blocking-2", &blockingIntegration{started: started, release: release})
+	defer integrations.RemoveIntegration("test-only-integration-blocking-2")
+
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+	done := make(chan []Status)
+	go func() { done <- Deliver(message) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected both integrations to be called at the same time")
+		}
+	}
+	close(release)
+
+	statuses := <-done
+	if len(statuses) != 2 || statuses[0].Integration != "test-only-integration-blocking-1" || statuses[1].Integration != "test-only-integration-blocking-2" {
+		t.Fatalf("Expected the statuses in the order of the integrations, got %#v", statuses)
+	}
+	for _, status := range statuses {
+		if status.Status != StatusAccepted {
+			t.Errorf("Expected %s to accept the message, got %v", status.Integration, status.Status)
+		}
+	}
+}
+
+func TestDeliverCapsTheConcurrencyOfTheIntegration(t *testing.T) {
+	Configure(map[string]Settings{"test-only-integration-capped": {Concurrency: 2}})
+	defer Reset()
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	integration := &blockingIntegration{started: started, release: release}
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliver("test-only-integration-capped", integration, message, false)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(started) != 2 {
+		t.Errorf("Expected 2 messages delivered at once, got %d", len(started))
+	}
+	close(release)
+	wg.Wait()
+	if len(started) != 3 {
+		t.Errorf("Expected the last message to be delivered once the others were, got %d", len(started))
+	}
+}
+
+// orderingIntegration records the events of each user, the slow ones taking
+// a while
+type orderingIntegration struct {
+	recordingIntegration
+	mu     sync.Mutex
+	events map[string][]string
+}
+
+func (i *orderingIntegration) Track(event integrations.Event) error {
+	if strings.HasPrefix(event.Name, "slow") {
+		time.Sleep(50 * time.Millisecond)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.events[event.UserID] = append(i.events[event.UserID], event.Name)
+	return nil
+}
+
+func TestWorkKeepsTheOrderOfTheMessagesOfEachUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	integration := &orderingIntegration{events: make(map[string][]string)}
+	integrations.RegisterIntegration("test-only-integration-ordering", integration)
+	defer integrations.RemoveIntegration("test-only-integration-ordering")
+
+	events := []struct{ user, name string }{
+		{"123", "slow.first"},
+		{"456", "first"},
+		{"123", "second"},
+		{"456", "slow.second"},
+		{"123", "third"},
+	}
+	for _, event := range events {
+		message := integrations.Message{
+			Type:  integrations.TypeTrack,
+			Event: &integrations.Event{Name: event.name, UserID: event.user, Timestamp: 1234567},
+		}
+		if _, err = q.Enqueue(message, []string{"test-only-integration-ordering"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Work(q, 4)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Fatal("Queued messages were not acknowledged")
+	}
+	integration.mu.Lock()
+	defer integration.mu.Unlock()
+	expected := map[string][]string{
+		"123": {"slow.first", "second", "third"},
+		"456": {"first", "slow.second"},
+	}
+	if !reflect.DeepEqual(integration.events, expected) {
+		t.Errorf("Expected the events of each user in order, %v, got %v", expected, integration.events)
+	}
+}
+
+func TestWorkKeepsWorkersForTheOtherIntegrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	Configure(map[string]Settings{"test-only-integration-slow": {Concurrency: 1}})
+	defer Reset()
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	integrations.RegisterIntegration("test-only-integration-slow", &blockingIntegration{started: started, release: release})
+	defer integrations.RemoveIntegration("test-only-integration-slow")
+	integration := &recordingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-fast", integration)
+	defer integrations.RemoveIntegration("test-only-integration-fast")
+
+	for _, user := range []string{"1", "2", "3"} {
+		message := integrations.Message{
+			Type:  integrations.TypeTrack,
+			Event: &integrations.Event{Name: "slow.created", UserID: user, Timestamp: 1234567},
+		}
+		if _, err = q.Enqueue(message, []string{"test-only-integration-slow"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "fast.created", UserID: "4", Timestamp: 1234567},
+	}
+	if _, err = q.Enqueue(message, []string{"test-only-integration-fast"}); err != nil {
+		t.Fatal(err)
+	}
+
+	Work(q, 2)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for integration.tracked() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if integration.tracked() != "fast.created" {
+		t.Errorf("Expected the other integration to get its message while the slow one is busy, got %q", integration.tracked())
+	}
+	if len(started) != 1 {
+		t.Errorf("Expected a single message delivered to the slow integration at once, got %d", len(started))
+	}
+	close(release)
+
+	for q.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.Len() != 0 {
+		t.Fatal("Queued messages were not acknowledged")
+	}
+}
+
+func TestWorkTakesABoundedNumberOfMessagesFromTheQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	integrations.RegisterIntegration("test-only-integration-stuck", &blockingIntegration{started: started, release: release})
+	defer integrations.RemoveIntegration("test-only-integration-stuck")
+	defer close(release)
+
+	for i := 0; i < pendingPerWorker+10; i++ {
+		message := integrations.Message{
+			Type:  integrations.TypeTrack,
+			Event: &integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567},
+		}
+		if _, err = q.Enqueue(message, []string{"test-only-integration-stuck"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := newPool(q, 1)
+	p.start()
+	<-started
+	time.Sleep(50 * time.Millisecond)
+
+	p.mu.Lock()
+	pending := p.pending
+	p.mu.Unlock()
+	if pending != pendingPerWorker {
+		t.Errorf("Expected %d messages taken from the queue, got %d", pendingPerWorker, pending)
+	}
+}
+
+func TestWorkKeepsDeliveringWhileOtherIntegrationsAreDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	down := []string{"test-only-integration-down-1", "test-only-integration-down-2", "test-only-integration-paused"}
+	Configure(map[string]Settings{
+		down[0]: {FailureThreshold: 1, OpenFor: "1h"},
+		down[1]: {FailureThreshold: 1, OpenFor: "1h"},
+	})
+	defer Reset()
+	breakerFor(down[0]).record(errors.New("timeout"))
+	breakerFor(down[1]).record(errors.New("timeout"))
+	throttleFor(down[2]).pause(time.Hour)
+	for _, name := range down {
+		integrations.RegisterIntegration(name, &recordingIntegration{})
+		defer integrations.RemoveIntegration(name)
+	}
+	integration := &recordingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-up", integration)
+	defer integrations.RemoveIntegration("test-only-integration-up")
+
+	for _, user := range []string{"1", "2", "3", "4"} {
+		message := integrations.Message{
+			Type:  integrations.TypeTrack,
+			Event: &integrations.Event{Name: "down.created", UserID: user, Timestamp: 1234567},
+		}
+		if _, err = q.Enqueue(message, down); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := integrations.Message{
+		Type:  integrations.TypeTrack,
+		Event: &integrations.Event{Name: "up.created", UserID: "5", Timestamp: 1234567},
+	}
+	if _, err = q.Enqueue(message, []string{"test-only-integration-up"}); err != nil {
+		t.Fatal(err)
+	}
+
+	Work(q, 2)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for integration.tracked() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if integration.tracked() != "up.created" {
+		t.Errorf("Expected the integration that is up to get its message, got %q", integration.tracked())
+	}
+	for _, name := range down {
+		if pending := q.Pending(name); pending != 4 {
+			t.Errorf("Expected the messages of %s to stay queued, got %d", name, pending)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package delivery
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/queue"
+)
+
+// maxInterrupted is how many times the delivery of a queued message to an
+// integration can be interrupted, like by a crash of the process, before it's
+// moved to the dead letters instead of being delivered again
+const maxInterrupted = 3
+
+// pendingPerWorker is how many deliveries are taken from the queue for each
+// worker, waiting for their turn in memory. The rest stays in the queue.
+const pendingPerWorker = 64
+
+// Work starts the given number of workers, delivering the queued messages to
+// their integrations until the queue is closed. It returns right away.
+// Each worker delivers one message at a time, to the integrations that are
+// delivered fewer messages than their concurrency. The messages about the same
+// user still reach each integration in the order they were queued. The
+// messages of an integration whose circuit is open, or that asked to wait,
+// are put off without holding a worker.
+func Work(q *queue.Queue, workers int) {
+	newPool(q, workers).start()
+}
+
+// pool hands the queued messages to its workers, through lanes: one per
+// integration and user, delivering its messages in order
+type pool struct {
+	q          *queue.Queue
+	workers    int
+	maxPending int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// lanes by integration and user, while they have messages
+	lanes map[laneKey]*lane
+	// runnable are the lanes with messages that no worker is delivering,
+	// taken in turn
+	runnable []*lane
+	// busy counts the workers delivering to each integration
+	busy map[string]int
+	// pending counts the deliveries taken from the queue and not done yet
+	pending int
+	closed  bool
+	// wakeup is when the workers are woken up for the lanes put off until
+	// then, zero when none is scheduled
+	wakeup time.Time
+}
+
+func newPool(q *queue.Queue, workers int) *pool {
+	p := &pool{
+		q:          q,
+		workers:    workers,
+		maxPending: workers * pendingPerWorker,
+		lanes:      make(map[laneKey]*lane),
+		busy:       make(map[string]int),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pool) start() {
+	for i := 0; i < p.workers; i++ {
+		go p.work()
+	}
+	go p.run()
+}
+
+type laneKey struct {
+	integration string
+	user        string
+}
+
+// lane holds the messages waiting to be delivered to an integration about a
+// user, oldest first
+type lane struct {
+	key     laneKey
+	entries []queue.Entry
+	// notBefore is when the lane can be delivered again, after it was put off
+	notBefore time.Time
+}
+
+// run takes the entries from the queue into their lanes, as long as fewer
+// than maxPending deliveries are waiting
+func (p *pool) run() {
+	for {
+		p.mu.Lock()
+		for p.pending >= p.maxPending {
+			p.cond.Wait()
+		}
+		p.mu.Unlock()
+
+		entry, ok := p.q.Next()
+		if !ok {
+			p.mu.Lock()
+			p.closed = true
+			p.cond.Broadcast()
+			p.mu.Unlock()
+			return
+		}
+
+		p.mu.Lock()
+		for _, integrationName := range entry.Destinations {
+			p.push(laneKey{integration: integrationName, user: entry.Message.UserKey()}, entry)
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// push adds the entry to its lane, making a new lane runnable
+func (p *pool) push(key laneKey, entry queue.Entry) {
+	p.pending++
+	l := p.lanes[key]
+	if l == nil {
+		l = &lane{key: key}
+		p.lanes[key] = l
+		p.runnable = append(p.runnable, l)
+	}
+	l.entries = append(l.entries, entry)
+}
+
+func (p *pool) work() {
+	for {
+		l, ok := p.take()
+		if !ok {
+			return
+		}
+		notBefore := p.deliver(l.key.integration, l.entries[0])
+		p.done(l, notBefore)
+	}
+}
+
+// take waits for a runnable lane whose integration can be delivered one more
+// message, and that is not put off, and hands it to the worker. It returns
+// false once the queue is closed.
+func (p *pool) take() (*lane, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.closed {
+			return nil, false
+		}
+		current := now()
+		var next time.Time
+		for i, l := range p.runnable {
+			if current.Before(l.notBefore) {
+				if next.IsZero() || l.notBefore.Before(next) {
+					next = l.notBefore
+				}
+				continue
+			}
+			if p.busy[l.key.integration] < throttleFor(l.key.integration).limit() {
+				p.runnable = append(p.runnable[:i], p.runnable[i+1:]...)
+				p.busy[l.key.integration]++
+				return l, true
+			}
+		}
+		if !next.IsZero() {
+			p.wakeAt(next)
+		}
+		p.cond.Wait()
+	}
+}
+
+// wakeAt wakes the workers up at that time, unless it's already planned
+// sooner
+func (p *pool) wakeAt(at time.Time) {
+	if !p.wakeup.IsZero() && !at.Before(p.wakeup) {
+		return
+	}
+	p.wakeup = at
+	go func() {
+		sleep(at.Sub(now()))
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.wakeup.Equal(at) {
+			p.wakeup = time.Time{}
+		}
+		p.cond.Broadcast()
+	}()
+}
+
+// done removes the entry the worker delivered from the lane, which goes back
+// to the end of the runnable ones when it has more. When the entry was put
+// off, it stays in the lane until notBefore.
+func (p *pool) done(l *lane, notBefore time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.busy[l.key.integration]--; p.busy[l.key.integration] == 0 {
+		delete(p.busy, l.key.integration)
+	}
+	l.notBefore = notBefore
+	if notBefore.IsZero() {
+		l.entries = l.entries[1:]
+		p.pending--
+	}
+	if len(l.entries) == 0 {
+		delete(p.lanes, l.key)
+	} else {
+		p.runnable = append(p.runnable, l)
+	}
+	p.cond.Broadcast()
+}
+
+// deliver sends the entry to the integration and acknowledges it. An entry
+// whose delivery keeps being interrupted goes to the dead letters instead, so
+// that a message crashing the process doesn't do it on every restart. While
+// the circuit of the integration is open, or it asked to wait, the entry is
+// not acknowledged but put off: deliver returns when to deliver it again.
+func (p *pool) deliver(integrationName string, entry queue.Entry) (notBefore time.Time) {
+	status := Status{Integration: integrationName, Status: StatusFailed, Error: "unknown integration"}
+	integration := integrations.GetIntegration(integrationName)
+	if integration == nil {
+		logrus.WithField("integration", integrationName).WithField("id", entry.ID).Error("Queued message is for an unknown integration")
+	} else if !entry.Message.SupportedBy(integration) {
+		status = Status{Integration: integrationName, Status: StatusUnsupported}
+	} else if interrupted := entry.Starts[integrationName]; interrupted >= maxInterrupted {
+		err := fmt.Errorf("delivery interrupted %d times", interrupted)
+		logrus.WithField("integration", integrationName).WithField("id", entry.ID).WithField("interrupted", interrupted).Error("Delivery of queued message keeps being interrupted, giving up")
+		status = Status{Integration: integrationName, Status: StatusFailed, Error: err.Error(), DeadLetter: deadLetter(integrationName, entry.Message, err, 0)}
+	} else if wait := holdOff(integrationName); wait > 0 {
+		return now().Add(wait)
+	} else {
+		if err := p.q.Start(entry.ID, integrationName); err != nil {
+			logrus.WithField("integration", integrationName).WithField("id", entry.ID).WithField("err", err).Error("Error recording the start of a queued delivery")
+		}
+		var wait time.Duration
+		status, wait = p.deliverSafely(integrationName, integration, entry)
+		if wait > 0 {
+			if err := p.q.Postpone(entry.ID, integrationName); err != nil {
+				logrus.WithField("integration", integrationName).WithField("id", entry.ID).WithField("err", err).Error("Error postponing a queued delivery")
+			}
+			return now().Add(wait)
+		}
+	}
+
+	count(status)
+	err := p.q.Ack(entry.ID, integrationName, status.Status)
+	if err != nil {
+		logrus.WithField("integration", integrationName).WithField("id", entry.ID).WithField("err", err).Error("Error acknowledging queued message")
+	}
+	return time.Time{}
+}
+
+// deliverSafely delivers the entry, failing it when the delivery panics
+func (p *pool) deliverSafely(integrationName string, integration integrations.Integration, entry queue.Entry) (status Status, wait time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := panicError(integrationName, r)
+			status = Status{Integration: integrationName, Status: StatusFailed, Error: err.Error(), DeadLetter: deadLetter(integrationName, entry.Message, err, 0)}
+			wait = 0
+		}
+	}()
+	return deliverQueued(integrationName, integration, entry.Message)
+}
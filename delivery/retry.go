@@ -0,0 +1,96 @@
+package delivery
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Retries is the number of times a call to an integration is retried on
+// error, when its retry policy doesn't set the number of attempts
+var Retries int
+
+// retryPolicy is the RetryPolicy of an integration, with its durations read
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	deadline       time.Duration
+}
+
+var policies = struct {
+	sync.Mutex
+	byName map[string]retryPolicy
+}{byName: make(map[string]retryPolicy)}
+
+// random is replaced in tests
+var random = rand.Float64
+
+// sleep is replaced in tests
+var sleep = time.Sleep
+
+// read reads the durations of the retry policy
+func (p RetryPolicy) read() (policy retryPolicy, err error) {
+	policy = retryPolicy{maxAttempts: p.MaxAttempts, jitter: p.Jitter}
+	if policy.initialBackoff, err = parseDuration(p.InitialBackoff); err != nil {
+		return policy, fmt.Errorf("initialBackoff: %v", err)
+	}
+	if policy.maxBackoff, err = parseDuration(p.MaxBackoff); err != nil {
+		return policy, fmt.Errorf("maxBackoff: %v", err)
+	}
+	if policy.deadline, err = parseDuration(p.Deadline); err != nil {
+		return policy, fmt.Errorf("deadline: %v", err)
+	}
+	return policy, nil
+}
+
+// configurePolicies replaces the retry policies of the integration instances
+func configurePolicies(configs map[string]config) {
+	byName := make(map[string]retryPolicy, len(configs))
+	for name, c := range configs {
+		byName[name] = c.policy
+	}
+
+	policies.Lock()
+	defer policies.Unlock()
+	policies.byName = byName
+}
+
+// policyFor returns the retry policy of the integration
+func policyFor(name string) retryPolicy {
+	policies.Lock()
+	defer policies.Unlock()
+	return policies.byName[name]
+}
+
+// attempts returns the number of calls made for a message at most
+func (p retryPolicy) attempts() int {
+	if p.maxAttempts > 0 {
+		return p.maxAttempts
+	}
+	return Retries + 1
+}
+
+// backoff is how long to wait after the attempt failed, longer every time
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	var wait time.Duration
+	if p.initialBackoff == 0 {
+		seconds := attempt*attempt*attempt*attempt + attempt + 10
+		wait = time.Duration(seconds) * time.Second
+	} else if wait = p.initialBackoff << uint(attempt); attempt > 32 || wait < p.initialBackoff {
+		// Overflowed
+		wait = p.maxBackoff
+	}
+	if p.maxBackoff != 0 && wait > p.maxBackoff {
+		wait = p.maxBackoff
+	}
+	return wait - time.Duration(p.jitter*random()*float64(wait))
+}
+
+// expired tells if waiting that long before the next attempt would go past
+// the deadline of the delivery started at start
+func (p retryPolicy) expired(start time.Time, wait time.Duration) bool {
+	return p.deadline != 0 && now().Add(wait).Sub(start) > p.deadline
+}
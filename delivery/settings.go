@@ -0,0 +1,166 @@
+package delivery
+
+import (
+	"fmt"
+	"time"
+)
+
+// Settings configures the delivery to an integration instance
+type Settings struct {
+	// RateLimit is the number of calls per second the integration gets at
+	// most. Unlimited when 0.
+	RateLimit float64 `yaml:"rateLimit"`
+
+	// FailureThreshold is the number of calls failing in a row that opens
+	// the circuit of the integration. DefaultFailureThreshold when 0.
+	FailureThreshold int `yaml:"failureThreshold"`
+
+	// OpenFor is how long the circuit stays open before probing the
+	// integration, as a duration (e.g. 30s). DefaultOpenFor when empty.
+	OpenFor string `yaml:"openFor"`
+
+	Retry RetryPolicy `yaml:"retry"`
+
+	// Concurrency is the number of messages delivered to the integration at
+	// once, at most. DefaultConcurrency when 0.
+	Concurrency int `yaml:"concurrency"`
+}
+
+// RetryPolicy configures how the calls the integration failed are retried
+type RetryPolicy struct {
+	// MaxAttempts is the number of calls made for a message at most,
+	// including the first one. Retries + 1 when 0.
+	MaxAttempts int `yaml:"maxAttempts"`
+
+	// InitialBackoff is the wait after the first failed call, doubling after
+	// each of the next ones, as a duration (e.g. 1s). When empty, the waits
+	// are 10s, 12s, 28s, 94s and so on.
+	InitialBackoff string `yaml:"initialBackoff"`
+
+	// MaxBackoff caps the wait between two calls, as a duration. Optional.
+	MaxBackoff string `yaml:"maxBackoff"`
+
+	// Jitter shortens each wait by a random fraction of it, up to this one,
+	// so that the workers don't all call again at once. Between 0 and 1.
+	Jitter float64 `yaml:"jitter"`
+
+	// Deadline is how long delivering a message can take, retries included,
+	// as a duration (e.g. 5m). No retry starts past it. Optional.
+	Deadline string `yaml:"deadline"`
+}
+
+// config is the Settings of an integration instance, with its durations read
+type config struct {
+	Settings
+	openFor time.Duration
+	policy  retryPolicy
+}
+
+// now is replaced in tests
+var now = time.Now
+
+// Validate returns the problems of the settings
+func (s Settings) Validate() (problems []string) {
+	if s.RateLimit < 0 {
+		problems = append(problems, "rateLimit can't be negative")
+	}
+	if s.Concurrency < 0 {
+		problems = append(problems, "concurrency can't be negative")
+	}
+	if s.FailureThreshold < 0 {
+		problems = append(problems, "failureThreshold can't be negative")
+	}
+	if _, err := parseDuration(s.OpenFor); err != nil {
+		problems = append(problems, fmt.Sprintf("openFor should be a positive duration, like 30s, got %q", s.OpenFor))
+	}
+	for _, problem := range s.Retry.Validate() {
+		problems = append(problems, "retry."+problem)
+	}
+	return
+}
+
+// Validate returns the problems of the retry policy
+func (p RetryPolicy) Validate() (problems []string) {
+	if p.MaxAttempts < 0 {
+		problems = append(problems, "maxAttempts can't be negative")
+	}
+	durations := []struct {
+		name, value, example string
+	}{
+		{"initialBackoff", p.InitialBackoff, "1s"},
+		{"maxBackoff", p.MaxBackoff, "1m"},
+		{"deadline", p.Deadline, "5m"},
+	}
+	for _, duration := range durations {
+		if _, err := parseDuration(duration.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s should be a positive duration, like %s, got %q", duration.name, duration.example, duration.value))
+		}
+	}
+	initial, _ := parseDuration(p.InitialBackoff)
+	max, _ := parseDuration(p.MaxBackoff)
+	if max != 0 && initial > max {
+		problems = append(problems, "initialBackoff can't be longer than maxBackoff")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		problems = append(problems, "jitter should be between 0 and 1")
+	}
+	return
+}
+
+// parseDuration reads an optional positive duration, zero when empty
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err == nil && duration <= 0 {
+		err = fmt.Errorf("duration %q is not positive", value)
+	}
+	return duration, err
+}
+
+// read reads the durations of the settings
+func (s Settings) read() (config, error) {
+	openFor, err := parseDuration(s.OpenFor)
+	if err != nil {
+		return config{}, fmt.Errorf("openFor: %v", err)
+	}
+	policy, err := s.Retry.read()
+	if err != nil {
+		return config{}, fmt.Errorf("retry.%v", err)
+	}
+	return config{Settings: s, openFor: openFor, policy: policy}, nil
+}
+
+// Configure applies the delivery settings of each integration instance, by
+// name. The instances without settings are unlimited, with the default
+// concurrency, circuit breaker and retry policy. Pauses asked by the
+// integrations and the state of the circuits are kept.
+// Nothing changes when a duration of the settings can't be read.
+func Configure(settings map[string]Settings) error {
+	configs := make(map[string]config, len(settings))
+	for name, s := range settings {
+		c, err := s.read()
+		if err != nil {
+			return fmt.Errorf("delivery.%s.%v", name, err)
+		}
+		configs[name] = c
+	}
+	configureThrottles(configs)
+	configureBreakers(configs)
+	configurePolicies(configs)
+	return nil
+}
+
+// Reset forgets the circuits, throttles and retry policies of every
+// integration, as if nothing was configured or delivered yet. It's meant for
+// tests, so that the failures of one don't open the circuit of the next.
+func Reset() {
+	breakers.Lock()
+	breakers.byName = make(map[string]*breaker)
+	breakers.Unlock()
+	throttles.Lock()
+	throttles.byName = make(map[string]*throttle)
+	throttles.Unlock()
+	configurePolicies(nil)
+}
@@ -0,0 +1,151 @@
+package delivery
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/ratelimit"
+)
+
+// DefaultConcurrency is the number of messages delivered to an integration at
+// once, when its settings don't tell
+const DefaultConcurrency = 4
+
+// ErrPaused is returned instead of calling an integration that asked to wait,
+// until the pause ends
+var ErrPaused = integrations.RateLimited(errors.New("paused, the integration asked to wait"), 0)
+
+// throttle spaces the calls to an integration to its rate limit, pauses them
+// when the integration asks to wait, and caps the messages delivered to it at
+// once
+type throttle struct {
+	mu          sync.Mutex
+	rate        float64
+	limiter     *ratelimit.Limiter
+	pausedUntil time.Time
+	concurrency int
+	active      int
+	// released is signaled when a delivery ends
+	released *sync.Cond
+}
+
+var throttles = struct {
+	sync.Mutex
+	byName map[string]*throttle
+}{byName: make(map[string]*throttle)}
+
+// configureThrottles applies the rate limit of each integration instance,
+// keeping the pauses asked by the integrations
+func configureThrottles(configs map[string]config) {
+	throttles.Lock()
+	defer throttles.Unlock()
+	for name, t := range throttles.byName {
+		t.configure(configs[name])
+	}
+	for name, c := range configs {
+		if throttles.byName[name] == nil {
+			t := newThrottle()
+			t.configure(c)
+			throttles.byName[name] = t
+		}
+	}
+}
+
+// throttleFor returns the throttle of the integration
+func throttleFor(name string) *throttle {
+	throttles.Lock()
+	defer throttles.Unlock()
+	t := throttles.byName[name]
+	if t == nil {
+		t = newThrottle()
+		throttles.byName[name] = t
+	}
+	return t
+}
+
+func newThrottle() *throttle {
+	t := &throttle{concurrency: DefaultConcurrency}
+	t.released = sync.NewCond(&t.mu)
+	return t
+}
+
+// configure replaces the concurrency and the rate limit, starting a new
+// bucket when it changed
+func (t *throttle) configure(c config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.concurrency = DefaultConcurrency
+	if c.Concurrency > 0 {
+		t.concurrency = c.Concurrency
+	}
+	// Deliveries waiting can start when the concurrency grew
+	t.released.Broadcast()
+
+	if c.RateLimit == t.rate {
+		return
+	}
+	t.rate = c.RateLimit
+	t.limiter = nil
+	if t.rate > 0 {
+		t.limiter = ratelimit.New(t.rate, 0)
+	}
+}
+
+// acquire waits until fewer messages than the concurrency are being delivered
+// to the integration, and counts one more. Call release once done.
+func (t *throttle) acquire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.active >= t.concurrency {
+		t.released.Wait()
+	}
+	t.active++
+}
+
+func (t *throttle) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active--
+	t.released.Signal()
+}
+
+// limit returns the number of messages delivered to the integration at once
+func (t *throttle) limit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.concurrency
+}
+
+// allow takes a call from the integration's rate limit, and tells if it can
+// be made now. When it can't, it returns how long until it can.
+func (t *throttle) allow() (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limiter == nil {
+		return true, 0
+	}
+	return t.limiter.Allow("")
+}
+
+// paused returns how long until the pause the integration asked for ends, zero
+// when it's not paused
+func (t *throttle) paused() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if paused := t.pausedUntil.Sub(now()); paused > 0 {
+		return paused
+	}
+	return 0
+}
+
+// pause holds the calls to the integration for that long, e.g. when it
+// answered that it got too many
+func (t *throttle) pause(wait time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := now().Add(wait); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
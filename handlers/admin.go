@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/config"
+	"github.com/jipiboily/forwardlytics/delivery"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/metrics"
+)
+
+// Reloader reads the configuration again and applies it. Reloading is not
+// available when it's nil.
+var Reloader func() error
+
+type reloadResponse struct {
+	Message string `json:"message"`
+	// Integrations are the instances enabled by the new configuration
+	Integrations []string `json:"integrations"`
+	// Draining are the instances removed, still delivering their messages
+	Draining []string `json:"draining,omitempty"`
+}
+
+type invalidConfigResponse struct {
+	Message string `json:"message"`
+	// Problems of the configuration, which is not applied
+	Problems []string `json:"problems"`
+}
+
+// Reload applies the configuration again, like sending SIGHUP to the process:
+//
+//	POST /admin/reload
+func Reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if Reloader == nil {
+		writeResponse(w, "Reloading the configuration is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	err := Reloader()
+	if configErr, ok := err.(*config.Error); ok {
+		response := invalidConfigResponse{Message: "Invalid configuration, keeping the current one.", Problems: configErr.Problems}
+		writeAdminResponse(w, response.Message, response, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logrus.WithField("err", err).Error("Error reloading the configuration")
+		writeResponse(w, "Error reloading the configuration.", http.StatusInternalServerError)
+		return
+	}
+
+	response := reloadResponse{
+		Message:      "Configuration reloaded.",
+		Integrations: append([]string{}, integrations.IntegrationList()...),
+		Draining:     integrations.RetiredList(),
+	}
+	writeAdminResponse(w, response.Message, response, http.StatusOK)
+}
+
+// Metrics returns the counters of what happened since Forwardlytics started,
+// by name and label, like the requests refused by the rate limit of each
+// source:
+//
+//	GET /admin/metrics
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	snapshot := metrics.Snapshot()
+	writeAdminResponse(w, "Error listing the metrics.", snapshot, http.StatusOK)
+}
+
+// Breakers returns the state of the circuit breaker of each enabled
+// integration, and when the open ones will be probed:
+//
+//	GET /admin/breakers
+func Breakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	writeAdminResponse(w, "Error listing the circuit breakers.", delivery.Breakers(), http.StatusOK)
+}
+
+func writeAdminResponse(w http.ResponseWriter, message string, response interface{}, statusCode int) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		logrus.WithField("err", err).Error("Error marshalling the response")
+		writeResponse(w, message, statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/config"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/metrics"
+)
+
+func TestReloadWhenNotEnabled(t *testing.T) {
+	expectedStatusCode := 404
+	expectedBody := `{"message": "Reloading the configuration is not enabled."}`
+
+	r, err := http.NewRequest("POST", "/admin/reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Reload(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestReload(t *testing.T) {
+	reloaded := false
+	Reloader = func() error {
+		reloaded = true
+		return nil
+	}
+	defer func() { Reloader = nil }()
+	expectedStatusCode := 200
+	expectedBody := `{"message":"Configuration reloaded.","integrations":[]}`
+
+	r, err := http.NewRequest("POST", "/admin/reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Reload(w, r)
+
+	if !reloaded {
+		t.Error("Expected the configuration to be reloaded")
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestReloadWhenConfigurationIsInvalid(t *testing.T) {
+	Reloader = func() error {
+		return &config.Error{Path: "forwardlytics.yml", Problems: []string{"apiKey is required"}}
+	}
+	defer func() { Reloader = nil }()
+	expectedStatusCode := 400
+	expectedBody := `{"message":"Invalid configuration, keeping the current one.","problems":["apiKey is required"]}`
+
+	r, err := http.NewRequest("POST", "/admin/reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Reload(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	defer metrics.Reset()
+	metrics.Add("test.metric", "web", 2)
+	expectedStatusCode := 200
+	expectedBody := `"test.metric":{"web":2}`
+
+	r, err := http.NewRequest("GET", "/admin/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Metrics(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestBreakers(t *testing.T) {
+	integrations.RegisterIntegration("test-only-integration-breaker", FakeIntegration{})
+	defer integrations.RemoveIntegration("test-only-integration-breaker")
+	expectedStatusCode := 200
+	expectedBody := `{"integration":"test-only-integration-breaker","state":"closed","failures":0}`
+
+	r, err := http.NewRequest("GET", "/admin/breakers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Breakers(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func TestAliasWhenNotPOST(t *testing.T) {
+	expectedStatusCode := 404
+	expectedBody := "404 page not found"
+
+	r, err := http.NewRequest("GET", "/alias", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Alias(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestAliasWhenMissingParameter(t *testing.T) {
+	expectedStatusCode := 400
+	expectedBody := `{"message": "Missing parameters: previousID, userID, timestamp."}`
+
+	r, err := http.NewRequest("POST", "/alias", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Alias(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestAliasWhenValid(t *testing.T) {
+	expectedStatusCode := 200
+	expectedBody := `{"message":"Forwarding alias to integrations.","destinations":[{"integration":"test-only-integration-aliased","status":"accepted","attempts":1},{"integration":"test-only-integration-working","status":"unsupported"}]}`
+
+	requestBody := `{
+		"previousID":"anonymous-456",
+		"userID":"123",
+		"timestamp": 12345678
+	}`
+	r, err := http.NewRequest("POST", "/alias", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &AliasedIntegration{}
+	integrations.RegisterIntegration("test-only-integration-aliased", integration)
+	defer integrations.RemoveIntegration("test-only-integration-aliased")
+
+	workingIntegration := FakeIntegration{}
+	integrations.RegisterIntegration("test-only-integration-working", workingIntegration)
+	defer integrations.RemoveIntegration("test-only-integration-working")
+
+	Alias(w, r)
+
+	if integration.Aliased.PreviousID != "anonymous-456" || integration.Aliased.UserID != "123" {
+		t.Errorf("Wrong alias forwarded: %#v", integration.Aliased)
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+// AliasedIntegration is an integration supporting aliases
+type AliasedIntegration struct {
+	FakeIntegration
+	Aliased integrations.Alias
+}
+
+func (i *AliasedIntegration) Alias(alias integrations.Alias) error {
+	i.Aliased = alias
+	return nil
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/delivery"
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+// Largest number of messages accepted in a single batch
+const maxBatchSize = 1000
+
+// States of a message in a batch, on top of the ones from delivery
+const (
+	batchStatusInvalid   = "invalid"
+	batchStatusFailed    = "failed"
+	batchStatusDuplicate = "duplicate"
+	batchStatusDropped   = "dropped"
+	// The source sent too many messages about the user, it can be sent
+	// again later
+	batchStatusRateLimited = "rate_limited"
+)
+
+// batchResult is the outcome of one of the messages of a batch
+type batchResult struct {
+	Index        int               `json:"index"`
+	Type         string            `json:"type"`
+	Status       string            `json:"status"`
+	Message      string            `json:"message,omitempty"`
+	Destinations []delivery.Status `json:"destinations,omitempty"`
+}
+
+type batchResponse struct {
+	Message string        `json:"message"`
+	Results []batchResult `json:"results"`
+}
+
+// Batch is taking a list of identifications, events, page-views, aliases and
+// groups to send them to the enabled integrations. Each message has a "type"
+// of identify, track, page, alias or group, and is handled on its own: an
+// invalid message doesn't prevent the others from being forwarded.
+func Batch(w http.ResponseWriter, r *http.Request) {
+	// This is the soonest we can do that, pretty much at least.
+	receivedAt := time.Now().Unix()
+
+	// This endpoint is a POST, everything else be a 404
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Unmarshal input JSON
+	decoder := json.NewDecoder(r.Body)
+	var items []json.RawMessage
+	err := decoder.Decode(&items)
+	if err != nil {
+		logrus.WithField("err", err).WithField("body", r.Body).Error("Bad request in Batch")
+		writeResponse(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		writeResponse(w, "Empty batch.", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchSize {
+		writeResponse(w, fmt.Sprintf("Too many messages in the batch, the maximum is %d.", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(items))
+	allGood := true
+	for index, item := range items {
+		results[index] = batchItem(index, item, receivedAt, r)
+		switch results[index].Status {
+		case delivery.StatusAccepted, delivery.StatusQueued, batchStatusDuplicate, batchStatusDropped:
+		default:
+			allGood = false
+		}
+	}
+
+	statusCode := http.StatusOK
+	if Queue != nil {
+		statusCode = http.StatusAccepted
+	}
+	if !allGood {
+		statusCode = http.StatusMultiStatus
+	}
+	writeBatchResponse(w, fmt.Sprintf("Processed %d messages.", len(items)), results, statusCode)
+}
+
+// batchItem decodes and dispatches a single message of a batch
+func batchItem(index int, item json.RawMessage, receivedAt int64, r *http.Request) batchResult {
+	message, err := decodeMessage(item, receivedAt)
+	if err != nil {
+		return batchResult{Index: index, Type: message.Type, Status: batchStatusInvalid, Message: "Invalid message."}
+	}
+	if message.Type != "" && message.Identification == nil && message.Event == nil && message.Page == nil && message.Alias == nil && message.Group == nil {
+		return batchResult{Index: index, Type: message.Type, Status: batchStatusInvalid, Message: "Unknown type, expecting identify, track, page, alias or group."}
+	}
+	requestContext(&message, r)
+	return batchDispatch(index, message)
+}
+
+// batchDispatch validates and dispatches a message of a batch
+func batchDispatch(index int, message integrations.Message) batchResult {
+	result := batchResult{Index: index, Type: message.Type, Status: batchStatusInvalid}
+
+	missingParameters := message.Validate()
+	if len(missingParameters) != 0 {
+		result.Message = "Missing parameters: " + strings.Join(missingParameters, ", ") + "."
+		return result
+	}
+
+	statuses, err := dispatch(message)
+	if err == errDuplicate {
+		result.Status = batchStatusDuplicate
+		result.Message = "Ignoring duplicate message."
+		return result
+	}
+	if err == errDropped {
+		result.Status = batchStatusDropped
+		result.Message = "Dropped message, as the rules of the source say."
+		return result
+	}
+	if limited, ok := err.(rateLimitedError); ok {
+		result.Status = batchStatusRateLimited
+		result.Message = fmt.Sprintf("Too many messages about this user. Retry in %d seconds.", retryAfterSeconds(limited.retryAfter))
+		return result
+	}
+	if err != nil {
+		result.Status = batchStatusFailed
+		result.Message = "Error queueing the message."
+		return result
+	}
+	result.Destinations = statuses
+	result.Status = delivery.StatusAccepted
+	if Queue != nil {
+		result.Status = delivery.StatusQueued
+	} else if _, failed := countStatuses(statuses); failed > 0 {
+		result.Status = batchStatusFailed
+	}
+	return result
+}
+
+// decodeMessage reads a message holding its type along with the fields of
+// the matching identification, event or page.
+func decodeMessage(data []byte, receivedAt int64) (message integrations.Message, err error) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err = json.Unmarshal(data, &header); err != nil {
+		return
+	}
+
+	message.Type = header.Type
+	switch header.Type {
+	case integrations.TypeIdentify:
+		var identification integrations.Identification
+		err = json.Unmarshal(data, &identification)
+		identification.ReceivedAt = receivedAt
+		message.Identification = &identification
+	case integrations.TypeTrack:
+		var event integrations.Event
+		err = json.Unmarshal(data, &event)
+		event.ReceivedAt = receivedAt
+		message.Event = &event
+	case integrations.TypePage:
+		var page integrations.Page
+		err = json.Unmarshal(data, &page)
+		page.ReceivedAt = receivedAt
+		message.Page = &page
+	case integrations.TypeAlias:
+		var alias integrations.Alias
+		err = json.Unmarshal(data, &alias)
+		alias.ReceivedAt = receivedAt
+		message.Alias = &alias
+	case integrations.TypeGroup:
+		var group integrations.Group
+		err = json.Unmarshal(data, &group)
+		group.ReceivedAt = receivedAt
+		message.Group = &group
+	}
+	return
+}
+
+func writeBatchResponse(w http.ResponseWriter, body string, results []batchResult, statusCode int) {
+	response, err := json.Marshal(batchResponse{Message: body, Results: results})
+	if err != nil {
+		logrus.WithField("err", err).Error("Error marshalling the response")
+		writeResponse(w, body, statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(response)
+}
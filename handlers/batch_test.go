@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/sources"
+)
+
+func TestBatchWhenNotPOST(t *testing.T) {
+	expectedStatusCode := 404
+	expectedBody := "404 page not found"
+
+	r, err := http.NewRequest("GET", "/batch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Batch(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestBatchWhenInvalidJSON(t *testing.T) {
+	expectedStatusCode := 400
+	expectedBody := `{"message": "Invalid request."}`
+
+	requestBody := `{"type":"track"}`
+	r, err := http.NewRequest("POST", "/batch", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Batch(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestBatchWhenEmpty(t *testing.T) {
+	expectedStatusCode := 400
+	expectedBody := `{"message": "Empty batch."}`
+
+	r, err := http.NewRequest("POST", "/batch", strings.NewReader(`[]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Batch(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestBatchWhenValid(t *testing.T) {
+	expectedStatusCode := 200
+	expectedBody := `{"message":"Processed 2 messages.","results":[{"index":0,"type":"identify","status":"accepted","destinations":[{"integration":"test-only-integration-called","status":"accepted","attempts":1}]},{"index":1,"type":"track","status":"accepted","destinations":[{"integration":"test-only-integration-called","status":"accepted","attempts":1}]}]}`
+
+	requestBody := `[
+		{"type":"identify", "userID":"123", "userTraits": {"email": "john@example.com"}, "timestamp": 12345678},
+		{"type":"track", "name":"something.created", "userID":"123", "properties": { "someCounter": 97 }, "timestamp": 12345678}
+	]`
+	r, err := http.NewRequest("POST", "/batch", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &CalledIntegration{t: t}
+	integrations.RegisterIntegration("test-only-integration-called", integration)
+	defer integrations.RemoveIntegration("test-only-integration-called")
+
+	Batch(w, r)
+
+	if !integration.Tracked {
+		t.Error("Track was not called on the integration")
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestBatchWhenSomeMessagesAreInvalid(t *testing.T) {
+	expectedStatusCode := 207
+	expectedBody := `{"message":"Processed 3 messages.","results":[{"index":0,"type":"page","status":"invalid","message":"Missing parameters: url, timestamp."},{"index":1,"type":"screen","status":"invalid","message":"Unknown type, expecting identify, track, page, alias or group."},{"index":2,"type":"track","status":"accepted","destinations":[{"integration":"test-only-integration-called","status":"accepted","attempts":1}]}]}`
+
+	requestBody := `[
+		{"type":"page", "name":"Homepage", "userID":"123"},
+		{"type":"screen", "userID":"123"},
+		{"type":"track", "name":"something.created", "userID":"123", "timestamp": 12345678}
+	]`
+	r, err := http.NewRequest("POST", "/batch", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &CalledIntegration{t: t}
+	integrations.RegisterIntegration("test-only-integration-called", integration)
+	defer integrations.RemoveIntegration("test-only-integration-called")
+
+	Batch(w, r)
+
+	if !integration.Tracked {
+		t.Error("The valid event should be tracked")
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestBatchWhenRateLimitedByUser(t *testing.T) {
+	sources.Configure([]*sources.Source{{Name: "web", Keys: []sources.Key{{ID: "web-1", Secret: "web-key"}}, RateLimit: sources.RateLimit{UserRate: 1}}})
+	defer sources.Configure(nil)
+	expectedStatusCode := 207
+	expectedBody := `{"index":1,"type":"track","status":"rate_limited","message":"Too many messages about this user. Retry in 1 seconds."}`
+
+	requestBody := `[
+		{"type":"track", "name":"something.created", "userID":"123", "timestamp": 12345678},
+		{"type":"track", "name":"something.updated", "userID":"123", "timestamp": 12345678},
+		{"type":"track", "name":"something.created", "userID":"456", "timestamp": 12345678}
+	]`
+	r, err := http.NewRequest("POST", "/batch", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Add("Forwardlytics-Api-Key", "web-key")
+	w := httptest.NewRecorder()
+
+	integration := &CountingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-counting", integration)
+	defer integrations.RemoveIntegration("test-only-integration-counting")
+
+	AuthMiddleware(http.HandlerFunc(Batch)).ServeHTTP(w, r)
+
+	if integration.Calls != 2 {
+		t.Errorf("Expected the messages within the limit to be tracked, got %v calls", integration.Calls)
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/deadletter"
+	"github.com/jipiboily/forwardlytics/delivery"
+)
+
+// DeadLetters gives access to the messages integrations failed to receive:
+//
+//	GET    /dead-letters         lists them, with their content
+//	POST   /dead-letters/replay  sends them to their integration again
+//	DELETE /dead-letters         discards them
+//
+// They are selected with the integration, id, since and until query
+// parameters. Replaying and discarding require the integration.
+func DeadLetters(w http.ResponseWriter, r *http.Request) {
+	if delivery.DeadLetters == nil {
+		writeResponse(w, "Dead letters are not enabled.", http.StatusNotFound)
+		return
+	}
+
+	var handler func(http.ResponseWriter, deadletter.Filter)
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/dead-letters":
+		handler = listDeadLetters
+	case r.Method == "POST" && r.URL.Path == "/dead-letters/replay":
+		handler = replayDeadLetters
+	case r.Method == "DELETE" && r.URL.Path == "/dead-letters":
+		handler = discardDeadLetters
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := deadletter.Filter{Integration: query.Get("integration"), ID: query.Get("id")}
+	var err error
+	if filter.Since, err = deadletter.ParseTime(query.Get("since")); err != nil {
+		writeResponse(w, "Invalid since parameter, expecting a unix timestamp or RFC 3339 time.", http.StatusBadRequest)
+		return
+	}
+	if filter.Until, err = deadletter.ParseTime(query.Get("until")); err != nil {
+		writeResponse(w, "Invalid until parameter, expecting a unix timestamp or RFC 3339 time.", http.StatusBadRequest)
+		return
+	}
+	if r.Method != "GET" && filter.Integration == "" {
+		writeResponse(w, "Missing parameters: integration.", http.StatusBadRequest)
+		return
+	}
+
+	handler(w, filter)
+}
+
+func listDeadLetters(w http.ResponseWriter, filter deadletter.Filter) {
+	letters, err := delivery.DeadLetters.List(filter)
+	if err != nil {
+		logrus.WithField("err", err).Error("Error listing dead letters")
+		writeResponse(w, "Error listing dead letters.", http.StatusInternalServerError)
+		return
+	}
+	if letters == nil {
+		letters = []deadletter.Letter{}
+	}
+
+	response, err := json.Marshal(map[string][]deadletter.Letter{"deadLetters": letters})
+	if err != nil {
+		logrus.WithField("err", err).Error("Error marshalling dead letters")
+		writeResponse(w, "Error listing dead letters.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+func replayDeadLetters(w http.ResponseWriter, filter deadletter.Filter) {
+	letters, err := delivery.DeadLetters.List(filter)
+	if err != nil {
+		logrus.WithField("err", err).Error("Error listing dead letters")
+		writeResponse(w, "Error listing dead letters.", http.StatusInternalServerError)
+		return
+	}
+
+	var statuses []delivery.Status
+	for _, letter := range letters {
+		statuses = append(statuses, delivery.Replay(delivery.DeadLetters, letter))
+	}
+	writeDeliveryResponse(w, fmt.Sprintf("Replayed %d dead letters.", len(letters)), statuses, http.StatusOK)
+}
+
+func discardDeadLetters(w http.ResponseWriter, filter deadletter.Filter) {
+	letters, err := delivery.DeadLetters.List(filter)
+	if err != nil {
+		logrus.WithField("err", err).Error("Error listing dead letters")
+		writeResponse(w, "Error listing dead letters.", http.StatusInternalServerError)
+		return
+	}
+
+	for _, letter := range letters {
+		err = delivery.DeadLetters.Remove(letter.Integration, letter.ID)
+		if err != nil && err != deadletter.ErrNotFound {
+			logrus.WithField("err", err).WithField("deadLetter", letter.ID).Error("Error discarding dead letter")
+			writeResponse(w, "Error discarding dead letters.", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeResponse(w, fmt.Sprintf("Discarded %d dead letters.", len(letters)), http.StatusOK)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/deadletter"
+	"github.com/jipiboily/forwardlytics/delivery"
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func openDeadLetters(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "forwardlytics-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery.DeadLetters, err = deadletter.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		delivery.DeadLetters = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDeadLettersWhenNotEnabled(t *testing.T) {
+	expectedStatusCode := 404
+	expectedBody := `{"message": "Dead letters are not enabled."}`
+
+	r, err := http.NewRequest("GET", "/dead-letters", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	DeadLetters(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestDeadLettersList(t *testing.T) {
+	defer openDeadLetters(t)()
+	message := integrations.Message{Type: integrations.TypeTrack, Event: &integrations.Event{Name: "account.created"}}
+	letter, err := delivery.DeadLetters.Add("drip", message, errors.New("some random error"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery.DeadLetters.Add("intercom", message, errors.New("some random error"), 1)
+
+	expectedStatusCode := 200
+	expectedBody := `{"deadLetters":[{"id":"` + letter.ID + `","integration":"drip"`
+
+	r, err := http.NewRequest("GET", "/dead-letters?integration=drip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	DeadLetters(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+
+	if strings.Contains(w.Body.String(), "intercom") {
+		t.Errorf("Only the drip dead letters should be listed, got %s", w.Body.String())
+	}
+}
+
+func TestDeadLettersReplay(t *testing.T) {
+	defer openDeadLetters(t)()
+	message := integrations.Message{Type: integrations.TypeTrack, Event: &integrations.Event{Name: "account.created"}}
+	letter, err := delivery.DeadLetters.Add("test-only-integration-working", message, errors.New("some random error"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workingIntegration := FakeIntegration{}
+	integrations.RegisterIntegration("test-only-integration-working", workingIntegration)
+	defer integrations.RemoveIntegration("test-only-integration-working")
+
+	expectedStatusCode := 200
+	expectedBody := `{"message":"Replayed 1 dead letters.","destinations":[{"integration":"test-only-integration-working","status":"accepted","attempts":1,"deadLetter":"` + letter.ID + `"}]}`
+
+	r, err := http.NewRequest("POST", "/dead-letters/replay?integration=test-only-integration-working&since=2016-04-01T00:00:00Z", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	DeadLetters(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+
+	letters, _ := delivery.DeadLetters.List(deadletter.Filter{})
+	if len(letters) != 0 {
+		t.Errorf("Expected the replayed dead letter to be removed, %v left", len(letters))
+	}
+}
+
+func TestDeadLettersDiscardWhenMissingIntegration(t *testing.T) {
+	defer openDeadLetters(t)()
+
+	expectedStatusCode := 400
+	expectedBody := `{"message": "Missing parameters: integration."}`
+
+	r, err := http.NewRequest("DELETE", "/dead-letters", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	DeadLetters(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
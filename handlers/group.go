@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+// Group is taking a group to send it to the enabled integrations supporting it
+func Group(w http.ResponseWriter, r *http.Request) {
+	// This is the soonest we can do that, pretty much at least.
+	receivedAt := time.Now().Unix()
+
+	// This endpoint is a POST, everything else be a 404
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Unmarshal input JSON
+	decoder := json.NewDecoder(r.Body)
+	var group integrations.Group
+	err := decoder.Decode(&group)
+	if err != nil {
+		logrus.WithField("err", err).WithField("body", r.Body).Error("Bad request in Group")
+		writeResponse(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+	group.ReceivedAt = receivedAt
+
+	// Input validation
+	missingParameters := group.Validate()
+	if len(missingParameters) != 0 {
+		msg := "Missing parameters: "
+		msg = msg + strings.Join(missingParameters, ", ") + "."
+		writeResponse(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	message := integrations.Message{Type: integrations.TypeGroup, Group: &group}
+	requestContext(&message, r)
+	// Yay, it worked so far, let's send all the things to integrations!
+	forward(w, message, "group")
+}
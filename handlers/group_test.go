@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func TestGroupWhenNotPOST(t *testing.T) {
+	expectedStatusCode := 404
+	expectedBody := "404 page not found"
+
+	r, err := http.NewRequest("GET", "/group", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Group(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestGroupWhenMissingParameter(t *testing.T) {
+	expectedStatusCode := 400
+	expectedBody := `{"message": "Missing parameters: groupID, userID or anonymousID, timestamp."}`
+
+	r, err := http.NewRequest("POST", "/group", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Group(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestGroupWhenValid(t *testing.T) {
+	expectedStatusCode := 200
+	expectedBody := `{"message":"Forwarding group to integrations.","destinations":[{"integration":"test-only-integration-grouped","status":"accepted","attempts":1},{"integration":"test-only-integration-working","status":"unsupported"}]}`
+
+	requestBody := `{
+		"groupID":"company-456",
+		"traits":{"name":"Acme"},
+		"userID":"123",
+		"timestamp": 12345678
+	}`
+	r, err := http.NewRequest("POST", "/group", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &GroupedIntegration{}
+	integrations.RegisterIntegration("test-only-integration-grouped", integration)
+	defer integrations.RemoveIntegration("test-only-integration-grouped")
+
+	workingIntegration := FakeIntegration{}
+	integrations.RegisterIntegration("test-only-integration-working", workingIntegration)
+	defer integrations.RemoveIntegration("test-only-integration-working")
+
+	Group(w, r)
+
+	if integration.Grouped.GroupID != "company-456" || integration.Grouped.UserID != "123" || integration.Grouped.Traits["name"] != "Acme" {
+		t.Errorf("Wrong group forwarded: %#v", integration.Grouped)
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+// GroupedIntegration is an integration supporting groups
+type GroupedIntegration struct {
+	FakeIntegration
+	Grouped integrations.Group
+}
+
+func (i *GroupedIntegration) Group(group integrations.Group) error {
+	i.Grouped = group
+	return nil
+}
@@ -1,33 +1,253 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/codeship/go-retro"
+	"github.com/jipiboily/forwardlytics/dedup"
+	"github.com/jipiboily/forwardlytics/delivery"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/queue"
+	"github.com/jipiboily/forwardlytics/sources"
 )
 
-func resourceNotReady(resourceError error) error {
-	if os.Getenv("NUM_RETRIES_ON_ERROR") == "" {
-		return resourceError
+// Queue receives the accepted messages when set, so they are delivered to the
+// integrations in the background instead of during the request.
+var Queue *queue.Queue
+
+// Dedup remembers the IDs of the messages received recently, so that a message
+// sent again is acknowledged without being forwarded twice. Every message is
+// forwarded when it's nil.
+var Dedup *dedup.Window
+
+// TrustedProxies are the networks of the proxies in front of the API, whose
+// X-Forwarded-For header gives the IP of the client. It's ignored otherwise.
+var TrustedProxies []*net.IPNet
+
+// errDuplicate is returned when dispatching a message that was already received
+var errDuplicate = errors.New("duplicate message")
+
+// errDropped is returned when dispatching a message the rules of its source
+// drop
+var errDropped = errors.New("dropped message")
+
+// deliveryResponse is the body sent back once the integrations got a message
+type deliveryResponse struct {
+	Message      string            `json:"message"`
+	Destinations []delivery.Status `json:"destinations"`
+}
+
+// forward dispatches the message and reports how each integration handled
+// it. The request only fails when no integration accepted the message, as
+// retrying it would otherwise duplicate it where it was accepted.
+func forward(w http.ResponseWriter, message integrations.Message, description string) {
+	statuses, err := dispatch(message)
+	if err == errDuplicate {
+		writeResponse(w, fmt.Sprintf("Ignoring duplicate %s.", description), http.StatusOK)
+		return
+	}
+	if err == errDropped {
+		writeResponse(w, fmt.Sprintf("Dropped %s, as the rules of the source say.", description), http.StatusOK)
+		return
+	}
+	if limited, ok := err.(rateLimitedError); ok {
+		writeRateLimited(w, "Too many messages about this user.", limited.retryAfter)
+		return
+	}
+	if err != nil {
+		writeResponse(w, "Error queueing the message.", http.StatusInternalServerError)
+		return
+	}
+	if Queue != nil {
+		writeDeliveryResponse(w, fmt.Sprintf("Queued %s for integrations.", description), statuses, http.StatusAccepted)
+		return
+	}
+
+	accepted, failed := countStatuses(statuses)
+	switch {
+	case failed == 0:
+		writeDeliveryResponse(w, fmt.Sprintf("Forwarding %s to integrations.", description), statuses, http.StatusOK)
+	case accepted == 0:
+		writeDeliveryResponse(w, fmt.Sprintf("Fatal error during %s with all integrations.", description), statuses, http.StatusInternalServerError)
+	default:
+		writeDeliveryResponse(w, fmt.Sprintf("Fatal error during %s with some integrations.", description), statuses, http.StatusMultiStatus)
+	}
+}
+
+// dispatch hands the message to the integrations: it's written to the queue
+// when there is one, and delivered right away otherwise. Messages without an
+// ID get one, and the ones already received return errDuplicate. The rules of
+// the source are applied first, errDropped being returned when they drop it.
+// Messages about a user the source already sent too many of return a
+// rateLimitedError.
+func dispatch(message integrations.Message) ([]delivery.Status, error) {
+	if err := allowMessage(message); err != nil {
+		return nil, err
+	}
+
+	id := message.ID()
+	if id == "" {
+		generated, err := integrations.NewID()
+		if err != nil {
+			logrus.WithField("message", message).WithField("err", err).Error("Error generating the message ID")
+			return nil, err
+		}
+		message.SetID(generated)
+	} else if Dedup != nil && Dedup.Seen(message.Source, id) {
+		logrus.WithField("messageID", id).WithField("type", message.Type).Info("Ignoring duplicate message")
+		return nil, errDuplicate
+	}
+
+	if !sources.Get(message.Source).Transform(message) {
+		logrus.WithField("messageID", message.ID()).WithField("type", message.Type).WithField("source", message.Source).Info("Message dropped by the rules of the source")
+		return nil, errDropped
+	}
+
+	if Queue != nil {
+		statuses, err := enqueue(message)
+		if err != nil {
+			forget(message.Source, id)
+		}
+		return statuses, err
+	}
+
+	statuses := delivery.Deliver(message)
+	// Nothing got the message, so sending it again is not a duplicate
+	if accepted, failed := countStatuses(statuses); accepted == 0 && failed > 0 {
+		forget(message.Source, id)
+	}
+	return statuses, nil
+}
+
+// forget removes the ID of a message from the source that could not be
+// dispatched from the dedup window, so the client can retry it
+func forget(source, id string) {
+	if Dedup != nil && id != "" {
+		Dedup.Forget(source, id)
+	}
+}
+
+// enqueue durably stores the message for every enabled integration
+func enqueue(message integrations.Message) ([]delivery.Status, error) {
+	var destinations []string
+	var statuses []delivery.Status
+	source := sources.Get(message.Source)
+	for _, instance := range integrations.Instances() {
+		integrationName, integration := instance.Name, instance.Integration
+		switch {
+		case !source.Enabled(integrationName):
+			// Other sources' integrations are not mentioned
+		case !integration.Enabled():
+			statuses = append(statuses, delivery.Status{Integration: integrationName, Status: delivery.StatusSkipped})
+		case !message.SupportedBy(integration):
+			statuses = append(statuses, delivery.Status{Integration: integrationName, Status: delivery.StatusUnsupported})
+		default:
+			destinations = append(destinations, integrationName)
+			statuses = append(statuses, delivery.Status{Integration: integrationName, Status: delivery.StatusQueued})
+		}
 	}
-	numRetries, err := strconv.Atoi(os.Getenv("NUM_RETRIES_ON_ERROR"))
+
+	_, err := Queue.Enqueue(message, destinations)
 	if err != nil {
-		logrus.WithField("err", err).Error("env variable NUM_RETRIES_ON_ERROR should be an integer")
-		return err
+		logrus.WithField("message", message).WithField("err", err).Error("Error writing message to the queue")
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// requestContext fills what the request tells about the message: the source
+// that sent it, and the IP and user agent of its context when the client
+// didn't send them
+func requestContext(message *integrations.Message, r *http.Request) {
+	message.Source = requestSource(r)
+
+	context := message.Context()
+	if context == nil {
+		context = &integrations.Context{}
+	}
+	if context.IP == "" {
+		context.IP = requestIP(r)
+	}
+	if context.UserAgent == "" {
+		context.UserAgent = r.UserAgent()
+	}
+	message.SetContext(context)
+}
+
+// requestIP returns the IP of the client. When the request comes from a
+// trusted proxy (e.g. on Heroku), it's the last IP of X-Forwarded-For that is
+// not a trusted proxy, as the client can put anything before it.
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if hop := strings.TrimSpace(forwarded[i]); hop != "" {
+			ip = hop
+			if !trustedProxy(ip) {
+				break
+			}
+		}
 	}
-	logrus.WithField("error", resourceError).Error("Error sending request")
-	return retro.NewBackoffRetryableError(resourceError, numRetries)
+	return ip
+}
+
+// trustedProxy tells if the IP is one of the TrustedProxies
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// countStatuses returns how many integrations accepted the message, and how
+// many failed to receive it.
+func countStatuses(statuses []delivery.Status) (accepted int, failed int) {
+	for _, status := range statuses {
+		switch status.Status {
+		case delivery.StatusAccepted:
+			accepted++
+		case delivery.StatusFailed:
+			failed++
+		}
+	}
+	return
 }
 
 func writeResponse(w http.ResponseWriter, body string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-
 	body = fmt.Sprintf(`{"message": "%s"}`, body)
 	w.Write([]byte(body))
+}
 
+func writeDeliveryResponse(w http.ResponseWriter, body string, destinations []delivery.Status, statusCode int) {
+	if destinations == nil {
+		destinations = []delivery.Status{}
+	}
+	response, err := json.Marshal(deliveryResponse{Message: body, Destinations: destinations})
+	if err != nil {
+		logrus.WithField("err", err).Error("Error marshalling the response")
+		writeResponse(w, body, statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(response)
 }
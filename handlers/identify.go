@@ -2,13 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/codeship/go-retro"
 	"github.com/jipiboily/forwardlytics/integrations"
 )
 
@@ -43,27 +41,8 @@ func Identify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := integrations.Message{Type: integrations.TypeIdentify, Identification: &identification}
+	requestContext(&message, r)
 	// Yay, it worked so far, let's send all the things to integrations!
-	for _, integrationName := range integrations.IntegrationList() {
-		integration := integrations.GetIntegration(integrationName)
-		if integration.Enabled() {
-			logrus.Infof("Forwarding idenitify to %s", integrationName)
-			err := retro.DoWithRetry(func() error {
-				e := integration.Identify(identification)
-				if e != nil {
-					return resourceNotReady(e)
-				}
-				return e
-			})
-			if err != nil {
-				errMsg := fmt.Sprintf("Fatal error during identification with an integration (%s): %s", integrationName, err)
-				logrus.WithField("integration", integrationName).WithField("identification", identification).WithField("err", err).Error(errMsg)
-				writeResponse(w, errMsg, 500)
-				return
-			}
-		}
-
-	}
-
-	writeResponse(w, "Forwarding identify to integrations.", http.StatusOK)
+	forward(w, message, "identify")
 }
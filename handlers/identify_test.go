@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jipiboily/forwardlytics/delivery"
 	"github.com/jipiboily/forwardlytics/integrations"
 )
 
@@ -56,7 +57,7 @@ func TestIdentifyWhenInvalidJSON(t *testing.T) {
 
 func TestIdentifyWhenMissingParameter(t *testing.T) {
 	expectedStatusCode := 400
-	expectedBody := `{"message": "Missing parameters: userID, timestamp."}`
+	expectedBody := `{"message": "Missing parameters: userID or anonymousID, timestamp."}`
 
 	requestBody := `{}`
 	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
@@ -77,8 +78,8 @@ func TestIdentifyWhenMissingParameter(t *testing.T) {
 }
 
 func TestIdentifyWhenOneIntegrationFails(t *testing.T) {
-	expectedStatusCode := 500
-	expectedBody := `{"message": "Fatal error during identification with an integration (test-only-integration-failing): some random error"}`
+	expectedStatusCode := 207
+	expectedBody := `{"message":"Fatal error during identify with some integrations.","destinations":[{"integration":"test-only-integration-failing","status":"failed","error":"some random error","attempts":1},{"integration":"test-only-integration-working","status":"accepted","attempts":1}]}`
 
 	requestBody := `{
 		"name":"something.created",
@@ -95,6 +96,7 @@ func TestIdentifyWhenOneIntegrationFails(t *testing.T) {
 	failingIntegration := FailingIntegrationIdentification{}
 	integrations.RegisterIntegration("test-only-integration-failing", failingIntegration)
 	defer integrations.RemoveIntegration("test-only-integration-failing")
+	defer delivery.Reset()
 
 	workingIntegration := FakeIntegration{}
 	integrations.RegisterIntegration("test-only-integration-working", workingIntegration)
@@ -113,7 +115,7 @@ func TestIdentifyWhenOneIntegrationFails(t *testing.T) {
 
 func TestIdentifyWhenValid(t *testing.T) {
 	expectedStatusCode := 200
-	expectedBody := `{"message": "Forwarding identify to integrations."}`
+	expectedBody := `{"message":"Forwarding identify to integrations.","destinations":[{"integration":"test-only-integration-called","status":"accepted","attempts":1}]}`
 
 	requestBody := `{
 		"name":"something.created",
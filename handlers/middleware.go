@@ -1,22 +1,220 @@
 package handlers
 
 import (
-	"crypto/subtle"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/sources"
 )
 
+// sourceKey is the key of the authenticated source in the request context
+type sourceKey struct{}
+
+// publicTypeKey is the key of the type of messages public keys can send to
+// the endpoint, in the request context
+type publicTypeKey struct{}
+
+// SignatureSkew is how far the timestamp of a signed request can be from the
+// current time. Older requests are rejected, so they can't be replayed later.
+var SignatureSkew = 5 * time.Minute
+
+// Largest body of a signed request, as it's read before the handlers
+const maxSignedBodySize = 10 * 1024 * 1024
+
+const signaturePrefix = "sha256="
+
+// How long browsers can cache the answer to a CORS preflight request, in
+// seconds
+const corsMaxAge = "86400"
+
 // AuthMiddleware is making sure the call is properly authenticated before
-// sending the request to the handlers
+// sending the request to the handlers. The key tells which source is calling.
+// Requests authenticated by SignatureMiddleware go through.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Already authenticated by SignatureMiddleware
+		if requestSource(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		apiKey := r.Header.Get("Forwardlytics-Api-Key")
 
-		if subtle.ConstantTimeCompare([]byte(os.Getenv("FORWARDLYTICS_API_KEY")), []byte(apiKey)) != 1 {
+		source, keyID := sources.Authenticate(apiKey)
+		if source == nil {
 			errorMsg := "Invalid API KEY. The Forwardlytics-Api-Key header must be specified, with the proper API key."
 			writeResponse(w, errorMsg, http.StatusUnauthorized)
 			return
 		}
+		if source.RequireSignature {
+			writeResponse(w, "This source only accepts signed requests.", http.StatusUnauthorized)
+			return
+		}
+		if !publicKeyAllowed(w, r, source, keyID) || !withinRateLimit(w, r, source, keyID) {
+			return
+		}
+		next.ServeHTTP(w, withSource(r, source, keyID))
+	})
+}
+
+// PublicMiddleware opens the endpoint to the public keys allowed to send that
+// type of messages, and to the browsers calling it from their origins. It
+// answers CORS preflight requests, and lets those pages read the responses.
+func PublicMiddleware(messageType string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && sources.AllowedOrigin(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == "OPTIONS" {
+			if !allowed {
+				writeResponse(w, "Forbidden. No public key can be used from this origin.", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Forwardlytics-Api-Key")
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), publicTypeKey{}, messageType)))
+	})
+}
+
+// publicKeyAllowed makes sure a public key is used on an endpoint opened to
+// one of its types by PublicMiddleware, from one of its origins. Other keys are
+// always allowed.
+func publicKeyAllowed(w http.ResponseWriter, r *http.Request, source *sources.Source, keyID string) bool {
+	key, _ := source.Key(keyID)
+	if !key.Public {
+		return true
+	}
+	messageType, _ := r.Context().Value(publicTypeKey{}).(string)
+	if messageType == "" || !key.Allows(messageType) {
+		writeResponse(w, "Forbidden. This public key can't be used on this endpoint.", http.StatusForbidden)
+		return false
+	}
+	if !key.AllowsOrigin(r.Header.Get("Origin")) {
+		writeResponse(w, "Forbidden. This public key can't be used from this origin.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// SignatureMiddleware authenticates signed requests, which prove they have
+// one of the keys of their source without sending it. They have the headers:
+//
+//	Forwardlytics-Source     the name of the source
+//	Forwardlytics-Timestamp  when the request was signed, as a unix timestamp
+//	Forwardlytics-Signature  sha256= followed by the signature of the
+//	                         timestamp and body, see sources.Sign
+//
+// Requests without a signature are passed along as is, for AuthMiddleware to
+// authenticate them with their API key.
+func SignatureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature := r.Header.Get("Forwardlytics-Signature")
+		if signature == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timestamp := r.Header.Get("Forwardlytics-Timestamp")
+		signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			writeResponse(w, "Invalid signature. The Forwardlytics-Timestamp header must be a unix timestamp.", http.StatusUnauthorized)
+			return
+		}
+		if skew := time.Since(time.Unix(signedAt, 0)); skew > SignatureSkew || skew < -SignatureSkew {
+			writeResponse(w, fmt.Sprintf("Expired signature. The Forwardlytics-Timestamp header must be within %v of the current time.", SignatureSkew), http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBodySize))
+		if err != nil {
+			logrus.WithField("err", err).Error("Error reading the body of a signed request")
+			writeResponse(w, "Invalid request.", http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		source := sources.Get(r.Header.Get("Forwardlytics-Source"))
+		if source == nil || !strings.HasPrefix(signature, signaturePrefix) {
+			writeResponse(w, "Invalid signature.", http.StatusUnauthorized)
+			return
+		}
+		keyID, ok := source.VerifySignature(timestamp, body, strings.TrimPrefix(signature, signaturePrefix))
+		if !ok {
+			writeResponse(w, "Invalid signature.", http.StatusUnauthorized)
+			return
+		}
+		if !withinRateLimit(w, r, source, keyID) {
+			return
+		}
+		next.ServeHTTP(w, withSource(r, source, keyID))
+	})
+}
+
+// AdminMiddleware only lets the default source through, for the endpoints
+// managing Forwardlytics itself rather than sending messages
+func AdminMiddleware(next http.Handler) http.Handler {
+	return AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestSource(r) != sources.Default {
+			writeResponse(w, "Forbidden. This endpoint requires the API key of the default source.", http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
+	}))
+}
+
+// SegmentAuthMiddleware authenticates calls made by Segment client libraries,
+// which send the API key as the username of a basic auth, as the write key.
+// The Forwardlytics-Api-Key header is accepted as well.
+func SegmentAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, _, ok := r.BasicAuth()
+		if !ok {
+			apiKey = r.Header.Get("Forwardlytics-Api-Key")
+		}
+		source, keyID := sources.Authenticate(apiKey)
+		if source == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Forwardlytics"`)
+			errorMsg := "Invalid write key. The API key must be used as the basic auth username."
+			writeResponse(w, errorMsg, http.StatusUnauthorized)
+			return
+		}
+		if source.RequireSignature {
+			writeResponse(w, "This source only accepts signed requests.", http.StatusUnauthorized)
+			return
+		}
+		if !publicKeyAllowed(w, r, source, keyID) || !withinRateLimit(w, r, source, keyID) {
+			return
+		}
+
+		next.ServeHTTP(w, withSource(r, source, keyID))
 	})
 }
+
+// withSource attaches the source to the request, logging the key it used so
+// that keys no longer used can be spotted when rotating them
+func withSource(r *http.Request, source *sources.Source, keyID string) *http.Request {
+	logrus.WithField("source", source.Name).WithField("keyID", keyID).WithField("path", r.URL.Path).Info("Request authenticated")
+	return r.WithContext(context.WithValue(r.Context(), sourceKey{}, source.Name))
+}
+
+// requestSource returns the name of the source that authenticated the
+// request
+func requestSource(r *http.Request) string {
+	name, _ := r.Context().Value(sourceKey{}).(string)
+	return name
+}
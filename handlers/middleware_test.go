@@ -1,14 +1,20 @@
 package handlers
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/metrics"
+	"github.com/jipiboily/forwardlytics/sources"
 )
 
 func TestAuthMiddlewareWhenAPIKeyIsValid(t *testing.T) {
-	os.Setenv("FORWARDLYTICS_API_KEY", "DNUAS67AASNDj")
+	configureAPIKey("DNUAS67AASNDj")
 	req, err := http.NewRequest("GET", "/health-check", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -31,7 +37,7 @@ func TestAuthMiddlewareWhenAPIKeyIsValid(t *testing.T) {
 }
 
 func TestAuthMiddlewareWhenAPIKeyIsInvalid(t *testing.T) {
-	os.Setenv("FORWARDLYTICS_API_KEY", "DNUAS67AASNDj")
+	configureAPIKey("DNUAS67AASNDj")
 	req, err := http.NewRequest("GET", "/health-check", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -53,8 +59,258 @@ func TestAuthMiddlewareWhenAPIKeyIsInvalid(t *testing.T) {
 	}
 }
 
+func TestAuthMiddlewareAttachesTheSource(t *testing.T) {
+	sources.Configure([]*sources.Source{
+		{Name: "web", Keys: []sources.Key{{ID: "web-1", Secret: "web-key"}}},
+		{Name: "mobile", Keys: []sources.Key{{ID: "mobile-1", Secret: "mobile-key"}}},
+	})
+	defer sources.Configure(nil)
+	req, err := http.NewRequest("GET", "/health-check", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Forwardlytics-Api-Key", "mobile-key")
+	rr := httptest.NewRecorder()
+
+	var source string
+	AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source = requestSource(r)
+	})).ServeHTTP(rr, req)
+
+	if source != "mobile" {
+		t.Errorf("Expected the request to come from mobile, got %q", source)
+	}
+}
+
+func TestAdminMiddlewareRequiresTheDefaultSource(t *testing.T) {
+	sources.Configure([]*sources.Source{
+		{Name: sources.Default, Keys: []sources.Key{{ID: "admin-1", Secret: "admin-key"}}},
+		{Name: "web", Keys: []sources.Key{{ID: "web-1", Secret: "web-key"}}},
+	})
+	defer sources.Configure(nil)
+
+	for key, expectedStatusCode := range map[string]int{"admin-key": http.StatusOK, "web-key": http.StatusForbidden, "...": http.StatusUnauthorized} {
+		req, err := http.NewRequest("POST", "/admin/reload", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Forwardlytics-Api-Key", key)
+		rr := httptest.NewRecorder()
+
+		AdminMiddleware(FakeHandler{}).ServeHTTP(rr, req)
+
+		if rr.Code != expectedStatusCode {
+			t.Errorf("Wrong status code for %v. Expecting %v but got %v", key, expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func configureAPIKey(apiKey string) {
+	sources.Configure([]*sources.Source{{Name: sources.Default, Keys: []sources.Key{{ID: "apiKey", Secret: apiKey}}}})
+}
+
 type FakeHandler struct{}
 
 func (FakeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	writeResponse(w, "success", 200)
 }
+
+func TestSegmentAuthMiddlewareWhenWriteKeyIsValid(t *testing.T) {
+	configureAPIKey("DNUAS67AASNDj")
+	req, err := http.NewRequest("POST", "/v1/track", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("DNUAS67AASNDj", "")
+	rr := httptest.NewRecorder()
+
+	SegmentAuthMiddleware(FakeHandler{}).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestSegmentAuthMiddlewareWhenWriteKeyIsInvalid(t *testing.T) {
+	configureAPIKey("DNUAS67AASNDj")
+	req, err := http.NewRequest("POST", "/v1/track", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("...", "")
+	rr := httptest.NewRecorder()
+
+	SegmentAuthMiddleware(FakeHandler{}).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnauthorized)
+	}
+
+	expected := `{"message": "Invalid write key. The API key must be used as the basic auth username."}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func signedRequest(t *testing.T, secret string, signedAt time.Time, body string) *http.Request {
+	req, err := http.NewRequest("POST", "/track", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	req.Header.Add("Forwardlytics-Source", "server")
+	req.Header.Add("Forwardlytics-Timestamp", timestamp)
+	req.Header.Add("Forwardlytics-Signature", "sha256="+sources.Sign(secret, timestamp, []byte(body)))
+	return req
+}
+
+func TestSignatureMiddleware(t *testing.T) {
+	sources.Configure([]*sources.Source{
+		{Name: "server", Keys: []sources.Key{{ID: "server-1", Secret: "server-key"}}, RequireSignature: true},
+	})
+	defer sources.Configure(nil)
+	body := `{"name":"account.created"}`
+
+	tests := []struct {
+		description        string
+		req                *http.Request
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"valid", signedRequest(t, "server-key", time.Now(), body), http.StatusOK, body},
+		{"wrong key", signedRequest(t, "other-key", time.Now(), body), http.StatusUnauthorized, `{"message": "Invalid signature."}`},
+		{"too old", signedRequest(t, "server-key", time.Now().Add(-SignatureSkew-time.Minute), body), http.StatusUnauthorized, `{"message": "Expired signature. The Forwardlytics-Timestamp header must be within 5m0s of the current time."}`},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+
+		var source string
+		SignatureMiddleware(AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			source = requestSource(r)
+			io.Copy(w, r.Body)
+		}))).ServeHTTP(rr, test.req)
+
+		if rr.Code != test.expectedStatusCode {
+			t.Errorf("Wrong status code when %s. Expecting %v but got %v", test.description, test.expectedStatusCode, rr.Code)
+		}
+		if rr.Body.String() != test.expectedBody {
+			t.Errorf(`Wrong response when %s. Expecting "%s" but got "%s"`, test.description, test.expectedBody, rr.Body.String())
+		}
+		if test.expectedStatusCode == http.StatusOK && source != "server" {
+			t.Errorf("Expected the request to come from server, got %q", source)
+		}
+	}
+}
+
+func TestAuthMiddlewareWhenSourceRequiresSignature(t *testing.T) {
+	sources.Configure([]*sources.Source{
+		{Name: "server", Keys: []sources.Key{{ID: "server-1", Secret: "server-key"}}, RequireSignature: true},
+	})
+	defer sources.Configure(nil)
+	req, err := http.NewRequest("POST", "/track", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Forwardlytics-Api-Key", "server-key")
+	rr := httptest.NewRecorder()
+
+	SignatureMiddleware(AuthMiddleware(FakeHandler{})).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status code. Expecting %v but got %v", http.StatusUnauthorized, rr.Code)
+	}
+	expected := `{"message": "This source only accepts signed requests."}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestPublicMiddleware(t *testing.T) {
+	sources.Configure([]*sources.Source{{Name: "web", Keys: []sources.Key{
+		{ID: "browser", Secret: "public-key", Public: true, Origins: []string{"https://example.com"}},
+		{ID: "landing", Secret: "landing-key", Public: true, Origins: []string{"https://example.com"}, Types: []string{"page"}},
+	}}})
+	defer sources.Configure(nil)
+	track := PublicMiddleware("track", AuthMiddleware(FakeHandler{}))
+	identify := AuthMiddleware(FakeHandler{})
+
+	tests := []struct {
+		description        string
+		handler            http.Handler
+		method             string
+		key                string
+		origin             string
+		expectedStatusCode int
+		expectedBody       string
+		expectedCORS       bool
+	}{
+		{"preflight", track, "OPTIONS", "", "https://example.com", http.StatusNoContent, "", true},
+		{"preflight from elsewhere", track, "OPTIONS", "", "https://evil.com", http.StatusForbidden, `{"message": "Forbidden. No public key can be used from this origin."}`, false},
+		{"tracking", track, "POST", "public-key", "https://example.com", http.StatusOK, `{"message": "success"}`, true},
+		{"tracking from elsewhere", track, "POST", "public-key", "https://evil.com", http.StatusForbidden, `{"message": "Forbidden. This public key can't be used from this origin."}`, false},
+		{"tracking without origin", track, "POST", "public-key", "", http.StatusForbidden, `{"message": "Forbidden. This public key can't be used from this origin."}`, false},
+		{"tracking with a pages only key", track, "POST", "landing-key", "https://example.com", http.StatusForbidden, `{"message": "Forbidden. This public key can't be used on this endpoint."}`, true},
+		{"identifying", identify, "POST", "public-key", "https://example.com", http.StatusForbidden, `{"message": "Forbidden. This public key can't be used on this endpoint."}`, false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "/track", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.key != "" {
+			req.Header.Add("Forwardlytics-Api-Key", test.key)
+		}
+		if test.origin != "" {
+			req.Header.Add("Origin", test.origin)
+		}
+		rr := httptest.NewRecorder()
+
+		test.handler.ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedStatusCode {
+			t.Errorf("Wrong status code when %s. Expecting %v but got %v", test.description, test.expectedStatusCode, rr.Code)
+		}
+		if rr.Body.String() != test.expectedBody {
+			t.Errorf(`Wrong response when %s. Expecting "%s" but got "%s"`, test.description, test.expectedBody, rr.Body.String())
+		}
+		if cors := rr.Header().Get("Access-Control-Allow-Origin") == test.origin && test.origin != ""; cors != test.expectedCORS {
+			t.Errorf("Wrong CORS headers when %s. Expecting them: %v, got %v", test.description, test.expectedCORS, rr.Header())
+		}
+	}
+}
+
+func TestAuthMiddlewareWhenRateLimited(t *testing.T) {
+	sources.Configure([]*sources.Source{{Name: "rate-limited", Keys: []sources.Key{{ID: "job", Secret: "job-key"}}, RateLimit: sources.RateLimit{Rate: 0.5}}})
+	defer sources.Configure(nil)
+	limitedBefore := metrics.Get("rateLimitedRequests", "rate-limited")
+
+	codes := []int{}
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/track", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Forwardlytics-Api-Key", "job-key")
+		rr = httptest.NewRecorder()
+		AuthMiddleware(FakeHandler{}).ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("Expected the second request to be rate limited, got %v", codes)
+	}
+	if rr.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected to retry after 2 seconds, got %q", rr.Header().Get("Retry-After"))
+	}
+	expected := `{"message": "Too many requests. Retry in 2 seconds."}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+	if limited := metrics.Get("rateLimitedRequests", "rate-limited") - limitedBefore; limited != 1 {
+		t.Errorf("Expected 1 rate limited request in the metrics, got %d", limited)
+	}
+}
@@ -2,13 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/codeship/go-retro"
 	"github.com/jipiboily/forwardlytics/integrations"
 )
 
@@ -43,26 +41,8 @@ func Page(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := integrations.Message{Type: integrations.TypePage, Page: &page}
+	requestContext(&message, r)
 	// Yay, it worked so far, let's send all the things to integrations!
-	for _, integrationName := range integrations.IntegrationList() {
-		integration := integrations.GetIntegration(integrationName)
-		if integration.Enabled() {
-			logrus.Infof("Forwarding page to %s", integrationName)
-			err := retro.DoWithRetry(func() error {
-				e := integration.Page(page)
-				if e != nil {
-					return resourceNotReady(e)
-				}
-				return e
-			})
-			if err != nil {
-				errMsg := fmt.Sprintf("Fatal error during page with an integration (%s): %s", integrationName, err)
-				logrus.WithField("integration", integrationName).WithField("page", page).WithField("err", err).Error("Fatal error during page")
-				writeResponse(w, errMsg, 500)
-				return
-			}
-		}
-	}
-
-	writeResponse(w, "Forwarding page to integrations.", http.StatusOK)
+	forward(w, message, "page")
 }
@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jipiboily/forwardlytics/delivery"
 	"github.com/jipiboily/forwardlytics/integrations"
 )
 
@@ -56,7 +57,7 @@ func TestPageWhenInvalidJSON(t *testing.T) {
 
 func TestPageWhenMissingParameter(t *testing.T) {
 	expectedStatusCode := 400
-	expectedBody := `{"message": "Missing parameters: name, url, userID, timestamp."}`
+	expectedBody := `{"message": "Missing parameters: name, url, userID or anonymousID, timestamp."}`
 
 	requestBody := `{}`
 	r, err := http.NewRequest("POST", "/page", strings.NewReader(requestBody))
@@ -77,8 +78,8 @@ func TestPageWhenMissingParameter(t *testing.T) {
 }
 
 func TestPageWhenOneIntegrationFails(t *testing.T) {
-	expectedStatusCode := 500
-	expectedBody := `{"message": "Fatal error during page with an integration (test-only-integration-failing): some random error"}`
+	expectedStatusCode := 207
+	expectedBody := `{"message":"Fatal error during page with some integrations.","destinations":[{"integration":"test-only-integration-failing","status":"failed","error":"some random error","attempts":1},{"integration":"test-only-integration-working","status":"accepted","attempts":1}]}`
 
 	requestBody := `{
 		"name":"something.created",
@@ -96,6 +97,7 @@ func TestPageWhenOneIntegrationFails(t *testing.T) {
 	failingIntegration := FailingIntegrationPage{}
 	integrations.RegisterIntegration("test-only-integration-failing", failingIntegration)
 	defer integrations.RemoveIntegration("test-only-integration-failing")
+	defer delivery.Reset()
 
 	workingIntegration := FakeIntegration{}
 	integrations.RegisterIntegration("test-only-integration-working", workingIntegration)
@@ -114,7 +116,7 @@ func TestPageWhenOneIntegrationFails(t *testing.T) {
 
 func TestPageWhenValid(t *testing.T) {
 	expectedStatusCode := 200
-	expectedBody := `{"message": "Forwarding page to integrations."}`
+	expectedBody := `{"message":"Forwarding page to integrations.","destinations":[{"integration":"test-only-integration-called","status":"accepted","attempts":1}]}`
 
 	requestBody := `{
 		"name":"something.created",
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/metrics"
+	"github.com/jipiboily/forwardlytics/sources"
+)
+
+// transparentGIF is a 1x1 transparent GIF, the smallest image browsers and
+// email clients display without complaining
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// Prefix of the query parameters holding the properties of the message, like
+// properties.plan=pro
+const pixelPropertiesPrefix = "properties."
+
+// PixelMaxAge is how long a signed pixel is accepted after its timestamp, as
+// emails are opened long after being sent. Older ones are ignored, so that a
+// pixel URL can't be used forever.
+var PixelMaxAge = 30 * 24 * time.Hour
+
+// Pixel is taking an event or page-view from the URL of an image, for emails
+// and pages without JavaScript. The message is either the base64 encoded JSON
+// of a batch message in the data parameter, or the fields of the message as
+// parameters: type (track when missing), name, userID, anonymousID, url,
+// messageID, timestamp and properties.<name>. The time the pixel is loaded is
+// used when there is no timestamp.
+//
+// The pixel is authenticated with a public key in the key parameter, or
+// signed: the source, ts and sig parameters are the headers of a signed
+// request, with data as the body. Signed pixels expire after PixelMaxAge.
+//
+// The image is returned whatever happens, so the problems are only logged.
+func Pixel(w http.ResponseWriter, r *http.Request) {
+	// This is the soonest we can do that, pretty much at least.
+	receivedAt := time.Now().Unix()
+	defer writePixel(w)
+
+	query := r.URL.Query()
+	message, err := pixelMessage(query, receivedAt)
+	if err != nil {
+		logrus.WithField("err", err).WithField("query", r.URL.RawQuery).Warn("Invalid pixel")
+		return
+	}
+
+	source, keyID, err := pixelSource(r, query)
+	if err != nil {
+		logrus.WithField("err", err).WithField("query", r.URL.RawQuery).Warn("Unauthenticated pixel")
+		return
+	}
+	if key, _ := source.Key(keyID); !key.Allows(message.Type) {
+		logrus.WithField("source", source.Name).WithField("keyID", keyID).WithField("type", message.Type).Warn("Pixel with a type its key can't send")
+		return
+	}
+	if ok, wait := source.AllowRequest(keyID); !ok {
+		metrics.Add(metricRateLimitedRequests, source.Name, 1)
+		logrus.WithField("source", source.Name).WithField("keyID", keyID).WithField("retryAfter", wait).Warn("Pixel rate limited")
+		return
+	}
+	r = withSource(r, source, keyID)
+
+	requestContext(&message, r)
+	missingParameters := message.Validate()
+	if len(missingParameters) != 0 {
+		logrus.WithField("missingParameters", missingParameters).WithField("query", r.URL.RawQuery).Warn("Invalid pixel")
+		return
+	}
+	_, err = dispatch(message)
+	if _, limited := err.(rateLimitedError); err != nil && err != errDuplicate && err != errDropped && !limited {
+		logrus.WithField("err", err).WithField("messageID", message.ID()).Error("Error dispatching the pixel")
+	}
+}
+
+// pixelMessage decodes the event or page-view of a pixel
+func pixelMessage(query url.Values, receivedAt int64) (message integrations.Message, err error) {
+	var data []byte
+	if encoded := query.Get("data"); encoded != "" {
+		data, err = decodeBase64(encoded)
+		if err != nil {
+			return
+		}
+	} else {
+		data, err = json.Marshal(pixelFields(query))
+		if err != nil {
+			return
+		}
+	}
+
+	message, err = decodeMessage(data, receivedAt)
+	if err != nil {
+		return
+	}
+	switch {
+	case message.Event != nil:
+		if message.Event.Timestamp == 0 {
+			message.Event.Timestamp = receivedAt
+		}
+	case message.Page != nil:
+		if message.Page.Timestamp == 0 {
+			message.Page.Timestamp = receivedAt
+		}
+	default:
+		err = errors.New("a pixel can only be a track or page call")
+	}
+	return
+}
+
+// pixelFields returns the fields of a message sent as query parameters
+func pixelFields(query url.Values) map[string]interface{} {
+	fields := map[string]interface{}{"type": integrations.TypeTrack}
+	properties := make(map[string]interface{})
+	for name, values := range query {
+		value := values[0]
+		switch {
+		case name == "type", name == "name", name == "userID", name == "anonymousID", name == "url", name == "messageID":
+			fields[name] = value
+		case name == "timestamp":
+			if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+				fields[name] = timestamp
+			}
+		case strings.HasPrefix(name, pixelPropertiesPrefix):
+			properties[strings.TrimPrefix(name, pixelPropertiesPrefix)] = value
+		}
+	}
+	fields["properties"] = properties
+	return fields
+}
+
+// decodeBase64 accepts both the standard and URL alphabets, with or without
+// padding, as they're all found in URLs
+func decodeBase64(encoded string) (data []byte, err error) {
+	for _, encoding := range []*base64.Encoding{base64.URLEncoding, base64.RawURLEncoding, base64.StdEncoding, base64.RawStdEncoding} {
+		if data, err = encoding.DecodeString(encoded); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// pixelSource authenticates a pixel with its signature, or its public key.
+// Other keys would leak in the URL, so they're refused.
+func pixelSource(r *http.Request, query url.Values) (*sources.Source, string, error) {
+	if signature := query.Get("sig"); signature != "" {
+		data := query.Get("data")
+		if data == "" {
+			return nil, "", errors.New("only pixels with data can be signed")
+		}
+		source := sources.Get(query.Get("source"))
+		if source == nil {
+			return nil, "", errors.New("unknown source")
+		}
+		keyID, ok := source.VerifySignature(query.Get("ts"), []byte(data), strings.TrimPrefix(signature, signaturePrefix))
+		if !ok {
+			return nil, "", errors.New("invalid signature")
+		}
+		signedAt, err := strconv.ParseInt(query.Get("ts"), 10, 64)
+		if err != nil {
+			return nil, "", errors.New("invalid timestamp")
+		}
+		if age := time.Since(time.Unix(signedAt, 0)); age > PixelMaxAge || age < -SignatureSkew {
+			return nil, "", errors.New("expired signature")
+		}
+		return source, keyID, nil
+	}
+
+	source, keyID := sources.Authenticate(query.Get("key"))
+	if source == nil {
+		return nil, "", errors.New("invalid key")
+	}
+	key, _ := source.Key(keyID)
+	if !key.Public {
+		logrus.WithField("source", source.Name).WithField("keyID", keyID).Error("Secret API key used in a pixel URL, it should be replaced")
+		return nil, "", errors.New("only public keys can be used in pixels")
+	}
+	if !key.AllowsOrigin(pixelOrigin(r)) {
+		return nil, "", errors.New("public key used from another origin")
+	}
+	return source, keyID, nil
+}
+
+// pixelOrigin returns the origin of the page showing the pixel. Browsers don't
+// send the Origin header when loading images, but the Referer tells it.
+func pixelOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+	return referer.Scheme + "://" + referer.Host
+}
+
+// writePixel sends the transparent GIF, making sure it's loaded every time
+func writePixel(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.WriteHeader(http.StatusOK)
+	w.Write(transparentGIF)
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/sources"
+)
+
+func TestPixel(t *testing.T) {
+	sources.Configure([]*sources.Source{{Name: "web", Keys: []sources.Key{
+		{ID: "server", Secret: "web-key"},
+		{ID: "browser", Secret: "public-key", Public: true, Origins: []string{"https://example.com"}},
+	}}})
+	defer sources.Configure(nil)
+	data := base64.URLEncoding.EncodeToString([]byte(`{"type":"track","name":"email.opened","userID":"123","properties":{"campaign":"welcome"}}`))
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := url.Values{
+		"data":   {data},
+		"source": {"web"},
+		"ts":     {ts},
+		"sig":    {"sha256=" + sources.Sign("web-key", ts, []byte(data))},
+	}
+	forged := url.Values{"data": {data}, "source": {"web"}, "ts": {ts}, "sig": {sources.Sign("public-key", ts, []byte(data))}}
+	expired := url.Values{"data": {data}, "source": {"web"}, "ts": {"1459468800"}, "sig": {"sha256=" + sources.Sign("web-key", "1459468800", []byte(data))}}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	early := url.Values{"data": {data}, "source": {"web"}, "ts": {future}, "sig": {"sha256=" + sources.Sign("web-key", future, []byte(data))}}
+
+	tests := []struct {
+		description   string
+		query         string
+		referer       string
+		expectedEvent string
+		expectedPage  string
+	}{
+		{"signed", signed.Encode(), "", "email.opened", ""},
+		{"signed with a public key", forged.Encode(), "", "", ""},
+		{"signed too long ago", expired.Encode(), "", "", ""},
+		{"signed in the future", early.Encode(), "", "", ""},
+		{"with a public key", "key=public-key&name=signup.viewed&anonymousID=f4b5c3&properties.plan=pro", "https://example.com/signup", "signup.viewed", ""},
+		{"page with a public key", "key=public-key&type=page&name=pricing&url=https://example.com/pricing&userID=123", "https://example.com/pricing", "", "pricing"},
+		{"from another origin", "key=public-key&name=signup.viewed&anonymousID=f4b5c3", "https://evil.com/", "", ""},
+		{"with a secret key", "key=web-key&name=signup.viewed&anonymousID=f4b5c3", "https://example.com/", "", ""},
+		{"identifying", "key=public-key&type=identify&userID=123", "https://example.com/", "", ""},
+		{"without key", "name=signup.viewed&anonymousID=f4b5c3", "https://example.com/", "", ""},
+		{"with invalid data", "key=public-key&data=%25%25", "https://example.com/", "", ""},
+	}
+	for _, test := range tests {
+		integration := &SegmentIntegration{}
+		integrations.RegisterIntegration("test-only-integration-pixel", integration)
+
+		req, err := http.NewRequest("GET", "/pixel.gif?"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.referer != "" {
+			req.Header.Set("Referer", test.referer)
+		}
+		rr := httptest.NewRecorder()
+
+		Pixel(rr, req)
+		integrations.RemoveIntegration("test-only-integration-pixel")
+
+		if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), transparentGIF) {
+			t.Errorf("Expected the pixel when %s, got %v %q", test.description, rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("Content-Type") != "image/gif" || rr.Header().Get("Cache-Control") != "no-cache, no-store, must-revalidate, private" {
+			t.Errorf("Wrong headers when %s: %v", test.description, rr.Header())
+		}
+		if integration.Tracked.Name != test.expectedEvent {
+			t.Errorf("Wrong event when %s. Expecting %q but got %q", test.description, test.expectedEvent, integration.Tracked.Name)
+		}
+		if integration.Paged.Name != test.expectedPage {
+			t.Errorf("Wrong page when %s. Expecting %q but got %q", test.description, test.expectedPage, integration.Paged.Name)
+		}
+	}
+}
+
+func TestPixelMessage(t *testing.T) {
+	query, err := url.ParseQuery("name=signup.viewed&anonymousID=f4b5c3&properties.plan=pro&timestamp=1459468800")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := pixelMessage(query, 1459468900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := message.Event
+	if message.Type != integrations.TypeTrack || event.Name != "signup.viewed" || event.AnonymousID != "f4b5c3" || event.Properties["plan"] != "pro" {
+		t.Errorf("Wrong message: %+v %+v", message, event)
+	}
+	if event.Timestamp != 1459468800 || event.ReceivedAt != 1459468900 {
+		t.Errorf("Wrong times, got %v and %v", event.Timestamp, event.ReceivedAt)
+	}
+
+	query = url.Values{"data": {base64.RawStdEncoding.EncodeToString([]byte(`{"type":"page","name":"pricing","userID":"123"}`))}}
+	message, err = pixelMessage(query, 1459468900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Page == nil || message.Page.Name != "pricing" || message.Page.Timestamp != 1459468900 {
+		t.Errorf("Expected the page to be loaded now, got %+v", message.Page)
+	}
+}
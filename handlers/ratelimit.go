@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/metrics"
+	"github.com/jipiboily/forwardlytics/sources"
+)
+
+// Counters of the requests and messages refused by the rate limits, by source
+const (
+	metricRateLimitedRequests = "rateLimitedRequests"
+	metricRateLimitedMessages = "rateLimitedMessages"
+)
+
+// rateLimitedError is returned when dispatching a message about a user who
+// already got too many of them
+type rateLimitedError struct {
+	retryAfter time.Duration
+}
+
+func (e rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %v", e.retryAfter)
+}
+
+// withinRateLimit takes a request from the bucket of the key, answering 429
+// when it's empty
+func withinRateLimit(w http.ResponseWriter, r *http.Request, source *sources.Source, keyID string) bool {
+	ok, wait := source.AllowRequest(keyID)
+	if ok {
+		return true
+	}
+	metrics.Add(metricRateLimitedRequests, source.Name, 1)
+	logrus.WithField("source", source.Name).WithField("keyID", keyID).WithField("path", r.URL.Path).WithField("retryAfter", wait).Warn("Request rate limited")
+	writeRateLimited(w, "Too many requests.", wait)
+	return false
+}
+
+// allowMessage takes a message from the bucket of its user, when the source
+// limits them, and returns a rateLimitedError when it's empty
+func allowMessage(message integrations.Message) error {
+	ok, wait := sources.Get(message.Source).AllowMessage(message)
+	if ok {
+		return nil
+	}
+	metrics.Add(metricRateLimitedMessages, message.Source, 1)
+	logrus.WithField("source", message.Source).WithField("type", message.Type).WithField("retryAfter", wait).Warn("Message rate limited")
+	return rateLimitedError{retryAfter: wait}
+}
+
+// writeRateLimited answers 429, telling the client when to retry
+func writeRateLimited(w http.ResponseWriter, body string, wait time.Duration) {
+	seconds := retryAfterSeconds(wait)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeResponse(w, fmt.Sprintf("%s Retry in %d seconds.", body, seconds), http.StatusTooManyRequests)
+}
+
+// retryAfterSeconds rounds the wait up to whole seconds, as Retry-After
+// expects, never less than one
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Max(1, math.Ceil(wait.Seconds())))
+}
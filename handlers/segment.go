@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/delivery"
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+var (
+	errUnknownCall = errors.New("unknown Segment call")
+	errInvalidTime = errors.New("invalid timestamp")
+)
+
+// segmentCall is a call following Segment's spec, see
+// https://segment.com/docs/spec/common/
+type segmentCall struct {
+	Type              string                 `json:"type"`
+	UserID            string                 `json:"userId"`
+	AnonymousID       string                 `json:"anonymousId"`
+	MessageID         string                 `json:"messageId"`
+	Event             string                 `json:"event"`
+	Name              string                 `json:"name"`
+	Traits            map[string]interface{} `json:"traits"`
+	Properties        map[string]interface{} `json:"properties"`
+	Context           map[string]interface{} `json:"context"`
+	Timestamp         string                 `json:"timestamp"`
+	OriginalTimestamp string                 `json:"originalTimestamp"`
+	PreviousID        string                 `json:"previousId"`
+	GroupID           string                 `json:"groupId"`
+}
+
+type segmentBatch struct {
+	Batch   []segmentCall          `json:"batch"`
+	Context map[string]interface{} `json:"context"`
+}
+
+type segmentResponse struct {
+	Success      bool              `json:"success"`
+	Message      string            `json:"message,omitempty"`
+	Destinations []delivery.Status `json:"destinations,omitempty"`
+	Results      []batchResult     `json:"results,omitempty"`
+}
+
+// Segment accepts calls following Segment's HTTP tracking API, so that
+// Segment client libraries can be pointed at Forwardlytics. It's meant to be
+// mounted on /v1/, and handles identify, track, page, screen, alias, group and
+// batch calls. See https://segment.com/docs/sources/server/http/
+func Segment(w http.ResponseWriter, r *http.Request) {
+	// This is the soonest we can do that, pretty much at least.
+	receivedAt := time.Now().Unix()
+
+	// This endpoint is a POST, everything else be a 404
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	callType := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if callType == "batch" {
+		segmentBatchCall(w, r, receivedAt)
+		return
+	}
+	switch callType {
+	case "identify", "track", "page", "screen", "alias", "group":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// Unmarshal input JSON
+	decoder := json.NewDecoder(r.Body)
+	var call segmentCall
+	err := decoder.Decode(&call)
+	if err != nil {
+		logrus.WithField("err", err).WithField("body", r.Body).Error("Bad request in Segment")
+		writeResponse(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+	call.Type = callType
+
+	message, err := call.message(receivedAt)
+	switch err {
+	case nil:
+		requestContext(&message, r)
+	case errInvalidTime:
+		writeResponse(w, "Invalid timestamp, expecting ISO-8601.", http.StatusBadRequest)
+		return
+	default:
+		writeResponse(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+
+	// Input validation
+	missingParameters := message.Validate()
+	if len(missingParameters) != 0 {
+		msg := "Missing parameters: "
+		msg = msg + strings.Join(missingParameters, ", ") + "."
+		writeResponse(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	statuses, err := dispatch(message)
+	if err == errDuplicate {
+		writeSegmentResponse(w, segmentResponse{Success: true, Message: fmt.Sprintf("Ignoring duplicate %s.", callType)}, http.StatusOK)
+		return
+	}
+	if err == errDropped {
+		writeSegmentResponse(w, segmentResponse{Success: true, Message: fmt.Sprintf("Dropped %s, as the rules of the source say.", callType)}, http.StatusOK)
+		return
+	}
+	if limited, ok := err.(rateLimitedError); ok {
+		writeRateLimited(w, "Too many messages about this user.", limited.retryAfter)
+		return
+	}
+	if err != nil {
+		writeResponse(w, "Error queueing the message.", http.StatusInternalServerError)
+		return
+	}
+
+	// Segment libraries retry anything but a 200, so partial failures are
+	// only reported in the body to avoid duplicates.
+	if accepted, failed := countStatuses(statuses); Queue == nil && failed > 0 && accepted == 0 {
+		writeSegmentResponse(w, segmentResponse{Message: fmt.Sprintf("Fatal error during %s with all integrations.", callType), Destinations: statuses}, http.StatusInternalServerError)
+		return
+	}
+	writeSegmentResponse(w, segmentResponse{Success: true, Destinations: statuses}, http.StatusOK)
+}
+
+func segmentBatchCall(w http.ResponseWriter, r *http.Request, receivedAt int64) {
+	// Unmarshal input JSON
+	decoder := json.NewDecoder(r.Body)
+	var batch segmentBatch
+	err := decoder.Decode(&batch)
+	if err != nil {
+		logrus.WithField("err", err).WithField("body", r.Body).Error("Bad request in Segment batch")
+		writeResponse(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+	if len(batch.Batch) == 0 {
+		writeResponse(w, "Empty batch.", http.StatusBadRequest)
+		return
+	}
+	if len(batch.Batch) > maxBatchSize {
+		writeResponse(w, fmt.Sprintf("Too many messages in the batch, the maximum is %d.", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(batch.Batch))
+	for index, call := range batch.Batch {
+		if call.Context == nil {
+			call.Context = batch.Context
+		}
+		message, err := call.message(receivedAt)
+		switch err {
+		case nil:
+			requestContext(&message, r)
+			results[index] = batchDispatch(index, message)
+		case errInvalidTime:
+			results[index] = batchResult{Index: index, Type: call.Type, Status: batchStatusInvalid, Message: "Invalid timestamp, expecting ISO-8601."}
+		default:
+			results[index] = batchResult{Index: index, Type: call.Type, Status: batchStatusInvalid, Message: "Unknown type."}
+		}
+	}
+	writeSegmentResponse(w, segmentResponse{Success: true, Results: results}, http.StatusOK)
+}
+
+// message translates the Segment call into a Forwardlytics message
+func (c segmentCall) message(receivedAt int64) (message integrations.Message, err error) {
+	timestamp, err := c.timestamp(receivedAt)
+	if err != nil {
+		return
+	}
+
+	message.Type = c.Type
+	switch c.Type {
+	case "identify":
+		message.Identification = &integrations.Identification{
+			UserID:      c.UserID,
+			AnonymousID: c.AnonymousID,
+			UserTraits:  c.Traits,
+			Timestamp:   timestamp,
+			ReceivedAt:  receivedAt,
+		}
+	case "track":
+		message.Event = &integrations.Event{
+			Name:        c.Event,
+			UserID:      c.UserID,
+			AnonymousID: c.AnonymousID,
+			Properties:  c.Properties,
+			Timestamp:   timestamp,
+			ReceivedAt:  receivedAt,
+		}
+	case "page":
+		message.Page = &integrations.Page{
+			Name:        c.pageName(),
+			UserID:      c.UserID,
+			AnonymousID: c.AnonymousID,
+			Url:         c.pageUrl(),
+			Properties:  c.Properties,
+			Timestamp:   timestamp,
+			ReceivedAt:  receivedAt,
+		}
+	case "screen":
+		// Mobile screens have no URL, they're tracked as events the way
+		// Segment does for most destinations.
+		name := "Viewed Screen"
+		if c.Name != "" {
+			name = "Viewed " + c.Name + " Screen"
+		}
+		message.Type = integrations.TypeTrack
+		message.Event = &integrations.Event{
+			Name:        name,
+			UserID:      c.UserID,
+			AnonymousID: c.AnonymousID,
+			Properties:  c.Properties,
+			Timestamp:   timestamp,
+			ReceivedAt:  receivedAt,
+		}
+	case "alias":
+		message.Alias = &integrations.Alias{
+			PreviousID: c.PreviousID,
+			UserID:     c.UserID,
+			UserTraits: c.Traits,
+			Timestamp:  timestamp,
+			ReceivedAt: receivedAt,
+		}
+	case "group":
+		message.Group = &integrations.Group{
+			GroupID:     c.GroupID,
+			Traits:      c.Traits,
+			UserID:      c.UserID,
+			AnonymousID: c.AnonymousID,
+			Timestamp:   timestamp,
+			ReceivedAt:  receivedAt,
+		}
+	default:
+		err = errUnknownCall
+	}
+	message.SetID(c.MessageID)
+	message.SetContext(c.context())
+	return
+}
+
+// context reads the fields of Segment's context Forwardlytics knows about, see
+// https://segment.com/docs/spec/common/#context
+func (c segmentCall) context() *integrations.Context {
+	if c.Context == nil {
+		return nil
+	}
+	// Both use the same names, so it can go through JSON
+	data, err := json.Marshal(c.Context)
+	if err != nil {
+		return nil
+	}
+	var context integrations.Context
+	if err = json.Unmarshal(data, &context); err != nil {
+		logrus.WithField("err", err).WithField("context", c.Context).Warn("Ignoring invalid Segment context")
+		return nil
+	}
+	return &context
+}
+
+// timestamp returns when the call happened, as a unix timestamp. Segment sends
+// ISO-8601 dates, and defaults to when the call was received.
+func (c segmentCall) timestamp(receivedAt int64) (int64, error) {
+	value := c.Timestamp
+	if value == "" {
+		value = c.OriginalTimestamp
+	}
+	if value == "" {
+		return receivedAt, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, errInvalidTime
+	}
+	return t.Unix(), nil
+}
+
+func (c segmentCall) pageUrl() string {
+	if url, ok := c.Properties["url"].(string); ok && url != "" {
+		return url
+	}
+	if page, ok := c.Context["page"].(map[string]interface{}); ok {
+		if url, ok := page["url"].(string); ok {
+			return url
+		}
+	}
+	return ""
+}
+
+func (c segmentCall) pageName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if title, ok := c.Properties["title"].(string); ok && title != "" {
+		return title
+	}
+	return c.pageUrl()
+}
+
+func writeSegmentResponse(w http.ResponseWriter, response segmentResponse, statusCode int) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		logrus.WithField("err", err).Error("Error marshalling the response")
+		writeResponse(w, response.Message, statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func TestSegmentWhenUnknownCall(t *testing.T) {
+	expectedStatusCode := 404
+	expectedBody := "404 page not found"
+
+	r, err := http.NewRequest("POST", "/v1/something", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Segment(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestSegmentTrack(t *testing.T) {
+	expectedStatusCode := 200
+	expectedBody := `{"success":true,"destinations":[{"integration":"test-only-integration-segment","status":"accepted","attempts":1}]}`
+
+	requestBody := `{
+		"userId": "123",
+		"anonymousId": "507f191e810c19729de860ea",
+		"messageId": "022bb90c-bbac-11e4-8dfc-aa07a5b093db",
+		"event": "Item Purchased",
+		"properties": { "revenue": 39.95 },
+		"context": { "ip": "8.8.8.8" },
+		"timestamp": "2016-04-01T17:47:11.000Z"
+	}`
+	r, err := http.NewRequest("POST", "/v1/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &SegmentIntegration{}
+	integrations.RegisterIntegration("test-only-integration-segment", integration)
+	defer integrations.RemoveIntegration("test-only-integration-segment")
+
+	Segment(w, r)
+
+	if integration.Tracked.Name != "Item Purchased" || integration.Tracked.UserID != "123" {
+		t.Errorf("Wrong event forwarded: %#v", integration.Tracked)
+	}
+	if integration.Tracked.Timestamp != 1459532831 {
+		t.Errorf("Expecting the timestamp to be 1459532831, got %v", integration.Tracked.Timestamp)
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestSegmentTrackWhenInvalidTimestamp(t *testing.T) {
+	expectedStatusCode := 400
+	expectedBody := `{"message": "Invalid timestamp, expecting ISO-8601."}`
+
+	requestBody := `{"userId": "123", "event": "Item Purchased", "timestamp": "yesterday"}`
+	r, err := http.NewRequest("POST", "/v1/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	Segment(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestSegmentPageUsesContextURL(t *testing.T) {
+	requestBody := `{
+		"userId": "123",
+		"properties": { "title": "Welcome" },
+		"context": { "page": { "url": "http://www.example.com/" } }
+	}`
+	r, err := http.NewRequest("POST", "/v1/page", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &SegmentIntegration{}
+	integrations.RegisterIntegration("test-only-integration-segment", integration)
+	defer integrations.RemoveIntegration("test-only-integration-segment")
+
+	Segment(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Wrong status code. Expecting 200 but got %v: %s", w.Code, w.Body.String())
+	}
+	if integration.Paged.Url != "http://www.example.com/" {
+		t.Errorf("Expecting the url from the context, got %v", integration.Paged.Url)
+	}
+	if integration.Paged.Name != "Welcome" {
+		t.Errorf("Expecting the name to default to the title, got %v", integration.Paged.Name)
+	}
+	if integration.Paged.Timestamp == 0 {
+		t.Error("Expecting the timestamp to default to when the page was received")
+	}
+}
+
+func TestSegmentScreenIsTrackedAsEvent(t *testing.T) {
+	requestBody := `{"userId": "123", "name": "Home", "timestamp": "2016-04-01T17:47:11Z"}`
+	r, err := http.NewRequest("POST", "/v1/screen", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &SegmentIntegration{}
+	integrations.RegisterIntegration("test-only-integration-segment", integration)
+	defer integrations.RemoveIntegration("test-only-integration-segment")
+
+	Segment(w, r)
+
+	if integration.Tracked.Name != "Viewed Home Screen" {
+		t.Errorf("Expecting the Viewed Home Screen event, got %#v", integration.Tracked)
+	}
+}
+
+func TestSegmentContext(t *testing.T) {
+	requestBody := `{
+		"userId": "123",
+		"event": "Signed Up",
+		"context": {
+			"ip": "1.2.3.4",
+			"library": { "name": "analytics-ruby", "version": "2.2.2" },
+			"app": { "version": "1.2.0" }
+		}
+	}`
+	r, err := http.NewRequest("POST", "/v1/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("User-Agent", "analytics-ruby/2.2.2")
+	w := httptest.NewRecorder()
+
+	integration := &SegmentIntegration{}
+	integrations.RegisterIntegration("test-only-integration-segment", integration)
+	defer integrations.RemoveIntegration("test-only-integration-segment")
+
+	Segment(w, r)
+
+	context := integration.Tracked.Context
+	if context == nil || context.IP != "1.2.3.4" || context.Library == nil || context.Library.Name != "analytics-ruby" || context.App.Version != "1.2.0" {
+		t.Fatalf("Expected the Segment context to be kept, got %#v", context)
+	}
+	if context.UserAgent != "analytics-ruby/2.2.2" {
+		t.Errorf("Expected the user agent of the request, got %v", context.UserAgent)
+	}
+}
+
+func TestSegmentGroup(t *testing.T) {
+	requestBody := `{"userId": "123", "groupId": "company-456", "traits": {"name": "Acme"}, "timestamp": "2016-04-01T17:47:11Z"}`
+	r, err := http.NewRequest("POST", "/v1/group", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &GroupedIntegration{}
+	integrations.RegisterIntegration("test-only-integration-grouped", integration)
+	defer integrations.RemoveIntegration("test-only-integration-grouped")
+
+	Segment(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Wrong status code. Expecting 200 but got %v: %s", w.Code, w.Body.String())
+	}
+	if integration.Grouped.GroupID != "company-456" || integration.Grouped.UserID != "123" || integration.Grouped.Traits["name"] != "Acme" {
+		t.Errorf("Wrong group forwarded: %#v", integration.Grouped)
+	}
+}
+
+func TestSegmentGroupWhenAnonymous(t *testing.T) {
+	requestBody := `{"anonymousId": "anonymous-456", "groupId": "company-456", "timestamp": "2016-04-01T17:47:11Z"}`
+	r, err := http.NewRequest("POST", "/v1/group", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &GroupedIntegration{}
+	integrations.RegisterIntegration("test-only-integration-grouped", integration)
+	defer integrations.RemoveIntegration("test-only-integration-grouped")
+
+	Segment(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Wrong status code. Expecting 200 but got %v: %s", w.Code, w.Body.String())
+	}
+	if integration.Grouped.GroupID != "company-456" || integration.Grouped.AnonymousID != "anonymous-456" {
+		t.Errorf("Wrong group forwarded: %#v", integration.Grouped)
+	}
+}
+
+func TestSegmentBatch(t *testing.T) {
+	expectedStatusCode := 200
+	expectedBody := `{"success":true,"results":[{"index":0,"type":"identify","status":"accepted","destinations":[{"integration":"test-only-integration-segment","status":"accepted","attempts":1}]},{"index":1,"type":"track","status":"invalid","message":"Missing parameters: name."}]}`
+
+	requestBody := `{
+		"batch": [
+			{"type": "identify", "userId": "123", "traits": {"email": "john@example.com"}, "timestamp": "2016-04-01T17:47:11Z"},
+			{"type": "track", "userId": "123", "timestamp": "2016-04-01T17:47:11Z"}
+		]
+	}`
+	r, err := http.NewRequest("POST", "/v1/batch", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	integration := &SegmentIntegration{}
+	integrations.RegisterIntegration("test-only-integration-segment", integration)
+	defer integrations.RemoveIntegration("test-only-integration-segment")
+
+	Segment(w, r)
+
+	if integration.Identified.UserTraits["email"] != "john@example.com" {
+		t.Errorf("Expecting the traits to be forwarded, got %#v", integration.Identified)
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+// SegmentIntegration keeps what it receives
+type SegmentIntegration struct {
+	FakeIntegration
+	Identified integrations.Identification
+	Tracked    integrations.Event
+	Paged      integrations.Page
+}
+
+func (i *SegmentIntegration) Identify(identification integrations.Identification) error {
+	i.Identified = identification
+	return nil
+}
+
+func (i *SegmentIntegration) Track(event integrations.Event) error {
+	i.Tracked = event
+	return nil
+}
+
+func (i *SegmentIntegration) Page(page integrations.Page) error {
+	i.Paged = page
+	return nil
+}
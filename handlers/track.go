@@ -2,13 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/codeship/go-retro"
 	"github.com/jipiboily/forwardlytics/integrations"
 )
 
@@ -43,26 +41,8 @@ func Track(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := integrations.Message{Type: integrations.TypeTrack, Event: &event}
+	requestContext(&message, r)
 	// Yay, it worked so far, let's send all the things to integrations!
-	for _, integrationName := range integrations.IntegrationList() {
-		integration := integrations.GetIntegration(integrationName)
-		if integration.Enabled() {
-			logrus.Infof("Forwarding event to %s", integrationName)
-			err := retro.DoWithRetry(func() error {
-				e := integration.Track(event)
-				if e != nil {
-					return resourceNotReady(e)
-				}
-				return e
-			})
-			if err != nil {
-				errMsg := fmt.Sprintf("Fatal error during event with an integration (%s): %s", integrationName, err)
-				logrus.WithField("integration", integrationName).WithField("event", event).WithField("err", err).Error("Fatal error during event")
-				writeResponse(w, errMsg, 500)
-				return
-			}
-		}
-	}
-
-	writeResponse(w, "Forwarding event to integrations.", http.StatusOK)
+	forward(w, message, "event")
 }
@@ -2,13 +2,20 @@ package handlers
 
 import (
 	"errors"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/jipiboily/forwardlytics/dedup"
+	"github.com/jipiboily/forwardlytics/delivery"
 	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/queue"
+	"github.com/jipiboily/forwardlytics/sources"
 )
 
 func TestTrackWhenNotPOST(t *testing.T) {
@@ -56,7 +63,7 @@ func TestTrackWhenInvalidJSON(t *testing.T) {
 
 func TestTrackWhenMissingParameter(t *testing.T) {
 	expectedStatusCode := 400
-	expectedBody := `{"message": "Missing parameters: name, userID, timestamp."}`
+	expectedBody := `{"message": "Missing parameters: name, userID or anonymousID, timestamp."}`
 
 	requestBody := `{}`
 	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
@@ -77,8 +84,8 @@ func TestTrackWhenMissingParameter(t *testing.T) {
 }
 
 func TestTrackWhenOneIntegrationFails(t *testing.T) {
-	expectedStatusCode := 500
-	expectedBody := `{"message": "Fatal error during event with an integration (test-only-integration-failing): some random error"}`
+	expectedStatusCode := 207
+	expectedBody := `{"message":"Fatal error during event with some integrations.","destinations":[{"integration":"test-only-integration-failing","status":"failed","error":"some random error","attempts":1},{"integration":"test-only-integration-working","status":"accepted","attempts":1}]}`
 
 	requestBody := `{
 		"name":"something.created",
@@ -95,6 +102,7 @@ func TestTrackWhenOneIntegrationFails(t *testing.T) {
 	failingIntegration := FailingIntegrationTrack{}
 	integrations.RegisterIntegration("test-only-integration-failing", failingIntegration)
 	defer integrations.RemoveIntegration("test-only-integration-failing")
+	defer delivery.Reset()
 
 	workingIntegration := FakeIntegration{}
 	integrations.RegisterIntegration("test-only-integration-working", workingIntegration)
@@ -111,9 +119,45 @@ func TestTrackWhenOneIntegrationFails(t *testing.T) {
 	}
 }
 
+func TestTrackWhenAllIntegrationsFail(t *testing.T) {
+	expectedStatusCode := 500
+	expectedBody := `{"message":"Fatal error during event with all integrations.","destinations":[{"integration":"test-only-integration-disabled","status":"skipped"},{"integration":"test-only-integration-failing","status":"failed","error":"some random error","attempts":1}]}`
+
+	requestBody := `{
+		"name":"something.created",
+		"userID":"123",
+		"properties": { "someCounter": 97 },
+		"timestamp": 12345678
+	}`
+	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	failingIntegration := FailingIntegrationTrack{}
+	integrations.RegisterIntegration("test-only-integration-failing", failingIntegration)
+	defer integrations.RemoveIntegration("test-only-integration-failing")
+	defer delivery.Reset()
+
+	disabledIntegration := DisabledIntegration{}
+	integrations.RegisterIntegration("test-only-integration-disabled", disabledIntegration)
+	defer integrations.RemoveIntegration("test-only-integration-disabled")
+
+	Track(w, r)
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
 func TestTrackWhenValid(t *testing.T) {
 	expectedStatusCode := 200
-	expectedBody := `{"message": "Forwarding event to integrations."}`
+	expectedBody := `{"message":"Forwarding event to integrations.","destinations":[{"integration":"test-only-integration-called","status":"accepted","attempts":1}]}`
 
 	requestBody := `{
 		"name":"something.created",
@@ -146,7 +190,329 @@ func TestTrackWhenValid(t *testing.T) {
 	}
 }
 
+func TestTrackWhenQueued(t *testing.T) {
+	expectedStatusCode := 202
+	expectedBody := `{"message":"Queued event for integrations.","destinations":[{"integration":"test-only-integration-called","status":"queued"}]}`
+
+	requestBody := `{
+		"name":"something.created",
+		"userID":"123",
+		"properties": { "someCounter": 97 },
+		"timestamp": 12345678
+	}`
+	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Queue, err = queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Queue.Close()
+		Queue = nil
+	}()
+
+	integration := &CalledIntegration{t: t}
+	integrations.RegisterIntegration("test-only-integration-called", integration)
+	defer integrations.RemoveIntegration("test-only-integration-called")
+
+	Track(w, r)
+
+	if integration.Tracked {
+		t.Error("Track should not be called during the request when queueing")
+	}
+
+	if Queue.Len() != 1 {
+		t.Errorf("Expecting the event to be queued, queue length is %v", Queue.Len())
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
 // FailingIntegrationTrack is an integration that fails when called
+func TestTrackContextFromRequest(t *testing.T) {
+	requestBody := `{
+		"name":"something.created",
+		"userID":"123",
+		"context": { "locale": "fr-CA", "campaign": { "name": "launch" } },
+		"timestamp": 12345678
+	}`
+	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "1.2.3.4:5678"
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	w := httptest.NewRecorder()
+
+	integration := &SegmentIntegration{}
+	integrations.RegisterIntegration("test-only-integration-segment", integration)
+	defer integrations.RemoveIntegration("test-only-integration-segment")
+
+	Track(w, r)
+
+	context := integration.Tracked.Context
+	if context == nil {
+		t.Fatal("Expected the event to have a context")
+	}
+	if context.IP != "1.2.3.4" || context.UserAgent != "Mozilla/5.0" {
+		t.Errorf("Expected the IP and user agent of the request, got %#v", context)
+	}
+	if context.Locale != "fr-CA" || context.Campaign == nil || context.Campaign.Name != "launch" {
+		t.Errorf("Expected the context sent by the client to be kept, got %#v", context)
+	}
+}
+
+func TestTrackIPBehindTrustedProxies(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	TrustedProxies = []*net.IPNet{proxies}
+	defer func() { TrustedProxies = nil }()
+
+	integration := &SegmentIntegration{}
+	integrations.RegisterIntegration("test-only-integration-segment", integration)
+	defer integrations.RemoveIntegration("test-only-integration-segment")
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"1.2.3.4:5678", "6.6.6.6", "1.2.3.4"},
+		{"10.0.0.1:5678", "", "10.0.0.1"},
+		{"10.0.0.1:5678", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:5678", "6.6.6.6, 5.6.7.8, 10.0.0.2", "5.6.7.8"},
+	}
+	for _, c := range cases {
+		requestBody := `{"name":"something.created","userID":"123","timestamp":12345678}`
+		r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+
+		Track(httptest.NewRecorder(), r)
+
+		if context := integration.Tracked.Context; context == nil || context.IP != c.expected {
+			t.Errorf("Expected the IP %s from %s forwarding %q, got %#v", c.expected, c.remoteAddr, c.forwarded, context)
+		}
+	}
+}
+
+func TestTrackWhenDuplicate(t *testing.T) {
+	Dedup = dedup.New(10, time.Hour)
+	defer func() { Dedup = nil }()
+
+	integration := &CountingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-counting", integration)
+	defer integrations.RemoveIntegration("test-only-integration-counting")
+
+	requestBody := `{
+		"name":"something.created",
+		"userID":"123",
+		"messageID":"abc-123",
+		"timestamp": 12345678
+	}`
+	expectedBodies := []string{
+		`{"message":"Forwarding event to integrations.","destinations":[{"integration":"test-only-integration-counting","status":"accepted","attempts":1}]}`,
+		`{"message": "Ignoring duplicate event."}`,
+	}
+	for _, expectedBody := range expectedBodies {
+		r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		Track(w, r)
+
+		if w.Code != 200 {
+			t.Errorf("Wrong status code. Expecting 200 but got %v", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), expectedBody) {
+			t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+		}
+	}
+
+	if integration.Calls != 1 {
+		t.Errorf("Expected the event to be forwarded once, got %v", integration.Calls)
+	}
+}
+
+func TestTrackSameIDFromAnotherSource(t *testing.T) {
+	Dedup = dedup.New(10, time.Hour)
+	defer func() { Dedup = nil }()
+
+	integration := &CountingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-counting", integration)
+	defer integrations.RemoveIntegration("test-only-integration-counting")
+
+	requestBody := `{"name":"something.created","userID":"123","messageID":"abc-123","timestamp":12345678}`
+	for _, source := range []string{"web", "jobs"} {
+		r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		Track(w, withSource(r, &sources.Source{Name: source}, "test"))
+
+		if strings.Contains(w.Body.String(), "duplicate") {
+			t.Errorf("The message from %s should not be a duplicate, got %s", source, w.Body.String())
+		}
+	}
+
+	if integration.Calls != 2 {
+		t.Errorf("Expected the event to be forwarded for each source, got %v", integration.Calls)
+	}
+}
+
+func TestTrackWhenIntegrationIsPaused(t *testing.T) {
+	integration := &RateLimitedIntegration{}
+	integrations.RegisterIntegration("test-only-integration-rate-limited", integration)
+	defer integrations.RemoveIntegration("test-only-integration-rate-limited")
+	defer delivery.Reset()
+
+	requestBody := `{"name":"something.created","userID":"123","timestamp":12345678}`
+	// The first call pauses the integration for an hour, the second one
+	// happens during the pause
+	for i := 0; i < 2; i++ {
+		r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+
+		start := time.Now()
+		Track(w, r)
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the response without waiting for the pause, took %v", elapsed)
+		}
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"rate_limited"`) {
+			t.Errorf("Expected the message to be reported as rate limited, got %v %s", w.Code, w.Body.String())
+		}
+	}
+	if integration.Calls != 1 {
+		t.Errorf("Expected the integration not to be called during the pause, got %d calls", integration.Calls)
+	}
+}
+
+func TestTrackRetryAfterAllIntegrationsFail(t *testing.T) {
+	Dedup = dedup.New(10, time.Hour)
+	defer func() { Dedup = nil }()
+
+	failingIntegration := FailingIntegrationTrack{}
+	integrations.RegisterIntegration("test-only-integration-failing", failingIntegration)
+	defer delivery.Reset()
+	requestBody := `{"name":"something.created","userID":"123","messageID":"abc-123","timestamp":12345678}`
+	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Track(httptest.NewRecorder(), r)
+	integrations.RemoveIntegration("test-only-integration-failing")
+
+	integration := &CountingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-counting", integration)
+	defer integrations.RemoveIntegration("test-only-integration-counting")
+	r, err = http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Track(httptest.NewRecorder(), r)
+
+	if integration.Calls != 1 {
+		t.Error("A message nothing received should be forwarded when sent again")
+	}
+}
+
+func TestTrackOnlyToTheIntegrationsOfTheSource(t *testing.T) {
+	sources.Configure([]*sources.Source{{Name: "web", Keys: []sources.Key{{ID: "web-1", Secret: "web-key"}}, Integrations: []string{"test-only-integration-web"}}})
+	defer sources.Configure(nil)
+	expectedStatusCode := 200
+	expectedBody := `{"message":"Forwarding event to integrations.","destinations":[{"integration":"test-only-integration-web","status":"accepted","attempts":1}]}`
+
+	requestBody := `{"name":"account.created","userID":"123","timestamp":12345678}`
+	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Add("Forwardlytics-Api-Key", "web-key")
+	w := httptest.NewRecorder()
+
+	web := &CountingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-web", web)
+	defer integrations.RemoveIntegration("test-only-integration-web")
+	mobile := &CountingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-mobile", mobile)
+	defer integrations.RemoveIntegration("test-only-integration-mobile")
+
+	AuthMiddleware(http.HandlerFunc(Track)).ServeHTTP(w, r)
+
+	if web.Calls != 1 || mobile.Calls != 0 {
+		t.Errorf("Expected only the integration of the source to be called, got %v and %v calls", web.Calls, mobile.Calls)
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestTrackWhenDroppedBySource(t *testing.T) {
+	rules := []sources.Rule{{Events: []string{"debug.ping"}, Drop: true}}
+	sources.Configure([]*sources.Source{{Name: "web", Keys: []sources.Key{{ID: "web-1", Secret: "web-key"}}, Rules: rules}})
+	defer sources.Configure(nil)
+	expectedStatusCode := 200
+	expectedBody := `{"message": "Dropped event, as the rules of the source say."}`
+
+	requestBody := `{"name":"debug.ping","userID":"123","timestamp":12345678}`
+	r, err := http.NewRequest("POST", "/track", strings.NewReader(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Add("Forwardlytics-Api-Key", "web-key")
+	w := httptest.NewRecorder()
+
+	integration := &CountingIntegration{}
+	integrations.RegisterIntegration("test-only-integration-counting", integration)
+	defer integrations.RemoveIntegration("test-only-integration-counting")
+
+	AuthMiddleware(http.HandlerFunc(Track)).ServeHTTP(w, r)
+
+	if integration.Calls != 0 {
+		t.Errorf("Dropped messages should not be forwarded, got %v calls", integration.Calls)
+	}
+
+	if w.Code != expectedStatusCode {
+		t.Errorf("Wrong status code. Expecting %v but got %v", expectedStatusCode, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), expectedBody) {
+		t.Errorf(`Wrong response. Expecting "%s" but got "%s"`, expectedBody, w.Body.String())
+	}
+}
+
 type FailingIntegrationTrack struct {
 	FakeIntegration
 }
@@ -161,6 +527,16 @@ func (FailingIntegrationTrack) Enabled() bool {
 	return true
 }
 
+// DisabledIntegration is an integration that is not configured
+type DisabledIntegration struct {
+	FakeIntegration
+}
+
+// Enabled returns false, so the integration is skipped
+func (DisabledIntegration) Enabled() bool {
+	return false
+}
+
 type CalledIntegration struct {
 	FakeIntegration
 	Tracked bool
@@ -181,3 +557,28 @@ func (i *CalledIntegration) Track(event integrations.Event) error {
 func (i CalledIntegration) Enabled() bool {
 	return true
 }
+
+// CountingIntegration counts the events it receives
+type CountingIntegration struct {
+	FakeIntegration
+	Calls int
+}
+
+func (i *CountingIntegration) Track(event integrations.Event) error {
+	i.Calls++
+	return nil
+}
+
+func (i *CountingIntegration) Enabled() bool {
+	return true
+}
+
+// RateLimitedIntegration asks to wait an hour before calling it again
+type RateLimitedIntegration struct {
+	CountingIntegration
+}
+
+func (i *RateLimitedIntegration) Track(event integrations.Event) error {
+	i.Calls++
+	return integrations.RateLimited(errors.New("too many requests"), time.Hour)
+}
@@ -3,9 +3,9 @@ package drift
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jipiboily/forwardlytics/integrations"
@@ -13,7 +13,9 @@ import (
 
 // Drift integration
 type Drift struct {
-	api service
+	// name of the instance, drift when empty
+	name string
+	api  service
 }
 
 type service interface {
@@ -25,37 +27,47 @@ type driftAPIProduction struct {
 }
 
 type apiSubscriber struct {
-	Attributes map[string]interface{} `json:"attributes"`
-	CreatedAt  int64                  `json:"createdAt"`
-	UserId     string                 `json:"userId"`
-	OrgId      string                 `json:"orgId"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	CreatedAt   int64                  `json:"createdAt"`
+	UserId      string                 `json:"userId,omitempty"`
+	AnonymousId string                 `json:"anonymousId,omitempty"`
+	OrgId       string                 `json:"orgId"`
 }
 
 type apiEvent struct {
-	OrgId      string                 `json:"orgId"`
-	UserId     string                 `json:"userId"`
-	Event      string                 `json:"event"`
-	CreatedAt  int64                  `json:"createdAt"`
-	Attributes map[string]interface{} `json:"attributes"`
+	OrgId       string                 `json:"orgId"`
+	UserId      string                 `json:"userId,omitempty"`
+	AnonymousId string                 `json:"anonymousId,omitempty"`
+	Event       string                 `json:"event"`
+	CreatedAt   int64                  `json:"createdAt"`
+	Attributes  map[string]interface{} `json:"attributes"`
 }
 
 type apiPage struct {
-	OrgId      string                 `json:"orgId"`
-	UserId     string                 `json:"userId"`
-	Event      string                 `json:"event"`
-	Url        string                 `json:"url"`
-	CreatedAt  int64                  `json:"createdAt"`
-	Attributes map[string]interface{} `json:"attributes"`
+	OrgId       string                 `json:"orgId"`
+	UserId      string                 `json:"userId,omitempty"`
+	AnonymousId string                 `json:"anonymousId,omitempty"`
+	Event       string                 `json:"event"`
+	Url         string                 `json:"url"`
+	CreatedAt   int64                  `json:"createdAt"`
+	Attributes  map[string]interface{} `json:"attributes"`
 }
 
 // Identify forwards and identify call to Drift
 func (d Drift) Identify(identification integrations.Identification) (err error) {
 	s := apiSubscriber{}
 	s.UserId = string(identification.UserID)
+	// Drift keeps anonymous visitors apart until they're identified
+	if s.UserId == "" {
+		s.AnonymousId = identification.AnonymousID
+	}
 	s.CreatedAt = identification.Timestamp
-	s.OrgId = orgID()
+	s.OrgId = orgID(d.name)
 	// Add custom attributes
 	s.Attributes = identification.UserTraits
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]interface{})
+	}
 	s.Attributes["forwardlyticsReceivedAt"] = identification.ReceivedAt
 	s.Attributes["forwardlyticsTimestamp"] = identification.Timestamp
 	payload, err := json.Marshal(s)
@@ -70,10 +82,16 @@ func (d Drift) Identify(identification integrations.Identification) (err error)
 // Track forwards the event to Drift
 func (d Drift) Track(event integrations.Event) (err error) {
 	e := apiEvent{}
-	e.OrgId = orgID()
+	e.OrgId = orgID(d.name)
 	e.UserId = event.UserID
+	if e.UserId == "" {
+		e.AnonymousId = event.AnonymousID
+	}
 	e.Attributes = event.Properties
-	event.Properties["forwardlyticsReceivedAt"] = event.ReceivedAt
+	if e.Attributes == nil {
+		e.Attributes = make(map[string]interface{})
+	}
+	e.Attributes["forwardlyticsReceivedAt"] = event.ReceivedAt
 	e.Event = event.Name
 	e.CreatedAt = event.Timestamp
 	payload, err := json.Marshal(e)
@@ -90,12 +108,18 @@ func (d Drift) Track(event integrations.Event) (err error) {
 // Page forwards the page-events to Drift
 func (d Drift) Page(page integrations.Page) (err error) {
 	p := apiPage{}
-	p.OrgId = orgID()
+	p.OrgId = orgID(d.name)
 	p.UserId = page.UserID
+	if p.UserId == "" {
+		p.AnonymousId = page.AnonymousID
+	}
 	p.Url = page.Url
-	page.Properties["forwardlyticsReceivedAt"] = page.ReceivedAt
-	page.Properties["name"] = page.Name
 	p.Attributes = page.Properties
+	if p.Attributes == nil {
+		p.Attributes = make(map[string]interface{})
+	}
+	p.Attributes["forwardlyticsReceivedAt"] = page.ReceivedAt
+	p.Attributes["name"] = page.Name
 	p.Event = "page"
 	p.CreatedAt = page.Timestamp
 	payload, err := json.Marshal(p)
@@ -110,8 +134,8 @@ func (d Drift) Page(page integrations.Page) (err error) {
 }
 
 // Enabled returns wether or not the Drift integration is enabled/configured
-func (Drift) Enabled() bool {
-	return orgID() != ""
+func (d Drift) Enabled() bool {
+	return orgID(d.name) != ""
 }
 
 func (api driftAPIProduction) request(method string, endpoint string, payload []byte) (err error) {
@@ -152,17 +176,29 @@ func (api driftAPIProduction) request(method string, endpoint string, payload []
 				"method":      method,
 				"endpoint":    endpoint,
 				"payload":     string(payload[:])}).Error("Drift api returned errors")
-
+		return integrations.StatusError(resp.StatusCode, resp.Header, fmt.Errorf("Drift API returned HTTP status %d: %s", resp.StatusCode, body))
 	}
 	return
 }
 
-func orgID() string {
-	return os.Getenv("DRIFT_ORG_ID")
+func orgID(name string) string {
+	if name == "" {
+		name = "drift"
+	}
+	return integrations.GetSetting(name, "orgID")
+}
+
+// New returns the Drift instance with that name
+func New(name string) integrations.Integration {
+	return Drift{
+		name: name,
+		api:  &driftAPIProduction{baseUrl: "https://event.api.drift.com/"},
+	}
 }
 
 func init() {
-	drift := Drift{}
-	drift.api = &driftAPIProduction{baseUrl: "https://event.api.drift.com/"}
-	integrations.RegisterIntegration("drift", drift)
+	integrations.RegisterSettings("drift", []integrations.Setting{
+		{Name: "orgID", Env: "DRIFT_ORG_ID", Required: true},
+	})
+	integrations.RegisterFactory("drift", New)
 }
@@ -1,8 +1,11 @@
 package drift
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/jipiboily/forwardlytics/integrations"
 )
@@ -55,6 +58,28 @@ func TestIdentify(t *testing.T) {
 	}
 }
 
+func TestIdentifyAnonymous(t *testing.T) {
+	os.Setenv("DRIFT_ORG_ID", "123")
+	drift := Drift{}
+	api := APIMock{baseUrl: "http://www.example.com"}
+	drift.api = &api
+	identification := integrations.Identification{
+		AnonymousID: "anonymous-456",
+		UserTraits:  map[string]interface{}{},
+		Timestamp:   1234567,
+		ReceivedAt:  8765432,
+	}
+	err := drift.Identify(identification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPayload := `{"attributes":{"forwardlyticsReceivedAt":8765432,"forwardlyticsTimestamp":1234567},"createdAt":1234567,"anonymousId":"anonymous-456","orgId":"123"}`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+string(expectedPayload)+" got: %s", api.Payload)
+	}
+}
+
 func TestTrack(t *testing.T) {
 	os.Setenv("DRIFT_ORG_ID", "321")
 	drift := Drift{}
@@ -124,6 +149,37 @@ func TestPage(t *testing.T) {
 	}
 }
 
+func TestWithoutTraitsOrProperties(t *testing.T) {
+	os.Setenv("DRIFT_ORG_ID", "321")
+	drift := Drift{}
+	api := APIMock{baseUrl: "http://www.example.com/"}
+	drift.api = &api
+
+	if err := drift.Identify(integrations.Identification{UserID: "123", Timestamp: 1234567, ReceivedAt: 65}); err != nil {
+		t.Fatal(err)
+	}
+	expectedPayload := `{"attributes":{"forwardlyticsReceivedAt":65,"forwardlyticsTimestamp":1234567},"createdAt":1234567,"userId":"123","orgId":"321"}`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+expectedPayload+" got: %s", api.Payload)
+	}
+
+	if err := drift.Track(integrations.Event{Name: "account.created", UserID: "123", Timestamp: 1234567, ReceivedAt: 65}); err != nil {
+		t.Fatal(err)
+	}
+	expectedPayload = `{"orgId":"321","userId":"123","event":"account.created","createdAt":1234567,"attributes":{"forwardlyticsReceivedAt":65}}`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+expectedPayload+" got: %s", api.Payload)
+	}
+
+	if err := drift.Page(integrations.Page{Name: "Homepage", UserID: "123", Url: "http://www.example.com", Timestamp: 1234567, ReceivedAt: 65}); err != nil {
+		t.Fatal(err)
+	}
+	expectedPayload = `{"orgId":"321","userId":"123","event":"page","url":"http://www.example.com","createdAt":1234567,"attributes":{"forwardlyticsReceivedAt":65,"name":"Homepage"}}`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+expectedPayload+" got: %s", api.Payload)
+	}
+}
+
 type MockEvents struct {
 	Events []MockEvent `json:"events"`
 }
@@ -153,3 +209,21 @@ func (api *APIMock) request(method string, endpoint string, payload []byte) erro
 	api.Payload = payload
 	return nil
 }
+
+func TestRequestClassifiesErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	api := driftAPIProduction{baseUrl: server.URL + "/"}
+
+	err := api.request("POST", "track", []byte("{}"))
+
+	if kind := integrations.Kind(err); err == nil || kind != integrations.ErrorRateLimited {
+		t.Fatalf("Expected the call to be rate limited, got %v (%s)", err, kind)
+	}
+	if retryAfter := integrations.RetryAfter(err); retryAfter != 10*time.Second {
+		t.Errorf("Expected to retry after 10s, got %v", retryAfter)
+	}
+}
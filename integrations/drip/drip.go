@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -16,7 +15,9 @@ import (
 
 // Drip integration
 type Drip struct {
-	api service
+	// name of the instance, drip when empty
+	name string
+	api  service
 }
 
 type service interface {
@@ -24,7 +25,8 @@ type service interface {
 }
 
 type dripAPIProduction struct {
-	Url string
+	name    string
+	baseUrl string
 }
 
 type apiSubscriber struct {
@@ -50,13 +52,18 @@ type dripAPIResult struct {
 	Errors []dripAPIError `json:"errors"`
 }
 
-// Identify forwards and identify call to Drip
+// Identify forwards and identify call to Drip. Drip finds subscribers by
+// email, so anonymous visitors are only sent once their email is known.
 func (d Drip) Identify(identification integrations.Identification) (err error) {
 	s := apiSubscriber{}
 	// Drip needs an email to identify the user
+	if identification.UserTraits["email"] == nil && identification.UserID == "" {
+		logrus.WithField("identification", identification).Info("Drip: Skipping anonymous identify without email")
+		return integrations.ErrUnsupported
+	}
 	if identification.UserTraits["email"] == nil {
 		logrus.WithField("identification", identification).Error("Drip: Required field email is not present")
-		return errors.New("Email is required for doing a drip request")
+		return integrations.Permanent(errors.New("Email is required for doing a drip request"))
 	} else {
 		s.Email = identification.UserTraits["email"].(string)
 	}
@@ -75,9 +82,13 @@ func (d Drip) Identify(identification integrations.Identification) (err error) {
 
 // Track forwards the event to Drip
 func (d Drip) Track(event integrations.Event) (err error) {
+	if event.Properties["email"] == nil && event.UserID == "" {
+		logrus.WithField("event", event).Info("Drip: Skipping anonymous event without email")
+		return integrations.ErrUnsupported
+	}
 	if event.Properties["email"] == nil {
 		logrus.WithError(err).WithField("event", event).Error("Drip: Required field email is not present")
-		return errors.New("Email is required for doing a drip request")
+		return integrations.Permanent(errors.New("Email is required for doing a drip request"))
 	}
 	e := apiEvent{}
 	e.Email = event.Properties["email"].(string)
@@ -96,9 +107,13 @@ func (d Drip) Track(event integrations.Event) (err error) {
 // Page forwards the page-events to Drip
 // In the drip integration, page-views are just special case events
 func (d Drip) Page(page integrations.Page) (err error) {
+	if page.Properties["email"] == nil && page.UserID == "" {
+		logrus.WithField("page", page).Info("Drip: Skipping anonymous page-event without email")
+		return integrations.ErrUnsupported
+	}
 	if page.Properties["email"] == nil {
 		logrus.WithError(err).WithField("page", page).Error("Drip: Required field email is not present")
-		return errors.New("Email is required for doing a drip request")
+		return integrations.Permanent(errors.New("Email is required for doing a drip request"))
 	}
 	e := apiEvent{}
 	e.Email = page.Properties["email"].(string)
@@ -119,15 +134,39 @@ func (d Drip) Page(page integrations.Page) (err error) {
 	return
 }
 
+// Alias sets the user ID of the Drip subscriber. Drip finds subscribers by
+// email, so it needs to be part of the user traits.
+func (d Drip) Alias(alias integrations.Alias) (err error) {
+	if alias.UserTraits["email"] == nil {
+		logrus.WithField("alias", alias).Error("Drip: Required field email is not present")
+		return integrations.Permanent(errors.New("Email is required for doing a drip request"))
+	}
+	s := apiSubscriber{}
+	s.Email = alias.UserTraits["email"].(string)
+	s.UserId = alias.UserID
+	s.CustomFields = map[string]interface{}{
+		"forwardlyticsPreviousID": alias.PreviousID,
+		"forwardlyticsReceivedAt": alias.ReceivedAt,
+	}
+
+	payload, err := json.Marshal(map[string][]apiSubscriber{"subscribers": []apiSubscriber{s}})
+	if err != nil {
+		logrus.WithField("err", err).Error("Error marshalling drip alias to json")
+		return
+	}
+	err = d.api.request("POST", "subscribers", payload)
+	return
+}
+
 // Enabled returns wether or not the Drip integration is enabled/configured
-func (Drip) Enabled() bool {
-	return apiToken() != "" && accountID() != ""
+func (d Drip) Enabled() bool {
+	return apiToken(d.name) != "" && accountID(d.name) != ""
 }
 
 func (api dripAPIProduction) request(method string, endpoint string, payload []byte) (err error) {
-	apiUrl := api.Url + endpoint
+	apiUrl := api.baseUrl + accountID(api.name) + "/" + endpoint
 	req, err := http.NewRequest(method, apiUrl, bytes.NewBuffer(payload))
-	req.SetBasicAuth(apiToken(), "")
+	req.SetBasicAuth(apiToken(api.name), "")
 	req.Header.Add("User-Agent", "forwardlytics")
 	req.Header.Set("Content-Type", "application/vnd.api+json")
 	client := &http.Client{}
@@ -149,32 +188,61 @@ func (api dripAPIProduction) request(method string, endpoint string, payload []b
 		var apiResult dripAPIResult
 		json.Unmarshal(body, &apiResult)
 
-		errorDetails := fmt.Sprintf("[%s] %s (on attribute: %s)", apiResult.Errors[0].Code, apiResult.Errors[0].Message, apiResult.Errors[0].Attribute)
-		errorMessage := "Drip API returned errors: " + errorDetails
+		errorMessage := fmt.Sprintf("Drip API returned HTTP status %d", resp.StatusCode)
+		if len(apiResult.Errors) != 0 {
+			errorDetails := fmt.Sprintf("[%s] %s (on attribute: %s)", apiResult.Errors[0].Code, apiResult.Errors[0].Message, apiResult.Errors[0].Attribute)
+			errorMessage = "Drip API returned errors: " + errorDetails
+		}
 
 		logrus.WithField("method", method).WithField("endpoint", endpoint).WithField("payload", string(payload[:])).WithFields(
 			logrus.Fields{
 				"response":    string(body),
 				"HTTP-status": resp.StatusCode}).Error(errorMessage)
-		return errors.New(errorMessage)
+		return dripError(resp, apiResult, errors.New(errorMessage))
 	}
 	return
 }
 
-func apiUrl() string {
-	return "https://api.getdrip.com/v2/" + accountID() + "/"
+// dripError classifies the error Drip returned, by its code for the
+// authentication errors and by the HTTP status otherwise
+func dripError(resp *http.Response, apiResult dripAPIResult, err error) error {
+	for _, apiError := range apiResult.Errors {
+		switch apiError.Code {
+		case "authentication_error", "authorization_error":
+			return integrations.AuthFailure(err)
+		}
+	}
+	return integrations.StatusError(resp.StatusCode, resp.Header, err)
+}
+
+func apiToken(name string) string {
+	return setting(name, "apiToken")
+}
+
+func accountID(name string) string {
+	return setting(name, "accountID")
 }
 
-func apiToken() string {
-	return os.Getenv("DRIP_API_TOKEN")
+// setting reads the setting of the Drip instance with that name
+func setting(name string, key string) string {
+	if name == "" {
+		name = "drip"
+	}
+	return integrations.GetSetting(name, key)
 }
 
-func accountID() string {
-	return os.Getenv("DRIP_ACCOUNT_ID")
+// New returns the Drip instance with that name
+func New(name string) integrations.Integration {
+	return Drip{
+		name: name,
+		api:  &dripAPIProduction{name: name, baseUrl: "https://api.getdrip.com/v2/"},
+	}
 }
 
 func init() {
-	drip := Drip{}
-	drip.api = &dripAPIProduction{Url: apiUrl()}
-	integrations.RegisterIntegration("drip", drip)
+	integrations.RegisterSettings("drip", []integrations.Setting{
+		{Name: "apiToken", Env: "DRIP_API_TOKEN", Required: true},
+		{Name: "accountID", Env: "DRIP_ACCOUNT_ID", Required: true},
+	})
+	integrations.RegisterFactory("drip", New)
 }
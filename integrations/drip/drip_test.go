@@ -2,7 +2,10 @@ package drip
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -21,6 +24,18 @@ func TestIdentifyErrorWhenNoEmail(t *testing.T) {
 	}
 }
 
+func TestIdentifyAnonymousWithoutEmailIsUnsupported(t *testing.T) {
+	drip := Drip{}
+	identification := integrations.Identification{
+		AnonymousID: "anonymous-456",
+		UserTraits:  map[string]interface{}{},
+	}
+	err := drip.Identify(identification)
+	if err != integrations.ErrUnsupported {
+		t.Errorf("Expected the anonymous identify to be unsupported, got %v", err)
+	}
+}
+
 func TestNotEnabledWhenMissingCredentials(t *testing.T) {
 	os.Setenv("DRIP_API_TOKEN", "")
 	os.Setenv("DRIP_ACCOUNT_ID", "")
@@ -219,6 +234,47 @@ func TestPage(t *testing.T) {
 	}
 }
 
+func TestAliasErrorWhenNoEmail(t *testing.T) {
+	drip := Drip{}
+	alias := integrations.Alias{
+		PreviousID: "anonymous-456",
+		UserID:     "123",
+	}
+	err := drip.Alias(alias)
+	if err == nil {
+		t.Error("Expected error when no email given")
+	}
+}
+
+func TestAlias(t *testing.T) {
+	drip := Drip{}
+	api := APIMock{Url: "http://www.example.com"}
+	drip.api = &api
+	alias := integrations.Alias{
+		PreviousID: "anonymous-456",
+		UserID:     "123",
+		UserTraits: map[string]interface{}{
+			"email": "john@example.com",
+		},
+		Timestamp:  1234567,
+		ReceivedAt: 65,
+	}
+
+	err := drip.Alias(alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if api.Endpoint != "subscribers" {
+		t.Errorf("Expected endpoint to be subscribers, was: %v", api.Endpoint)
+	}
+
+	expectedPayload := `{"subscribers":[{"custom_fields":{"forwardlyticsPreviousID":"anonymous-456","forwardlyticsReceivedAt":65},"email":"john@example.com","user_id":"123"}]}`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+expectedPayload+" got: %s", api.Payload)
+	}
+}
+
 type MockEvents struct {
 	Events []MockEvent `json:"events"`
 }
@@ -266,3 +322,56 @@ func (api *APIMock) request(method string, endpoint string, payload []byte) erro
 	api.Payload = payload
 	return nil
 }
+
+func TestInstancesUseTheirOwnAccount(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	integrations.Configure(map[string]map[string]string{
+		"drip-eu": {"type": "drip", "apiToken": "123", "accountID": "111"},
+		"drip-us": {"type": "drip", "apiToken": "456", "accountID": "222"},
+	})
+	defer integrations.Configure(nil)
+
+	for _, name := range []string{"drip-eu", "drip-us"} {
+		api := dripAPIProduction{name: name, baseUrl: server.URL + "/"}
+		if err := api.request("POST", "subscribers", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"/111/subscribers", "/222/subscribers"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected requests to %v, got %v", expected, paths)
+	}
+}
+
+func TestRequestClassifiesErrors(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		body       string
+		kind       integrations.ErrorKind
+	}{
+		{422, `{"errors":[{"code":"email_error","attribute":"email","message":"Email is invalid"}]}`, integrations.ErrorPermanent},
+		{401, `{"errors":[{"code":"authentication_error","message":"You are not authorized"}]}`, integrations.ErrorAuth},
+		{429, `{"errors":[{"code":"too_many_requests","message":"Slow down"}]}`, integrations.ErrorRateLimited},
+		{502, `<html>Bad gateway</html>`, integrations.ErrorRetryable},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.statusCode)
+			w.Write([]byte(test.body))
+		}))
+		api := dripAPIProduction{baseUrl: server.URL + "/"}
+
+		err := api.request("POST", "subscribers", []byte("{}"))
+		server.Close()
+
+		if kind := integrations.Kind(err); err == nil || kind != test.kind {
+			t.Errorf("Expected HTTP status %d to be %s, got %v (%s)", test.statusCode, test.kind, err, kind)
+		}
+	}
+}
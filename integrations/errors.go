@@ -0,0 +1,133 @@
+package integrations
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorKind tells how to handle a call an integration failed
+type ErrorKind string
+
+// Kinds of errors integrations return
+const (
+	// ErrorRetryable means the call can succeed later, like after a timeout
+	// or a server error
+	ErrorRetryable ErrorKind = "retryable"
+	// ErrorPermanent means the call will never succeed as is, like when the
+	// message is invalid for the integration
+	ErrorPermanent ErrorKind = "permanent"
+	// ErrorRateLimited means the integration got too many calls, the call
+	// can be made again after RetryAfter
+	ErrorRateLimited ErrorKind = "rate_limited"
+	// ErrorAuth means the integration refused its credentials, nothing goes
+	// through until its settings are fixed
+	ErrorAuth ErrorKind = "auth"
+)
+
+// Error is an error of an integration, classified so that the delivery knows
+// if calling again can help
+type Error struct {
+	Kind ErrorKind
+	Err  error
+
+	// RetryAfter is how long to wait before calling again, when the
+	// integration tells. Only for ErrorRateLimited.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Retryable returns the error as a retryable one
+func Retryable(err error) error {
+	return &Error{Kind: ErrorRetryable, Err: err}
+}
+
+// Permanent returns the error as a permanent one
+func Permanent(err error) error {
+	return &Error{Kind: ErrorPermanent, Err: err}
+}
+
+// RateLimited returns the error as a rate limited one, that can be retried
+// after retryAfter. Zero means the integration didn't tell.
+func RateLimited(err error, retryAfter time.Duration) error {
+	return &Error{Kind: ErrorRateLimited, Err: err, RetryAfter: retryAfter}
+}
+
+// AuthFailure returns the error as an authentication failure
+func AuthFailure(err error) error {
+	return &Error{Kind: ErrorAuth, Err: err}
+}
+
+// StatusError classifies the error of a call that got that HTTP status:
+//
+//	401, 403             ErrorAuth
+//	429                  ErrorRateLimited, after the Retry-After header
+//	408, 5xx             ErrorRetryable
+//	other 4xx            ErrorPermanent
+//
+// Other statuses are retryable.
+func StatusError(statusCode int, header http.Header, err error) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return AuthFailure(err)
+	case statusCode == http.StatusTooManyRequests:
+		return RateLimited(err, RetryAfterHeader(header, time.Now()))
+	case statusCode == http.StatusRequestTimeout || statusCode >= 500:
+		return Retryable(err)
+	case statusCode >= 400:
+		return Permanent(err)
+	}
+	return Retryable(err)
+}
+
+// RetryAfterHeader reads the Retry-After header, as seconds or as a date,
+// returning how long to wait from now. Without it, the X-RateLimit-Reset
+// header is read as the Unix time the limit resets at, like Intercom sends.
+// It's zero when both are missing or invalid.
+func RetryAfterHeader(header http.Header, now time.Time) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return rateLimitReset(header, now)
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// rateLimitReset reads the X-RateLimit-Reset header, returning how long until
+// that Unix time
+func rateLimitReset(header http.Header, now time.Time) time.Duration {
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	if at := time.Unix(reset, 0); at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// Kind returns the kind of the error. Errors that are not classified, like
+// network errors, are retryable.
+func Kind(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return ErrorRetryable
+}
+
+// RetryAfter returns how long to wait before calling again after a rate
+// limited error, zero when unknown
+func RetryAfter(err error) time.Duration {
+	if e, ok := err.(*Error); ok {
+		return e.RetryAfter
+	}
+	return 0
+}
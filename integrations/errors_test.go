@@ -0,0 +1,89 @@
+package integrations
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		kind       ErrorKind
+	}{
+		{http.StatusUnauthorized, ErrorAuth},
+		{http.StatusForbidden, ErrorAuth},
+		{http.StatusTooManyRequests, ErrorRateLimited},
+		{http.StatusRequestTimeout, ErrorRetryable},
+		{http.StatusInternalServerError, ErrorRetryable},
+		{http.StatusServiceUnavailable, ErrorRetryable},
+		{http.StatusBadRequest, ErrorPermanent},
+		{http.StatusUnprocessableEntity, ErrorPermanent},
+	}
+	for _, test := range tests {
+		err := StatusError(test.statusCode, nil, errors.New("failed"))
+		if kind := Kind(err); kind != test.kind {
+			t.Errorf("Expected HTTP status %d to be %s, got %s", test.statusCode, test.kind, kind)
+		}
+		if err.Error() != "failed" {
+			t.Errorf("Expected the message of the error to be kept, got %q", err.Error())
+		}
+	}
+
+	header := http.Header{"Retry-After": {"30"}}
+	if retryAfter := RetryAfter(StatusError(http.StatusTooManyRequests, header, errors.New("slow down"))); retryAfter != 30*time.Second {
+		t.Errorf("Expected to retry after 30s, got %v", retryAfter)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	now := time.Date(2016, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"Fri, 01 Apr 2016 12:01:00 GMT", time.Minute},
+		{"Fri, 01 Apr 2016 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.value != "" {
+			header.Set("Retry-After", test.value)
+		}
+		if retryAfter := RetryAfterHeader(header, now); retryAfter != test.expected {
+			t.Errorf("Expected %q to wait %v, got %v", test.value, test.expected, retryAfter)
+		}
+	}
+}
+
+func TestRateLimitResetHeader(t *testing.T) {
+	now := time.Date(2016, 4, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"1459512030", 30 * time.Second},
+		{"1459511940", 0},
+		{"soon", 0},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.value != "" {
+			header.Set("X-RateLimit-Reset", test.value)
+		}
+		if retryAfter := RetryAfterHeader(header, now); retryAfter != test.expected {
+			t.Errorf("Expected a reset at %q to wait %v, got %v", test.value, test.expected, retryAfter)
+		}
+	}
+}
+
+func TestKindOfUnclassifiedErrors(t *testing.T) {
+	if kind := Kind(errors.New("connection reset")); kind != ErrorRetryable {
+		t.Errorf("Expected unclassified errors to be retryable, got %s", kind)
+	}
+}
@@ -1,8 +1,8 @@
 package integrations
 
 // Integration defines what an integration is made of.
-// Each integrations is responsible to register it self to the registry (see
-// RegisterIntegration for details).
+// Each integrations is responsible to register a factory creating it to the
+// registry (see RegisterFactory for details).
 type Integration interface {
 	// Identify is responsible of forwarding the identify call to the integration
 	Identify(identification Identification) error
@@ -17,15 +17,96 @@ type Integration interface {
 	Enabled() bool
 }
 
+// AliasIntegration is implemented by the integrations able to merge two user
+// IDs. The others are reported as not supporting aliases.
+type AliasIntegration interface {
+	// Alias tells the integration that both IDs are the same user
+	Alias(alias Alias) error
+}
+
+// GroupIntegration is implemented by the integrations able to attach users to
+// a group, like a company or an account. The others are reported as not
+// supporting groups.
+type GroupIntegration interface {
+	// Group attaches the user to the group and updates its traits
+	Group(group Group) error
+}
+
+// Context holds what is known about where a message comes from. Fields are
+// optional, IP and UserAgent default to the ones of the HTTP request.
+type Context struct {
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Locale    string    `json:"locale,omitempty"`
+	Library   *Library  `json:"library,omitempty"`
+	Campaign  *Campaign `json:"campaign,omitempty"`
+	App       *App      `json:"app,omitempty"`
+}
+
+// Library is the client library that sent the message
+type Library struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Campaign holds the UTM parameters the user came from
+type Campaign struct {
+	Name    string `json:"name,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Medium  string `json:"medium,omitempty"`
+	Term    string `json:"term,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// App is the application that sent the message, for mobile apps mostly
+type App struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Build   string `json:"build,omitempty"`
+}
+
+// Copy returns a copy of the context that shares no data with the original
+func (c *Context) Copy() *Context {
+	if c == nil {
+		return nil
+	}
+	copied := *c
+	if c.Library != nil {
+		library := *c.Library
+		copied.Library = &library
+	}
+	if c.Campaign != nil {
+		campaign := *c.Campaign
+		copied.Campaign = &campaign
+	}
+	if c.App != nil {
+		app := *c.App
+		copied.App = &app
+	}
+	return &copied
+}
+
 // Identification defines the structure of the data we receive from the API
 type Identification struct {
 	// Unique user ID. Should not change, ever.
 	UserID string `json:"userID"`
 
+	// Anonymous ID of a visitor who is not known yet, used when there is no
+	// UserID. Integrations map it to their own anonymous visitors or leads, or
+	// report it as unsupported.
+	AnonymousID string `json:"anonymousID"`
+
 	// Set of custom traits sent to the integrations. Some might be required, on
 	// a per integration basis.
 	UserTraits map[string]interface{} `json:"userTraits"`
 
+	// Context of the message, like the device or campaign it comes from
+	Context *Context `json:"context,omitempty"`
+
+	// Optional unique ID of the message, generated when missing. Messages
+	// sent again with the same ID are ignored.
+	MessageID string `json:"messageID"`
+
 	// Timestamp of when the identifiaction originally triggered
 	Timestamp int64 `json:"timestamp"`
 
@@ -35,8 +116,8 @@ type Identification struct {
 
 // Validate the content of the identifiaction to be sure it has everything that's needed
 func (i Identification) Validate() (missingParameters []string) {
-	if i.UserID == "" {
-		missingParameters = append(missingParameters, "userID")
+	if i.UserID == "" && i.AnonymousID == "" {
+		missingParameters = append(missingParameters, "userID or anonymousID")
 	}
 
 	if i.Timestamp == 0 {
@@ -53,9 +134,21 @@ type Event struct {
 	// Unique user ID. Should not change, ever.
 	UserID string `json:"userID"`
 
+	// Anonymous ID of a visitor who is not known yet, used when there is no
+	// UserID. Integrations map it to their own anonymous visitors or leads, or
+	// report it as unsupported.
+	AnonymousID string `json:"anonymousID"`
+
 	// Properties are custom variables you can send with the event
 	Properties map[string]interface{} `json:"properties"`
 
+	// Context of the message, like the device or campaign it comes from
+	Context *Context `json:"context,omitempty"`
+
+	// Optional unique ID of the message, generated when missing. Messages
+	// sent again with the same ID are ignored.
+	MessageID string `json:"messageID"`
+
 	// Timestamp of when the identifiaction originally triggered
 	Timestamp int64 `json:"timestamp"`
 
@@ -69,8 +162,8 @@ func (e Event) Validate() (missingParameters []string) {
 		missingParameters = append(missingParameters, "name")
 	}
 
-	if e.UserID == "" {
-		missingParameters = append(missingParameters, "userID")
+	if e.UserID == "" && e.AnonymousID == "" {
+		missingParameters = append(missingParameters, "userID or anonymousID")
 	}
 
 	if e.Timestamp == 0 {
@@ -87,12 +180,24 @@ type Page struct {
 	// Unique user ID. Should not change, ever.
 	UserID string `json:"userID"`
 
+	// Anonymous ID of a visitor who is not known yet, used when there is no
+	// UserID. Integrations map it to their own anonymous visitors or leads, or
+	// report it as unsupported.
+	AnonymousID string `json:"anonymousID"`
+
 	// Unique user ID. Should not change, ever.
 	Url string `json:"url"`
 
 	// Properties are custom variables you can send with the page
 	Properties map[string]interface{} `json:"properties"`
 
+	// Context of the message, like the device or campaign it comes from
+	Context *Context `json:"context,omitempty"`
+
+	// Optional unique ID of the message, generated when missing. Messages
+	// sent again with the same ID are ignored.
+	MessageID string `json:"messageID"`
+
 	// Timestamp of when the page-call originally triggered
 	Timestamp int64 `json:"timestamp"`
 
@@ -110,8 +215,8 @@ func (p Page) Validate() (missingParameters []string) {
 		missingParameters = append(missingParameters, "url")
 	}
 
-	if p.UserID == "" {
-		missingParameters = append(missingParameters, "userID")
+	if p.UserID == "" && p.AnonymousID == "" {
+		missingParameters = append(missingParameters, "userID or anonymousID")
 	}
 
 	if p.Timestamp == 0 {
@@ -119,3 +224,87 @@ func (p Page) Validate() (missingParameters []string) {
 	}
 	return
 }
+
+// Alias defines the structure for the incoming alias data, used when a user
+// known by a previous ID, usually anonymous, gets a new ID (e.g. on signup).
+type Alias struct {
+	// PreviousID is the ID the user was known by until now
+	PreviousID string `json:"previousID"`
+
+	// Unique user ID. Should not change, ever.
+	UserID string `json:"userID"`
+
+	// Traits known about the user. Some integrations need them to find the
+	// user (e.g. the email for Drip).
+	UserTraits map[string]interface{} `json:"userTraits"`
+
+	// Optional unique ID of the message, generated when missing. Messages
+	// sent again with the same ID are ignored.
+	MessageID string `json:"messageID"`
+
+	// Timestamp of when the alias originally triggered
+	Timestamp int64 `json:"timestamp"`
+
+	// ReceivedAt of when Forwardlytics received the alias.
+	ReceivedAt int64 `json:"receivedAt"`
+}
+
+// Validate the content of the alias to be sure it has everything that's needed
+func (a Alias) Validate() (missingParameters []string) {
+	if a.PreviousID == "" {
+		missingParameters = append(missingParameters, "previousID")
+	}
+
+	if a.UserID == "" {
+		missingParameters = append(missingParameters, "userID")
+	}
+
+	if a.Timestamp == 0 {
+		missingParameters = append(missingParameters, "timestamp")
+	}
+	return
+}
+
+// Group defines the structure for the incoming group data, attaching a user to
+// a company or an account.
+type Group struct {
+	// Unique group ID. Should not change, ever.
+	GroupID string `json:"groupID"`
+
+	// Set of custom traits of the group (e.g. its name or plan).
+	Traits map[string]interface{} `json:"traits"`
+
+	// Unique user ID of the member of the group.
+	UserID string `json:"userID"`
+
+	// Anonymous ID of a visitor who is not known yet, used when there is no
+	// UserID. Integrations map it to their own anonymous visitors or leads, or
+	// report it as unsupported.
+	AnonymousID string `json:"anonymousID"`
+
+	// Optional unique ID of the message, generated when missing. Messages
+	// sent again with the same ID are ignored.
+	MessageID string `json:"messageID"`
+
+	// Timestamp of when the group-call originally triggered
+	Timestamp int64 `json:"timestamp"`
+
+	// ReceivedAt of when Forwardlytics received the group-call.
+	ReceivedAt int64 `json:"receivedAt"`
+}
+
+// Validate the content of the group to be sure it has everything that's needed
+func (g Group) Validate() (missingParameters []string) {
+	if g.GroupID == "" {
+		missingParameters = append(missingParameters, "groupID")
+	}
+
+	if g.UserID == "" && g.AnonymousID == "" {
+		missingParameters = append(missingParameters, "userID or anonymousID")
+	}
+
+	if g.Timestamp == 0 {
+		missingParameters = append(missingParameters, "timestamp")
+	}
+	return
+}
@@ -1,24 +1,36 @@
 package intercom
 
 import (
-	"os"
+	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jipiboily/forwardlytics/integrations"
 	intercom "gopkg.in/intercom/intercom-go.v2"
+	intercomInterfaces "gopkg.in/intercom/intercom-go.v2/interfaces"
 )
 
 // Intercom integration
 type Intercom struct {
-	*intercom.Client
+	// name of the instance, intercom when empty
+	name string
+
 	Service
 	EventRepository
+	LeadRepository
+	CompanyRepository
 }
 
-// Identify forwards and identify call to Intercom
+// Identify forwards and identify call to Intercom. Anonymous visitors are
+// saved as leads.
 func (i Intercom) Identify(identification integrations.Identification) (err error) {
+	if identification.UserID == "" {
+		return i.identifyLead(identification)
+	}
+
 	icUser, err := i.Service.FindByUserID(identification.UserID)
 	if err != nil {
 		if strings.Contains(err.Error(), "not_found") {
@@ -45,6 +57,11 @@ func (i Intercom) Identify(identification integrations.Identification) (err erro
 		icUser.Name = identification.UserTraits["name"].(string)
 	}
 
+	if identification.Context != nil {
+		icUser.LastSeenIP = identification.Context.IP
+		icUser.LastSeenUserAgent = identification.Context.UserAgent
+	}
+
 	if identification.UserTraits["createdAt"] != nil {
 		// TODO: this is horrible, there must be a better way...
 		icUser.CreatedAt = int64(identification.UserTraits["createdAt"].(float64))
@@ -60,8 +77,14 @@ func (i Intercom) Identify(identification integrations.Identification) (err erro
 	return
 }
 
-// Track forwards the event to Intercom
+// Track forwards the event to Intercom. Events of anonymous visitors are not
+// supported, as Intercom only tracks them for users.
 func (i Intercom) Track(event integrations.Event) (err error) {
+	if event.UserID == "" {
+		logrus.WithField("event", event).Info("Skipping anonymous event for Intercom")
+		return integrations.ErrUnsupported
+	}
+
 	icEvent := intercom.Event{}
 	icEvent.UserID = event.UserID
 	icEvent.EventName = event.Name
@@ -119,8 +142,14 @@ func (i Intercom) Track(event integrations.Event) (err error) {
 }
 
 // Page tracks page views. Intercom doesn't support a special type for
-// this, so it's implemented as a special type of event
+// this, so it's implemented as a special type of event. Like events, the
+// page views of anonymous visitors are not supported.
 func (p Intercom) Page(page integrations.Page) (err error) {
+	if page.UserID == "" {
+		logrus.WithField("page", page).Info("Skipping anonymous page view for Intercom")
+		return integrations.ErrUnsupported
+	}
+
 	icPage := intercom.Event{}
 	icPage.UserID = page.UserID
 	icPage.EventName = "Page visited"
@@ -155,9 +184,137 @@ func (p Intercom) Page(page integrations.Page) (err error) {
 	return
 }
 
+// identifyLead creates or updates the lead known by the anonymous ID
+func (i Intercom) identifyLead(identification integrations.Identification) (err error) {
+	lead, err := i.LeadRepository.FindLeadByUserID(identification.AnonymousID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not_found") {
+			// The lead doesn't exist, we just need to create it.
+			lead = intercom.Contact{UserID: identification.AnonymousID}
+		} else {
+			logrus.WithError(err).WithField("identification", identification).Error("Error fetching the Intercom lead")
+			return
+		}
+	}
+
+	lead.CustomAttributes = make(map[string]interface{})
+	for k, v := range identification.UserTraits {
+		lead.CustomAttributes[k] = v
+	}
+	lead.CustomAttributes["forwardlyticsReceivedAt"] = identification.ReceivedAt
+
+	if email, ok := identification.UserTraits["email"].(string); ok {
+		lead.Email = email
+	}
+
+	if name, ok := identification.UserTraits["name"].(string); ok {
+		lead.Name = name
+	}
+
+	// The client doesn't send the user agent of leads
+	if identification.Context != nil {
+		lead.LastSeenIP = identification.Context.IP
+	}
+
+	savedLead, err := i.LeadRepository.SaveLead(lead)
+	if err == nil {
+		logrus.WithField("savedLead", savedLead).Info("Lead saved on Intercom")
+	} else {
+		logrus.WithError(err).WithField("identification", identification).WithField("lead", lead).Error("Error while saving lead on Intercom")
+	}
+	return
+}
+
+// Alias converts the Intercom lead known by the previous ID into the user.
+// Nothing happens when there is no such lead.
+func (i Intercom) Alias(alias integrations.Alias) (err error) {
+	lead, err := i.LeadRepository.FindLeadByUserID(alias.PreviousID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not_found") {
+			logrus.WithField("alias", alias).Info("No Intercom lead to convert")
+			return nil
+		}
+		logrus.WithError(err).WithField("alias", alias).Error("Error fetching the Intercom lead")
+		return
+	}
+
+	icUser := intercom.User{UserID: alias.UserID}
+	if alias.UserTraits["email"] != nil {
+		icUser.Email = alias.UserTraits["email"].(string)
+	}
+
+	savedUser, err := i.LeadRepository.ConvertLead(lead, icUser)
+	if err == nil {
+		logrus.WithField("savedUser", savedUser).Info("Lead converted to user on Intercom")
+	} else {
+		logrus.WithError(err).WithField("alias", alias).WithField("lead", lead).Error("Error while converting lead on Intercom")
+	}
+	return
+}
+
+// Group creates or updates the Intercom company, and adds the user to it. The
+// groups of anonymous visitors are not supported, as only users are added to
+// companies.
+func (i Intercom) Group(group integrations.Group) (err error) {
+	if group.UserID == "" {
+		logrus.WithField("group", group).Info("Skipping anonymous group for Intercom")
+		return integrations.ErrUnsupported
+	}
+
+	company := intercom.Company{CompanyID: group.GroupID}
+	company.CustomAttributes = make(map[string]interface{})
+	for k, v := range group.Traits {
+		switch value := v.(type) {
+		case string:
+			switch k {
+			case "name":
+				company.Name = value
+			case "plan":
+				company.Plan = &intercom.Plan{Name: value}
+			default:
+				company.CustomAttributes[k] = value
+			}
+		case float64:
+			switch k {
+			case "monthlySpend":
+				company.MonthlySpend = int64(value)
+			case "createdAt":
+				company.RemoteCreatedAt = int64(value)
+			default:
+				company.CustomAttributes[k] = value
+			}
+		case map[string]interface{}, []interface{}:
+			// Nested values are not supported by Intercom's custom attributes
+		default:
+			company.CustomAttributes[k] = value
+		}
+	}
+	company.CustomAttributes["forwardlyticsReceivedAt"] = group.ReceivedAt
+
+	savedCompany, err := i.CompanyRepository.SaveCompany(company)
+	if err != nil {
+		logrus.WithError(err).WithField("group", group).WithField("company", company).Error("Error while saving company on Intercom")
+		return
+	}
+	logrus.WithField("savedCompany", savedCompany).Info("Company saved on Intercom")
+
+	// Saving a user with a company adds it without removing the others
+	icUser := intercom.User{
+		UserID:    group.UserID,
+		Companies: &intercom.CompanyList{Companies: []intercom.Company{{CompanyID: group.GroupID}}},
+	}
+	savedUser, err := i.Service.Save(icUser)
+	if err == nil {
+		logrus.WithField("savedUser", savedUser).Info("User added to company on Intercom")
+	} else {
+		logrus.WithError(err).WithField("group", group).WithField("icUser", icUser).Error("Error while adding user to company on Intercom")
+	}
+	return
+}
+
 // Enabled returns wether or not the Intercom integration is enabled/configured
 func (i Intercom) Enabled() bool {
-	return apiKey() != "" && appID() != ""
+	return apiKey(i.name) != "" && appID(i.name) != ""
 }
 
 // EventRepository defines the interface for tracking events on Intercom
@@ -167,12 +324,13 @@ type EventRepository interface {
 
 // EventService tracks services on Intercom
 type EventService struct {
-	*intercom.Client
+	// name of the instance
+	name string
 }
 
 // Save the event on Intercom
 func (es EventService) Save(event *intercom.Event) error {
-	return es.Client.Events.Save(event)
+	return intercomError(es.name, client(es.name).Events.Save(event))
 }
 
 // Service defines the interface for working with the Intercom API
@@ -183,37 +341,200 @@ type Service interface {
 
 // API implements IntercomService
 type API struct {
-	*intercom.Client
+	// name of the instance
+	name string
 }
 
 // FindByUserID gets the user by UserID on Intercom
 func (api API) FindByUserID(userID string) (user intercom.User, err error) {
-	user, err = api.Client.Users.FindByUserID(userID)
+	user, err = client(api.name).Users.FindByUserID(userID)
+	err = intercomError(api.name, err)
 	return
 }
 
 // Save the user on Intercom
 func (api API) Save(user intercom.User) (savedUser intercom.User, err error) {
-	savedUser, err = api.Client.Users.Save(&user)
+	savedUser, err = client(api.name).Users.Save(&user)
+	err = intercomError(api.name, err)
 	return
 }
 
-func apiKey() string {
-	return os.Getenv("INTERCOM_API_KEY")
+// LeadRepository defines the interface for working with leads on Intercom
+type LeadRepository interface {
+	FindLeadByUserID(userID string) (intercom.Contact, error)
+	SaveLead(lead intercom.Contact) (intercom.Contact, error)
+	ConvertLead(lead intercom.Contact, user intercom.User) (intercom.User, error)
 }
 
-func appID() string {
-	return os.Getenv("INTERCOM_APP_ID")
+// LeadService works with leads on Intercom
+type LeadService struct {
+	// name of the instance
+	name string
 }
 
-func init() {
-	ic := Intercom{}
-	ic.Client = intercom.NewClient(appID(), apiKey())
-	ic.Service = API{ic.Client}
-	ic.EventRepository = EventService{ic.Client}
+// FindLeadByUserID gets the lead by UserID on Intercom
+func (ls LeadService) FindLeadByUserID(userID string) (lead intercom.Contact, err error) {
+	lead, err = client(ls.name).Contacts.FindByUserID(userID)
+	err = intercomError(ls.name, err)
+	return
+}
+
+// SaveLead creates the lead on Intercom, or updates it when it already exists
+func (ls LeadService) SaveLead(lead intercom.Contact) (savedLead intercom.Contact, err error) {
+	if lead.ID == "" {
+		savedLead, err = client(ls.name).Contacts.Create(&lead)
+	} else {
+		savedLead, err = client(ls.name).Contacts.Update(&lead)
+	}
+	err = intercomError(ls.name, err)
+	return
+}
+
+// ConvertLead turns the lead into the user on Intercom, merging them if the
+// user already exists
+func (ls LeadService) ConvertLead(lead intercom.Contact, user intercom.User) (savedUser intercom.User, err error) {
+	savedUser, err = client(ls.name).Contacts.Convert(&lead, &user)
+	err = intercomError(ls.name, err)
+	return
+}
+
+// CompanyRepository defines the interface for working with companies on Intercom
+type CompanyRepository interface {
+	SaveCompany(company intercom.Company) (intercom.Company, error)
+}
+
+// CompanyService works with companies on Intercom
+type CompanyService struct {
+	// name of the instance
+	name string
+}
+
+// SaveCompany creates or updates the company on Intercom
+func (cs CompanyService) SaveCompany(company intercom.Company) (savedCompany intercom.Company, err error) {
+	savedCompany, err = client(cs.name).Companies.Save(&company)
+	err = intercomError(cs.name, err)
+	return
+}
+
+// intercomError classifies the errors of the Intercom client of the instance
+// by their code for the authentication and rate limit ones, and by HTTP
+// status otherwise. Errors that didn't come from Intercom, like network ones,
+// are left as is.
+func intercomError(name string, err error) error {
+	icErr, ok := err.(intercom.IntercomError)
+	if !ok {
+		return err
+	}
+	switch icErr.GetCode() {
+	case "unauthorized", "token_unauthorized", "token_not_found", "token_revoked", "token_blocked":
+		return integrations.AuthFailure(err)
+	case "rate_limit_exceeded":
+		return integrations.RateLimited(err, retryAfter(name))
+	}
+	return integrations.StatusError(icErr.GetStatusCode(), nil, err)
+}
+
+type cachedClient struct {
+	appID  string
+	apiKey string
+	client *intercom.Client
+}
+
+var clients struct {
+	sync.Mutex
+	byName map[string]*cachedClient
+}
+
+// client returns the Intercom client for the credentials of the instance.
+// They're read when calling Intercom, as they can change when the
+// configuration is loaded.
+func client(name string) *intercom.Client {
+	clients.Lock()
+	defer clients.Unlock()
+	if clients.byName == nil {
+		clients.byName = make(map[string]*cachedClient)
+	}
+	cached := clients.byName[name]
+	if cached == nil || cached.appID != appID(name) || cached.apiKey != apiKey(name) {
+		cached = &cachedClient{appID: appID(name), apiKey: apiKey(name)}
+		cached.client = intercom.NewClient(cached.appID, cached.apiKey)
+		if httpClient, ok := cached.client.HTTPClient.(intercomInterfaces.IntercomHTTPClient); ok {
+			httpClient.Client.Transport = rateLimitTransport{name: name}
+		}
+		clients.byName[name] = cached
+
+		// Useful for debugging, keeping it around to avoid remembering how to use it
+		// cached.client.Option(intercom.TraceHTTP(true))
+	}
+	return cached.client
+}
 
-	// Useful for debugging, keeping it around to avoid remembering how to use it
-	// ic.Client.Option(intercom.TraceHTTP(true))
+// resets holds when the rate limit of each instance resets, after Intercom
+// refused a call, as its client doesn't give the headers back
+var resets = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// rateLimitTransport records the rate limit reset of the instance from the
+// responses refused for going over it
+type rateLimitTransport struct {
+	name string
+}
 
-	integrations.RegisterIntegration("intercom", ic)
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		now := time.Now()
+		resets.Lock()
+		resets.at[t.name] = now.Add(integrations.RetryAfterHeader(resp.Header, now))
+		resets.Unlock()
+	}
+	return resp, err
+}
+
+// retryAfter returns how long until the rate limit of the instance resets,
+// zero when unknown
+func retryAfter(name string) time.Duration {
+	resets.Lock()
+	defer resets.Unlock()
+	if wait := resets.at[name].Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func apiKey(name string) string {
+	return setting(name, "apiKey")
+}
+
+func appID(name string) string {
+	return setting(name, "appID")
+}
+
+// setting reads the setting of the Intercom instance with that name
+func setting(name string, key string) string {
+	if name == "" {
+		name = "intercom"
+	}
+	return integrations.GetSetting(name, key)
+}
+
+// New returns the Intercom instance with that name
+func New(name string) integrations.Integration {
+	return Intercom{
+		name:              name,
+		Service:           API{name: name},
+		EventRepository:   EventService{name: name},
+		LeadRepository:    LeadService{name: name},
+		CompanyRepository: CompanyService{name: name},
+	}
+}
+
+func init() {
+	integrations.RegisterSettings("intercom", []integrations.Setting{
+		{Name: "apiKey", Env: "INTERCOM_API_KEY", Required: true},
+		{Name: "appID", Env: "INTERCOM_APP_ID", Required: true},
+	})
+	integrations.RegisterFactory("intercom", New)
 }
@@ -2,18 +2,183 @@ package intercom
 
 import (
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/jipiboily/forwardlytics/integrations"
 	intercom "gopkg.in/intercom/intercom-go.v2"
 	intercomInterfaces "gopkg.in/intercom/intercom-go.v2/interfaces"
 )
 
+func TestAliasConvertsLead(t *testing.T) {
+	ic := Intercom{}
+	leads := &FakeIntercomLeadService{Lead: intercom.Contact{ID: "abc", UserID: "anonymous-456"}}
+	ic.LeadRepository = leads
+	alias := integrations.Alias{
+		PreviousID: "anonymous-456",
+		UserID:     "123",
+		UserTraits: map[string]interface{}{
+			"email": "john@example.com",
+		},
+	}
+
+	err := ic.Alias(alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leads.FoundUserID != "anonymous-456" {
+		t.Errorf("Expected the lead to be looked up by the previous ID, was: %v", leads.FoundUserID)
+	}
+	if leads.ConvertedLead.ID != "abc" {
+		t.Errorf("Expected the lead to be converted, got %#v", leads.ConvertedLead)
+	}
+	expectedUser := intercom.User{UserID: "123", Email: "john@example.com"}
+	if !reflect.DeepEqual(leads.ConvertedTo, expectedUser) {
+		t.Errorf("Wrong user. Expected \n%#v\n but got \n%#v\n", expectedUser, leads.ConvertedTo)
+	}
+}
+
+func TestAliasWhenNoLead(t *testing.T) {
+	ic := Intercom{}
+	leads := &FakeIntercomLeadService{NotFound: true}
+	ic.LeadRepository = leads
+
+	err := ic.Alias(integrations.Alias{PreviousID: "anonymous-456", UserID: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leads.ConvertedLead.ID != "" {
+		t.Error("Nothing should be converted when there is no lead")
+	}
+}
+
+func TestIdentifyAnonymousCreatesLead(t *testing.T) {
+	ic := Intercom{}
+	leads := &FakeIntercomLeadService{NotFound: true}
+	ic.LeadRepository = leads
+	identification := integrations.Identification{
+		AnonymousID: "anonymous-456",
+		UserTraits: map[string]interface{}{
+			"email": "john@example.com",
+		},
+		Context:    &integrations.Context{IP: "1.2.3.4", UserAgent: "Mozilla/5.0"},
+		ReceivedAt: 3344,
+	}
+
+	err := ic.Identify(identification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leads.FoundUserID != "anonymous-456" {
+		t.Errorf("Expected the lead to be looked up by the anonymous ID, was: %v", leads.FoundUserID)
+	}
+	expectedLead := intercom.Contact{
+		UserID:     "anonymous-456",
+		Email:      "john@example.com",
+		LastSeenIP: "1.2.3.4",
+		CustomAttributes: map[string]interface{}{
+			"email":                   "john@example.com",
+			"forwardlyticsReceivedAt": int64(3344),
+		},
+	}
+	if !reflect.DeepEqual(leads.SavedLead, expectedLead) {
+		t.Errorf("Wrong lead. Expected \n%#v\n but got \n%#v\n", expectedLead, leads.SavedLead)
+	}
+}
+
+func TestTrackAnonymousIsUnsupported(t *testing.T) {
+	ic := Intercom{}
+	events := &FakeIntercomEventsService{}
+	ic.EventRepository = events
+
+	err := ic.Track(integrations.Event{Name: "account.created", AnonymousID: "anonymous-456"})
+	if err != integrations.ErrUnsupported {
+		t.Errorf("Expected the event to be unsupported, got %v", err)
+	}
+}
+
+func TestGroupAnonymousIsUnsupported(t *testing.T) {
+	ic := Intercom{}
+	companies := &FakeIntercomCompanyService{}
+	ic.CompanyRepository = companies
+
+	err := ic.Group(integrations.Group{GroupID: "company-456", AnonymousID: "anonymous-456"})
+	if err != integrations.ErrUnsupported {
+		t.Errorf("Expected the group to be unsupported, got %v", err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	ic := Intercom{}
+	companies := &FakeIntercomCompanyService{}
+	ic.CompanyRepository = companies
+	service := &FakeIntercomAPISuccess{}
+	ic.Service = service
+	group := integrations.Group{
+		GroupID: "company-456",
+		UserID:  "123",
+		Traits: map[string]interface{}{
+			"name":         "Acme",
+			"plan":         "enterprise",
+			"monthlySpend": float64(1000),
+			"industry":     "Rockets",
+			"address":      map[string]interface{}{"city": "Montreal"},
+		},
+		ReceivedAt: 3344,
+	}
+
+	err := ic.Group(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedCompany := intercom.Company{
+		CompanyID:    "company-456",
+		Name:         "Acme",
+		Plan:         &intercom.Plan{Name: "enterprise"},
+		MonthlySpend: 1000,
+		CustomAttributes: map[string]interface{}{
+			"industry":                "Rockets",
+			"forwardlyticsReceivedAt": int64(3344),
+		},
+	}
+	if !reflect.DeepEqual(companies.SavedCompany, expectedCompany) {
+		t.Errorf("Wrong company. Expected \n%#v\n but got \n%#v\n", expectedCompany, companies.SavedCompany)
+	}
+
+	expectedUser := intercom.User{
+		UserID:    "123",
+		Companies: &intercom.CompanyList{Companies: []intercom.Company{{CompanyID: "company-456"}}},
+	}
+	if !reflect.DeepEqual(service.ReceivedUser, expectedUser) {
+		t.Errorf("Wrong user. Expected \n%#v\n but got \n%#v\n", expectedUser, service.ReceivedUser)
+	}
+}
+
+func TestGroupWhenCompanyFails(t *testing.T) {
+	ic := Intercom{}
+	ic.CompanyRepository = &FakeIntercomCompanyService{Fail: true}
+	service := &FakeIntercomAPISuccess{}
+	ic.Service = service
+
+	err := ic.Group(integrations.Group{GroupID: "company-456", UserID: "123"})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if service.SaveCalled {
+		t.Error("The user should not be added to a company that failed to save")
+	}
+}
+
 func TestIdentifySuccessWhenCreate(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	service := &FakeIntercomAPIWhenCreate{}
 	ic.Service = service
 	identification := integrations.Identification{
@@ -56,7 +221,6 @@ func TestIdentifySuccessWhenCreate(t *testing.T) {
 
 func TestIdentifySuccessWhenUpdate(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	service := &FakeIntercomAPISuccess{}
 	ic.Service = service
 	identification := integrations.Identification{
@@ -96,12 +260,30 @@ func TestIdentifySuccessWhenUpdate(t *testing.T) {
 	}
 }
 
+func TestIdentifyWithContext(t *testing.T) {
+	ic := Intercom{}
+	service := &FakeIntercomAPISuccess{}
+	ic.Service = service
+	identification := integrations.Identification{
+		UserID:  "123",
+		Context: &integrations.Context{IP: "1.2.3.4", UserAgent: "Mozilla/5.0"},
+	}
+
+	err := ic.Identify(identification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if service.ReceivedUser.LastSeenIP != "1.2.3.4" || service.ReceivedUser.LastSeenUserAgent != "Mozilla/5.0" {
+		t.Errorf("Expected the IP and user agent from the context, got %#v", service.ReceivedUser)
+	}
+}
+
 func TestIdentifyWhenFail(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	service := &FakeIntercomAPIFailSave{}
 	ic.Service = service
-	err := ic.Identify(integrations.Identification{})
+	err := ic.Identify(integrations.Identification{UserID: "123"})
 	if err == nil {
 		t.Fatal("Expecting an error.")
 	}
@@ -113,7 +295,6 @@ func TestIdentifyWhenFail(t *testing.T) {
 
 func TestTrack(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	ic.Service = &FakeIntercomAPIWhenCreate{}
 	es := &FakeIntercomEventsService{t: t}
 	ic.EventRepository = es
@@ -155,7 +336,6 @@ func TestTrack(t *testing.T) {
 
 func TestTrackWhenFail(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	ic.Service = &FakeIntercomAPIWhenCreate{}
 	es := &FakeIntercomEventsServiceFailing{t: t}
 	ic.EventRepository = es
@@ -181,7 +361,6 @@ func TestTrackWhenFail(t *testing.T) {
 
 func TestTrackWhenUserDoesNotExists(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	es := &FakeIntercomEventsServiceFailingWithNotFound{t: t}
 	ic.EventRepository = es
 	service := &FakeIntercomAPISuccessCreateNewUserFromTrack{t: t}
@@ -218,7 +397,6 @@ func TestTrackWhenAPropertyIsAMap(t *testing.T) {
 	// by Intercom. See the `Metadata support` section of
 	// https://docs.intercom.io/the-intercom-platform/tracking-events-in-intercom
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	ic.Service = &FakeIntercomAPIWhenCreate{}
 	es := &FakeIntercomEventsService{t: t}
 	ic.EventRepository = es
@@ -265,7 +443,6 @@ func TestTrackWhenAPropertyIsAMap(t *testing.T) {
 
 func TestPage(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	es := &FakeIntercomEventsService{t: t}
 	ic.EventRepository = es
 
@@ -309,7 +486,6 @@ func TestPage(t *testing.T) {
 
 func TestPageWhenFail(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	es := &FakeIntercomEventsServiceFailing{t: t}
 	ic.EventRepository = es
 
@@ -336,7 +512,6 @@ func TestPageWhenFail(t *testing.T) {
 
 func TestPageWhenUserDoesNotExists(t *testing.T) {
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	es := &FakeIntercomEventsServiceFailingWithNotFound{t: t}
 	ic.EventRepository = es
 	service := &FakeIntercomAPISuccessCreateNewUserFromTrack{t: t}
@@ -375,7 +550,6 @@ func TestPageWhenAPropertyIsAMap(t *testing.T) {
 	// by Intercom. See the `Metadata support` section of
 	// https://docs.intercom.io/the-intercom-platform/tracking-events-in-intercom
 	ic := Intercom{}
-	ic.Client = intercom.NewClient("", "")
 	es := &FakeIntercomEventsService{t: t}
 	ic.EventRepository = es
 
@@ -493,6 +667,49 @@ func (api *FakeIntercomAPIWhenCreate) Save(user intercom.User) (savedUser interc
 	return
 }
 
+type FakeIntercomLeadService struct {
+	Lead          intercom.Contact
+	NotFound      bool
+	FoundUserID   string
+	SavedLead     intercom.Contact
+	ConvertedLead intercom.Contact
+	ConvertedTo   intercom.User
+}
+
+func (ls *FakeIntercomLeadService) FindLeadByUserID(userID string) (lead intercom.Contact, err error) {
+	ls.FoundUserID = userID
+	if ls.NotFound {
+		err = errors.New("404: not_found, Contact Not Found")
+		return
+	}
+	return ls.Lead, nil
+}
+
+func (ls *FakeIntercomLeadService) SaveLead(lead intercom.Contact) (savedLead intercom.Contact, err error) {
+	ls.SavedLead = lead
+	return lead, nil
+}
+
+func (ls *FakeIntercomLeadService) ConvertLead(lead intercom.Contact, user intercom.User) (savedUser intercom.User, err error) {
+	ls.ConvertedLead = lead
+	ls.ConvertedTo = user
+	return user, nil
+}
+
+type FakeIntercomCompanyService struct {
+	Fail         bool
+	SavedCompany intercom.Company
+}
+
+func (cs *FakeIntercomCompanyService) SaveCompany(company intercom.Company) (savedCompany intercom.Company, err error) {
+	if cs.Fail {
+		err = errors.New("Some API error")
+		return
+	}
+	cs.SavedCompany = company
+	return company, nil
+}
+
 type FakeIntercomEventsService struct {
 	t             *testing.T
 	SaveCalled    bool
@@ -549,3 +766,52 @@ func (api *FakeIntercomAPISuccessCreateNewUserFromTrack) Save(user intercom.User
 	}
 	return
 }
+
+func TestIntercomError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind integrations.ErrorKind
+	}{
+		{intercomInterfaces.HTTPError{StatusCode: 401, Code: "token_unauthorized", Message: "Not authorized to access resource"}, integrations.ErrorAuth},
+		{intercomInterfaces.HTTPError{StatusCode: 429, Code: "rate_limit_exceeded", Message: "Exceeded rate limit"}, integrations.ErrorRateLimited},
+		{intercomInterfaces.HTTPError{StatusCode: 404, Code: "not_found", Message: "User Not Found"}, integrations.ErrorPermanent},
+		{intercomInterfaces.HTTPError{StatusCode: 503, Code: "service_unavailable", Message: "Sorry, the API service is temporarily unavailable"}, integrations.ErrorRetryable},
+		{errors.New("connection reset by peer"), integrations.ErrorRetryable},
+	}
+	for _, test := range tests {
+		err := intercomError("intercom", test.err)
+		if kind := integrations.Kind(err); kind != test.kind {
+			t.Errorf("Expected %v to be %s, got %s", test.err, test.kind, kind)
+		}
+		if err.Error() != test.err.Error() {
+			t.Errorf("Expected the message of %v to be kept, got %q", test.err, err.Error())
+		}
+	}
+	if intercomError("intercom", nil) != nil {
+		t.Error("No error should stay nil")
+	}
+}
+
+func TestRateLimitReset(t *testing.T) {
+	reset := time.Now().Add(time.Minute).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: rateLimitTransport{name: "test-only-intercom-limited"}}
+	resp, err := httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	err = intercomError("test-only-intercom-limited", intercomInterfaces.HTTPError{StatusCode: 429, Code: "rate_limit_exceeded", Message: "Exceeded rate limit"})
+	if wait := integrations.RetryAfter(err); wait <= 58*time.Second || wait > time.Minute {
+		t.Errorf("Expected to wait until the reset, about a minute, got %v", wait)
+	}
+	if wait := retryAfter("test-only-intercom-other"); wait != 0 {
+		t.Errorf("Expected other instances not to wait, got %v", wait)
+	}
+}
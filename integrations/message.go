@@ -0,0 +1,247 @@
+package integrations
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Message types accepted by the API
+const (
+	TypeIdentify = "identify"
+	TypeTrack    = "track"
+	TypePage     = "page"
+	TypeAlias    = "alias"
+	TypeGroup    = "group"
+)
+
+// Message wraps any of the calls received by the API so it can be stored and
+// forwarded to the integrations later on. Only the field matching Type is set.
+type Message struct {
+	// Type is one of TypeIdentify, TypeTrack, TypePage, TypeAlias or TypeGroup
+	Type string `json:"type"`
+
+	Identification *Identification `json:"identification,omitempty"`
+	Event          *Event          `json:"event,omitempty"`
+	Page           *Page           `json:"page,omitempty"`
+	Alias          *Alias          `json:"alias,omitempty"`
+	Group          *Group          `json:"group,omitempty"`
+
+	// Source is the name of the source that sent the message, empty for the
+	// messages received before sources existed
+	Source string `json:"source,omitempty"`
+}
+
+// ErrUnsupported is returned when sending a message to an integration that
+// doesn't support its type. Integrations also return it for the anonymous
+// messages they can't map.
+var ErrUnsupported = errors.New("integrations: message type not supported")
+
+// Send forwards the message to the integration, using the call matching its type
+func (m Message) Send(integration Integration) error {
+	switch {
+	case m.Type == TypeIdentify && m.Identification != nil:
+		return integration.Identify(*m.Identification)
+	case m.Type == TypeTrack && m.Event != nil:
+		return integration.Track(*m.Event)
+	case m.Type == TypePage && m.Page != nil:
+		return integration.Page(*m.Page)
+	case m.Type == TypeAlias && m.Alias != nil:
+		if aliasIntegration, ok := integration.(AliasIntegration); ok {
+			return aliasIntegration.Alias(*m.Alias)
+		}
+		return ErrUnsupported
+	case m.Type == TypeGroup && m.Group != nil:
+		if groupIntegration, ok := integration.(GroupIntegration); ok {
+			return groupIntegration.Group(*m.Group)
+		}
+		return ErrUnsupported
+	}
+	return fmt.Errorf("invalid message of type %q", m.Type)
+}
+
+// ID returns the message ID of the wrapped call
+func (m Message) ID() string {
+	switch {
+	case m.Identification != nil:
+		return m.Identification.MessageID
+	case m.Event != nil:
+		return m.Event.MessageID
+	case m.Page != nil:
+		return m.Page.MessageID
+	case m.Alias != nil:
+		return m.Alias.MessageID
+	case m.Group != nil:
+		return m.Group.MessageID
+	}
+	return ""
+}
+
+// SetID sets the message ID of the wrapped call
+func (m Message) SetID(id string) {
+	switch {
+	case m.Identification != nil:
+		m.Identification.MessageID = id
+	case m.Event != nil:
+		m.Event.MessageID = id
+	case m.Page != nil:
+		m.Page.MessageID = id
+	case m.Alias != nil:
+		m.Alias.MessageID = id
+	case m.Group != nil:
+		m.Group.MessageID = id
+	}
+}
+
+// Context returns the context of the wrapped call, if it has one
+func (m Message) Context() *Context {
+	switch {
+	case m.Identification != nil:
+		return m.Identification.Context
+	case m.Event != nil:
+		return m.Event.Context
+	case m.Page != nil:
+		return m.Page.Context
+	}
+	return nil
+}
+
+// SetContext sets the context of the wrapped call. Aliases and groups have
+// none, so it's ignored for them.
+func (m Message) SetContext(context *Context) {
+	switch {
+	case m.Identification != nil:
+		m.Identification.Context = context
+	case m.Event != nil:
+		m.Event.Context = context
+	case m.Page != nil:
+		m.Page.Context = context
+	}
+}
+
+// UserKey returns the user the message is about: its user ID, or the anonymous
+// ID of an anonymous visitor. It's empty when there's neither.
+func (m Message) UserKey() string {
+	switch {
+	case m.Identification != nil:
+		return firstNonEmpty(m.Identification.UserID, m.Identification.AnonymousID)
+	case m.Event != nil:
+		return firstNonEmpty(m.Event.UserID, m.Event.AnonymousID)
+	case m.Page != nil:
+		return firstNonEmpty(m.Page.UserID, m.Page.AnonymousID)
+	case m.Alias != nil:
+		return m.Alias.UserID
+	case m.Group != nil:
+		return firstNonEmpty(m.Group.UserID, m.Group.AnonymousID)
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// SupportedBy tells if the integration handles messages of this type
+func (m Message) SupportedBy(integration Integration) bool {
+	switch m.Type {
+	case TypeAlias:
+		_, ok := integration.(AliasIntegration)
+		return ok
+	case TypeGroup:
+		_, ok := integration.(GroupIntegration)
+		return ok
+	}
+	return true
+}
+
+// Copy returns a copy of the message that shares no data with the original, so
+// that an integration adding attributes doesn't affect the others.
+func (m Message) Copy() Message {
+	c := Message{Type: m.Type, Source: m.Source}
+	if m.Identification != nil {
+		identification := *m.Identification
+		identification.UserTraits = copyMap(identification.UserTraits)
+		identification.Context = identification.Context.Copy()
+		c.Identification = &identification
+	}
+	if m.Event != nil {
+		event := *m.Event
+		event.Properties = copyMap(event.Properties)
+		event.Context = event.Context.Copy()
+		c.Event = &event
+	}
+	if m.Page != nil {
+		page := *m.Page
+		page.Properties = copyMap(page.Properties)
+		page.Context = page.Context.Copy()
+		c.Page = &page
+	}
+	if m.Alias != nil {
+		alias := *m.Alias
+		alias.UserTraits = copyMap(alias.UserTraits)
+		c.Alias = &alias
+	}
+	if m.Group != nil {
+		group := *m.Group
+		group.Traits = copyMap(group.Traits)
+		c.Group = &group
+	}
+	return c
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+func copyValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return copyMap(value)
+	case []interface{}:
+		c := make([]interface{}, len(value))
+		for i, item := range value {
+			c[i] = copyValue(item)
+		}
+		return c
+	}
+	return v
+}
+
+// NewID returns a random identifier, used for messages and stored entries
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Validate the content of the message to be sure it has everything that's needed
+func (m Message) Validate() (missingParameters []string) {
+	switch {
+	case m.Type == TypeIdentify && m.Identification != nil:
+		return m.Identification.Validate()
+	case m.Type == TypeTrack && m.Event != nil:
+		return m.Event.Validate()
+	case m.Type == TypePage && m.Page != nil:
+		return m.Page.Validate()
+	case m.Type == TypeAlias && m.Alias != nil:
+		return m.Alias.Validate()
+	case m.Type == TypeGroup && m.Group != nil:
+		return m.Group.Validate()
+	}
+	return []string{"type"}
+}
@@ -0,0 +1,76 @@
+package integrations
+
+import "testing"
+
+func TestMessageCopyIsIndependent(t *testing.T) {
+	original := Message{
+		Type: TypeTrack,
+		Event: &Event{
+			Name:   "account.created",
+			UserID: "123",
+			Properties: map[string]interface{}{
+				"plan": map[string]interface{}{"name": "pro"},
+			},
+			Context: &Context{IP: "1.2.3.4", Campaign: &Campaign{Name: "launch"}},
+		},
+	}
+
+	c := original.Copy()
+	c.Event.Name = "account.deleted"
+	c.Event.Properties["email"] = "john@example.com"
+	c.Event.Properties["plan"].(map[string]interface{})["name"] = "free"
+	c.Event.Context.IP = "5.6.7.8"
+	c.Event.Context.Campaign.Name = "sale"
+
+	if original.Event.Name != "account.created" {
+		t.Errorf("Original name changed to %v", original.Event.Name)
+	}
+	if _, ok := original.Event.Properties["email"]; ok {
+		t.Error("Original properties should not get the new email")
+	}
+	if name := original.Event.Properties["plan"].(map[string]interface{})["name"]; name != "pro" {
+		t.Errorf("Original nested property changed to %v", name)
+	}
+	if original.Event.Context.IP != "1.2.3.4" || original.Event.Context.Campaign.Name != "launch" {
+		t.Errorf("Original context changed to %#v", original.Event.Context)
+	}
+}
+
+func TestMessageSendWhenUnsupported(t *testing.T) {
+	message := Message{Type: TypeAlias, Alias: &Alias{PreviousID: "456", UserID: "123"}}
+	integration := basicIntegration{}
+
+	if message.SupportedBy(integration) {
+		t.Error("Alias should not be supported by an integration without an Alias method")
+	}
+	if err := message.Send(integration); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestMessageUserKey(t *testing.T) {
+	tests := []struct {
+		message  Message
+		expected string
+	}{
+		{Message{Type: TypeIdentify, Identification: &Identification{UserID: "123", AnonymousID: "anonymous-456"}}, "123"},
+		{Message{Type: TypeTrack, Event: &Event{AnonymousID: "anonymous-456"}}, "anonymous-456"},
+		{Message{Type: TypePage, Page: &Page{UserID: "123"}}, "123"},
+		{Message{Type: TypeAlias, Alias: &Alias{PreviousID: "anonymous-456", UserID: "123"}}, "123"},
+		{Message{Type: TypeGroup, Group: &Group{GroupID: "789", UserID: "123"}}, "123"},
+		{Message{Type: TypeGroup, Group: &Group{GroupID: "789", AnonymousID: "anonymous-456"}}, "anonymous-456"},
+		{Message{Type: TypeTrack}, ""},
+	}
+	for _, test := range tests {
+		if key := test.message.UserKey(); key != test.expected {
+			t.Errorf("Expected the %s to be about %q, got %q", test.message.Type, test.expected, key)
+		}
+	}
+}
+
+type basicIntegration struct{}
+
+func (basicIntegration) Identify(identification Identification) error { return nil }
+func (basicIntegration) Track(event Event) error                      { return nil }
+func (basicIntegration) Page(page Page) error                         { return nil }
+func (basicIntegration) Enabled() bool                                { return true }
@@ -1,46 +1,314 @@
 package mixpanel
 
 import (
-	"os"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jipiboily/forwardlytics/integrations"
 )
 
+// Mixpanel only accepts events from the last 5 days on /track, older ones
+// have to go through /import.
+const trackMaxAge = 5 * 24 * time.Hour
+
 // Mixpanel integration
 type Mixpanel struct {
+	// name of the instance, mixpanel when empty
+	name string
+	api  service
+}
+
+type service interface {
+	request(string, string, []byte) error
+}
+
+type mixpanelAPIProduction struct {
+	name    string
+	baseUrl string
+}
+
+type apiProfileUpdate struct {
+	Token      string                 `json:"$token"`
+	DistinctId string                 `json:"$distinct_id"`
+	Time       int64                  `json:"$time"`
+	IP         string                 `json:"$ip,omitempty"`
+	Set        map[string]interface{} `json:"$set"`
+}
+
+type apiEvent struct {
+	Event      string                 `json:"event"`
+	Properties map[string]interface{} `json:"properties"`
 }
 
-// Identify forwards and identify call to Mixpanel
-func (Mixpanel) Identify(identification integrations.Identification) (err error) {
-	logrus.Errorf("NOT IMPLEMENTED: will send %#v to Mixpanel\n", identification)
+type apiResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Identify forwards and identify call to Mixpanel, as a people profile update
+func (m Mixpanel) Identify(identification integrations.Identification) (err error) {
+	p := apiProfileUpdate{}
+	p.Token = token(m.name)
+	p.DistinctId = distinctID(identification.UserID, identification.AnonymousID)
+	p.Time = identification.Timestamp * 1000
+	if identification.Context != nil {
+		// Used by Mixpanel to geolocate the user
+		p.IP = identification.Context.IP
+	}
+	p.Set = make(map[string]interface{})
+	for k, v := range identification.UserTraits {
+		switch k {
+		case "email":
+			p.Set["$email"] = v
+		case "name":
+			p.Set["$name"] = v
+		case "createdAt":
+			if createdAt, ok := v.(float64); ok {
+				p.Set["$created"] = time.Unix(int64(createdAt), 0).UTC().Format("2006-01-02T15:04:05")
+			}
+		default:
+			p.Set[k] = v
+		}
+	}
+	p.Set["forwardlyticsReceivedAt"] = identification.ReceivedAt
+	p.Set["forwardlyticsTimestamp"] = identification.Timestamp
+
+	payload, err := json.Marshal([]apiProfileUpdate{p})
+	if err != nil {
+		logrus.WithError(err).WithField("identification", identification).Error("Error marshalling mixpanel profile update to json")
+		return
+	}
+	err = m.api.request("POST", "engage", payload)
+	if err != nil {
+		logrus.WithError(err).WithField("identification", identification).WithField("payload", string(payload[:])).Error("Error sending identify to Mixpanel")
+	}
 	return
 }
 
 // Track forwards the event to Mixpanel
-func (Mixpanel) Track(event integrations.Event) (err error) {
-	logrus.Errorf("NOT IMPLEMENTED: will send %#v to Mixpanel\n", event)
-	return
+func (m Mixpanel) Track(event integrations.Event) (err error) {
+	e := apiEvent{}
+	e.Event = event.Name
+	e.Properties = make(map[string]interface{})
+	for k, v := range event.Properties {
+		e.Properties[k] = v
+	}
+	return m.send(e, distinctID(event.UserID, event.AnonymousID), event.Context, event.Timestamp, event.ReceivedAt)
 }
 
-func (Mixpanel) Page(page integrations.Page) (err error) {
-	logrus.Errorf("NOT IMPLEMENTED: will send %#v to Mixpanel\n", page)
+// Page forwards the page-views to Mixpanel. Mixpanel doesn't have a special
+// type for those, so they're sent as events.
+func (m Mixpanel) Page(page integrations.Page) (err error) {
+	e := apiEvent{}
+	e.Event = "Page visited"
+	e.Properties = make(map[string]interface{})
+	for k, v := range page.Properties {
+		e.Properties[k] = v
+	}
+	e.Properties["url"] = page.Url
+	e.Properties["pagename"] = page.Name
+	return m.send(e, distinctID(page.UserID, page.AnonymousID), page.Context, page.Timestamp, page.ReceivedAt)
+}
+
+// Alias links the previous distinct_id, usually anonymous, to the user ID so
+// Mixpanel merges their events
+func (m Mixpanel) Alias(alias integrations.Alias) (err error) {
+	e := apiEvent{}
+	e.Event = "$create_alias"
+	e.Properties = map[string]interface{}{
+		"token":       token(m.name),
+		"distinct_id": alias.PreviousID,
+		"alias":       alias.UserID,
+	}
+	payload, err := json.Marshal([]apiEvent{e})
+	if err != nil {
+		logrus.WithError(err).WithField("alias", alias).Error("Error marshalling mixpanel alias to json")
+		return
+	}
+	err = m.api.request("POST", "track", payload)
+	if err != nil {
+		logrus.WithError(err).WithField("alias", alias).WithField("payload", string(payload[:])).Error("Error sending alias to Mixpanel")
+	}
 	return
 }
 
 // Enabled returns wether or not the Mixpanel integration is enabled/configured
-func (Mixpanel) Enabled() bool {
-	return apiKey() != "" && token() != ""
+func (m Mixpanel) Enabled() bool {
+	return apiKey(m.name) != "" && token(m.name) != ""
+}
+
+// send adds the properties Mixpanel needs to the event, and sends it to
+// /track or /import depending on how old it is.
+func (m Mixpanel) send(e apiEvent, distinctID string, context *integrations.Context, timestamp int64, receivedAt int64) (err error) {
+	e.Properties["token"] = token(m.name)
+	e.Properties["distinct_id"] = distinctID
+	e.Properties["time"] = timestamp
+	e.Properties["forwardlyticsReceivedAt"] = receivedAt
+	addContext(e.Properties, context)
+
+	endpoint := "track"
+	if time.Since(time.Unix(timestamp, 0)) > trackMaxAge {
+		endpoint = "import"
+	}
+
+	payload, err := json.Marshal([]apiEvent{e})
+	if err != nil {
+		logrus.WithError(err).WithField("event", e).Error("Error marshalling mixpanel event to json")
+		return
+	}
+	err = m.api.request("POST", endpoint, payload)
+	if err != nil {
+		logrus.WithError(err).WithField("event", e).WithField("payload", string(payload[:])).Error("Error sending event to Mixpanel")
+	}
+	return
+}
+
+// addContext sets the Mixpanel properties matching the context of the event
+func addContext(properties map[string]interface{}, context *integrations.Context) {
+	if context == nil {
+		return
+	}
+	if context.IP != "" {
+		properties["ip"] = context.IP
+	}
+	if browser := browser(context.UserAgent); browser != "" {
+		properties["$browser"] = browser
+	}
+	if context.App != nil && context.App.Version != "" {
+		properties["$app_version_string"] = context.App.Version
+	}
+	if campaign := context.Campaign; campaign != nil {
+		utm := map[string]string{
+			"utm_campaign": campaign.Name,
+			"utm_source":   campaign.Source,
+			"utm_medium":   campaign.Medium,
+			"utm_term":     campaign.Term,
+			"utm_content":  campaign.Content,
+		}
+		for k, v := range utm {
+			if v != "" {
+				properties[k] = v
+			}
+		}
+	}
+}
+
+// browser returns the name Mixpanel uses for the browser of the user agent.
+// The order matters, as most user agents mention several browsers.
+func browser(userAgent string) string {
+	switch {
+	case userAgent == "":
+		return ""
+	case strings.Contains(userAgent, "Edge/") || strings.Contains(userAgent, "Edg/"):
+		return "Microsoft Edge"
+	case strings.Contains(userAgent, "OPR/") || strings.Contains(userAgent, "Opera"):
+		return "Opera"
+	case strings.Contains(userAgent, "CriOS/"):
+		return "Chrome iOS"
+	case strings.Contains(userAgent, "Chrome/"):
+		return "Chrome"
+	case strings.Contains(userAgent, "FxiOS/"):
+		return "Firefox iOS"
+	case strings.Contains(userAgent, "Firefox/"):
+		return "Firefox"
+	case strings.Contains(userAgent, "MSIE") || strings.Contains(userAgent, "Trident/"):
+		return "Internet Explorer"
+	case strings.Contains(userAgent, "Safari/") && strings.Contains(userAgent, "Mobile"):
+		return "Mobile Safari"
+	case strings.Contains(userAgent, "Safari/"):
+		return "Safari"
+	}
+	return ""
+}
+
+// distinctID identifies the user on Mixpanel, anonymous visitors are tracked
+// by their anonymous ID until an alias links it to the user ID
+func distinctID(userID string, anonymousID string) string {
+	if userID == "" {
+		return anonymousID
+	}
+	return userID
+}
+
+func (api mixpanelAPIProduction) request(method string, endpoint string, payload []byte) (err error) {
+	apiUrl := api.baseUrl + endpoint + "?verbose=1"
+	req, err := http.NewRequest(method, apiUrl, bytes.NewBuffer(payload))
+	if err != nil {
+		return
+	}
+	// Only /import needs to be authenticated, with the API secret
+	if endpoint == "import" {
+		req.SetBasicAuth(apiKey(api.name), "")
+	}
+	req.Header.Add("User-Agent", "forwardlytics")
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("method", method).WithField("endpoint", endpoint).WithField("payload", string(payload[:])).Error("Error sending request to Mixpanel api")
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logrus.WithError(err).WithField("method", method).WithField("endpoint", endpoint).WithField("payload", string(payload[:])).Error("Error reading body in Mixpanel response")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		errorMessage := fmt.Sprintf("Mixpanel API returned HTTP status %d: %s", resp.StatusCode, body)
+		logrus.WithField("method", method).WithField("endpoint", endpoint).WithField("payload", string(payload[:])).Error(errorMessage)
+		return integrations.StatusError(resp.StatusCode, resp.Header, errors.New(errorMessage))
+	}
+
+	// With verbose=1, Mixpanel tells about invalid data in the body, which
+	// sending again won't fix
+	var result apiResult
+	if json.Unmarshal(body, &result) == nil && result.Status == 0 && result.Error != "" {
+		errorMessage := "Mixpanel API returned errors: " + result.Error
+		logrus.WithField("method", method).WithField("endpoint", endpoint).WithField("payload", string(payload[:])).WithField("response", string(body)).Error(errorMessage)
+		return integrations.Permanent(errors.New(errorMessage))
+	}
+	return
+}
+
+func apiKey(name string) string {
+	return setting(name, "apiKey")
+}
+
+func token(name string) string {
+	return setting(name, "token")
 }
 
-func apiKey() string {
-	return os.Getenv("MIXPANEL_API_KEY")
+// setting reads the setting of the Mixpanel instance with that name
+func setting(name string, key string) string {
+	if name == "" {
+		name = "mixpanel"
+	}
+	return integrations.GetSetting(name, key)
 }
 
-func token() string {
-	return os.Getenv("MIXPANEL_TOKEN")
+// New returns the Mixpanel instance with that name
+func New(name string) integrations.Integration {
+	return Mixpanel{
+		name: name,
+		api:  &mixpanelAPIProduction{name: name, baseUrl: "https://api.mixpanel.com/"},
+	}
 }
 
 func init() {
-	integrations.RegisterIntegration("mixpanel", Mixpanel{})
+	integrations.RegisterSettings("mixpanel", []integrations.Setting{
+		{Name: "apiKey", Env: "MIXPANEL_API_KEY", Required: true},
+		{Name: "token", Env: "MIXPANEL_TOKEN", Required: true},
+	})
+	integrations.RegisterFactory("mixpanel", New)
 }
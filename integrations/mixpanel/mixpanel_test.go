@@ -0,0 +1,362 @@
+package mixpanel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func TestNotEnabledWhenMissingCredentials(t *testing.T) {
+	os.Setenv("MIXPANEL_API_KEY", "")
+	os.Setenv("MIXPANEL_TOKEN", "")
+	mixpanel := Mixpanel{}
+	if mixpanel.Enabled() {
+		t.Error("Should not be enabled when missing api key and token")
+	}
+}
+
+func TestEnabledWhenCredentialsPresent(t *testing.T) {
+	os.Setenv("MIXPANEL_API_KEY", "secret")
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	if !mixpanel.Enabled() {
+		t.Error("Should be enabled when api key and token are present")
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	api := APIMock{}
+	mixpanel.api = &api
+	identification := integrations.Identification{
+		UserID: "123",
+		UserTraits: map[string]interface{}{
+			"email":     "john@example.com",
+			"name":      "John",
+			"createdAt": float64(1459532831),
+			"plan":      "pro",
+		},
+		Timestamp:  1234567,
+		ReceivedAt: 8765432,
+	}
+	err := mixpanel.Identify(identification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if api.Method != "POST" {
+		t.Errorf("Expected method to be POST, was: %v", api.Method)
+	}
+
+	if api.Endpoint != "engage" {
+		t.Errorf("Expected endpoint to be engage, was: %v", api.Endpoint)
+	}
+
+	expectedPayload := `[{"$token":"abc","$distinct_id":"123","$time":1234567000,"$set":{"$created":"2016-04-01T17:47:11","$email":"john@example.com","$name":"John","forwardlyticsReceivedAt":8765432,"forwardlyticsTimestamp":1234567,"plan":"pro"}}]`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+expectedPayload+" got: %s", api.Payload)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	api := APIMock{}
+	mixpanel.api = &api
+	timestamp := time.Now().Unix()
+	event := integrations.Event{
+		Name:   "account.created",
+		UserID: "123",
+		Properties: map[string]interface{}{
+			"plan": "pro",
+		},
+		Timestamp:  timestamp,
+		ReceivedAt: 65,
+	}
+
+	err := mixpanel.Track(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if api.Endpoint != "track" {
+		t.Errorf("Expected endpoint to be track, was: %v", api.Endpoint)
+	}
+
+	var events []apiEvent
+	if err = json.Unmarshal(api.Payload, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != "account.created" {
+		t.Fatalf("Expected the account.created event, got %s", api.Payload)
+	}
+	properties := events[0].Properties
+	if properties["token"] != "abc" || properties["distinct_id"] != "123" || properties["plan"] != "pro" {
+		t.Errorf("Missing properties in %s", api.Payload)
+	}
+	if properties["time"] != float64(timestamp) {
+		t.Errorf("Expected time to be %v, was: %v", timestamp, properties["time"])
+	}
+	if _, ok := event.Properties["token"]; ok {
+		t.Error("The event properties should not be modified")
+	}
+}
+
+func TestTrackAnonymousUsesAnonymousID(t *testing.T) {
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	api := APIMock{}
+	mixpanel.api = &api
+	event := integrations.Event{
+		Name:        "account.created",
+		AnonymousID: "anonymous-456",
+		Timestamp:   time.Now().Unix(),
+	}
+
+	err := mixpanel.Track(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []apiEvent
+	if err = json.Unmarshal(api.Payload, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Properties["distinct_id"] != "anonymous-456" {
+		t.Errorf("Expected the anonymous ID as distinct_id, got %s", api.Payload)
+	}
+}
+
+func TestTrackWithContext(t *testing.T) {
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	api := APIMock{}
+	mixpanel.api = &api
+	event := integrations.Event{
+		Name:   "account.created",
+		UserID: "123",
+		Context: &integrations.Context{
+			IP:        "1.2.3.4",
+			UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_4) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0.3029.81 Safari/537.36",
+			Campaign:  &integrations.Campaign{Name: "launch", Source: "newsletter"},
+			App:       &integrations.App{Version: "1.2.0"},
+		},
+		Timestamp: time.Now().Unix(),
+	}
+
+	err := mixpanel.Track(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []apiEvent
+	if err = json.Unmarshal(api.Payload, &events); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"ip":                  "1.2.3.4",
+		"$browser":            "Chrome",
+		"$app_version_string": "1.2.0",
+		"utm_campaign":        "launch",
+		"utm_source":          "newsletter",
+	}
+	for k, v := range expected {
+		if events[0].Properties[k] != v {
+			t.Errorf("Expected %v to be %v, was: %v", k, v, events[0].Properties[k])
+		}
+	}
+	if _, ok := events[0].Properties["utm_medium"]; ok {
+		t.Error("Empty UTM parameters should not be sent")
+	}
+}
+
+func TestBrowser(t *testing.T) {
+	userAgents := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:53.0) Gecko/20100101 Firefox/53.0":                                                          "Firefox",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X) AppleWebKit/603.1.30 (KHTML, like Gecko) Version/10.0 Mobile/14E277 Safari/602.1": "Mobile Safari",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0.2743.116 Safari/537.36 Edge/15.15063":       "Microsoft Edge",
+		"curl/7.51.0": "",
+	}
+	for userAgent, expected := range userAgents {
+		if name := browser(userAgent); name != expected {
+			t.Errorf("Expected %q for %v, got %q", expected, userAgent, name)
+		}
+	}
+}
+
+func TestTrackOldEventUsesImport(t *testing.T) {
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	api := APIMock{}
+	mixpanel.api = &api
+	event := integrations.Event{
+		Name:      "account.created",
+		UserID:    "123",
+		Timestamp: time.Now().Add(-6 * 24 * time.Hour).Unix(),
+	}
+
+	err := mixpanel.Track(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if api.Endpoint != "import" {
+		t.Errorf("Expected endpoint to be import, was: %v", api.Endpoint)
+	}
+}
+
+func TestPage(t *testing.T) {
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	api := APIMock{}
+	mixpanel.api = &api
+	page := integrations.Page{
+		Name:       "Homepage",
+		UserID:     "123",
+		Url:        "http://www.example.com",
+		Timestamp:  1234567,
+		ReceivedAt: 65,
+	}
+
+	err := mixpanel.Page(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPayload := `[{"event":"Page visited","properties":{"distinct_id":"123","forwardlyticsReceivedAt":65,"pagename":"Homepage","time":1234567,"token":"abc","url":"http://www.example.com"}}]`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+expectedPayload+" got: %s", api.Payload)
+	}
+}
+
+func TestProductionRequest(t *testing.T) {
+	os.Setenv("MIXPANEL_API_KEY", "secret")
+	var path, query, user, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		query = r.URL.RawQuery
+		user, _, _ = r.BasicAuth()
+		contentType = r.Header.Get("Content-Type")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Write([]byte(`{"status": 1, "error": null}`))
+	}))
+	defer server.Close()
+
+	api := mixpanelAPIProduction{baseUrl: server.URL + "/"}
+	err := api.request("POST", "import", []byte(`[{"event":"account.created"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/import" || query != "verbose=1" {
+		t.Errorf("Expected request to /import?verbose=1, was: %v?%v", path, query)
+	}
+	if user != "secret" {
+		t.Errorf("Expected the import to be authenticated with the api key, was: %v", user)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Expected JSON content type, was: %v", contentType)
+	}
+	if body != `[{"event":"account.created"}]` {
+		t.Errorf("Unexpected body: %v", body)
+	}
+}
+
+func TestProductionRequestWhenMixpanelRejects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": 0, "error": "data, missing or empty"}`))
+	}))
+	defer server.Close()
+
+	api := mixpanelAPIProduction{baseUrl: server.URL + "/"}
+	err := api.request("POST", "track", []byte(`[]`))
+	if err == nil || err.Error() != "Mixpanel API returned errors: data, missing or empty" {
+		t.Errorf("Expected Mixpanel error, got: %v", err)
+	}
+	if kind := integrations.Kind(err); kind != integrations.ErrorPermanent {
+		t.Errorf("Expected the invalid data to be a permanent error, got %s", kind)
+	}
+}
+
+func TestProductionRequestWhenHTTPError(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		body       string
+		kind       integrations.ErrorKind
+	}{
+		{400, `Invalid data`, integrations.ErrorPermanent},
+		{401, `Invalid API secret`, integrations.ErrorAuth},
+		{429, `Too many requests`, integrations.ErrorRateLimited},
+		{503, `Service unavailable`, integrations.ErrorRetryable},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(test.statusCode)
+			w.Write([]byte(test.body))
+		}))
+		api := mixpanelAPIProduction{baseUrl: server.URL + "/"}
+
+		err := api.request("POST", "import", []byte(`[]`))
+		server.Close()
+
+		expected := fmt.Sprintf("Mixpanel API returned HTTP status %d: %s", test.statusCode, test.body)
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected HTTP error %q, got: %v", expected, err)
+		}
+		if kind := integrations.Kind(err); kind != test.kind {
+			t.Errorf("Expected HTTP status %d to be %s, got %s", test.statusCode, test.kind, kind)
+		}
+		if test.kind == integrations.ErrorRateLimited && integrations.RetryAfter(err) != 10*time.Second {
+			t.Errorf("Expected to retry after 10s, got %v", integrations.RetryAfter(err))
+		}
+	}
+}
+
+type APIMock struct {
+	Method   string
+	Endpoint string
+	Payload  []byte
+}
+
+func (api *APIMock) request(method string, endpoint string, payload []byte) error {
+	api.Method = method
+	api.Endpoint = endpoint
+	api.Payload = payload
+	return nil
+}
+
+func TestAlias(t *testing.T) {
+	os.Setenv("MIXPANEL_TOKEN", "abc")
+	mixpanel := Mixpanel{}
+	api := APIMock{}
+	mixpanel.api = &api
+	alias := integrations.Alias{
+		PreviousID: "anonymous-456",
+		UserID:     "123",
+		Timestamp:  1234567,
+	}
+
+	err := mixpanel.Alias(alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if api.Endpoint != "track" {
+		t.Errorf("Expected endpoint to be track, was: %v", api.Endpoint)
+	}
+
+	expectedPayload := `[{"event":"$create_alias","properties":{"alias":"123","distinct_id":"anonymous-456","token":"abc"}}]`
+	if string(api.Payload) != expectedPayload {
+		t.Errorf("Expected payload: "+expectedPayload+" got: %s", api.Payload)
+	}
+}
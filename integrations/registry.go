@@ -11,9 +11,130 @@ import (
 var integrationsMu sync.Mutex
 var integrations = make(map[string]Integration)
 
-// RegisterIntegration registers a integration so it can be created from its name. Integrations should
-// call this from an init() function so that they registers themselvse on
-// import
+// Factory creates an instance of an integration. The instance reads its
+// settings with GetSetting, using the name it's given.
+type Factory func(name string) Integration
+
+var factories = make(map[string]Factory)
+
+// instantiated holds the names of the instances created by Configure, to
+// replace them on the next call
+var instantiated []string
+
+// retired holds the instances Configure removed, until they're drained. They
+// can still be retrieved by name, to deliver the messages they were given, but
+// don't get new ones.
+var retired = make(map[string]Integration)
+
+// RegisterFactory registers an integration type so it can be instantiated by
+// Configure, possibly several times with different names and settings.
+// Integrations should call this from an init() function so that they registers
+// themselves on import
+func RegisterFactory(typeName string, factory Factory) {
+	integrationsMu.Lock()
+	defer integrationsMu.Unlock()
+	if factory == nil {
+		panic("integration: RegisterFactory factory is nil")
+	}
+	if _, dup := factories[typeName]; dup {
+		panic("integration: RegisterFactory called twice for " + typeName)
+	}
+	factories[typeName] = factory
+}
+
+// InstanceType returns the type of the instance configured with values: its
+// "type" setting, or its name when not set.
+func InstanceType(name string, values map[string]string) string {
+	if typeName := values[TypeSetting]; typeName != "" {
+		return typeName
+	}
+	return name
+}
+
+// instantiate creates the instances from the factories: one per configured
+// instance, or one per type named after it when values is nil.
+func instantiate(values map[string]map[string]string) map[string]Integration {
+	integrationsMu.Lock()
+	registered := make(map[string]Factory, len(factories))
+	for typeName, factory := range factories {
+		registered[typeName] = factory
+	}
+	integrationsMu.Unlock()
+
+	if values == nil {
+		values = make(map[string]map[string]string, len(registered))
+		for typeName := range registered {
+			values[typeName] = nil
+		}
+	}
+	created := make(map[string]Integration, len(values))
+	for name, instanceValues := range values {
+		typeName := InstanceType(name, instanceValues)
+		factory, ok := registered[typeName]
+		if !ok {
+			logrus.WithField("integration", name).WithField("type", typeName).Error("Unknown integration type")
+			continue
+		}
+		created[name] = factory(name)
+	}
+	return created
+}
+
+// swap replaces the instances created by the previous call to Configure with
+// the new ones, at once. The names of the previous instances missing from the
+// new ones are returned, sorted, and they're kept as retired. The caller holds
+// integrationsMu.
+func swap(created map[string]Integration) (removed []string) {
+	active := make(map[string]Integration, len(integrations))
+	for name, integration := range integrations {
+		active[name] = integration
+	}
+	for _, name := range instantiated {
+		if _, ok := created[name]; !ok {
+			retired[name] = active[name]
+			removed = append(removed, name)
+		}
+		delete(active, name)
+	}
+
+	instantiated = nil
+	for name, integration := range created {
+		active[name] = integration
+		instantiated = append(instantiated, name)
+		delete(retired, name)
+	}
+	integrations = active
+	sort.Strings(removed)
+	return
+}
+
+// Drained forgets an instance retired by Configure, once it delivered the
+// messages it was given
+func Drained(name string) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	integrationsMu.Lock()
+	defer integrationsMu.Unlock()
+	delete(retired, name)
+	delete(retainedSettings, name)
+}
+
+// RetiredList returns a sorted list of the names of the instances retired by
+// Configure and not drained yet
+func RetiredList() []string {
+	integrationsMu.Lock()
+	defer integrationsMu.Unlock()
+	list := make([]string, 0, len(retired))
+	for name := range retired {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// RegisterIntegration registers a single instance of an integration under
+// that name. Most integrations register a factory instead, see
+// RegisterFactory.
 func RegisterIntegration(name string, integration Integration) {
 	integrationsMu.Lock()
 	defer integrationsMu.Unlock()
@@ -26,12 +147,35 @@ func RegisterIntegration(name string, integration Integration) {
 	integrations[name] = integration
 }
 
-// GetIntegration retrieves a registered integration by name
+// GetIntegration retrieves a registered integration by name, including the
+// retired ones that are not drained yet
 func GetIntegration(name string) Integration {
 	integrationsMu.Lock()
 	defer integrationsMu.Unlock()
-	integration := integrations[name]
-	return integration
+	if integration, ok := integrations[name]; ok {
+		return integration
+	}
+	return retired[name]
+}
+
+// Instance is a registered integration, along with its name
+type Instance struct {
+	Name        string
+	Integration Integration
+}
+
+// Instances returns the registered integrations, sorted by name. Unlike
+// calling GetIntegration for each name of IntegrationList, they're all from
+// the same configuration when it's being reloaded.
+func Instances() []Instance {
+	integrationsMu.Lock()
+	defer integrationsMu.Unlock()
+	instances := make([]Instance, 0, len(integrations))
+	for name, integration := range integrations {
+		instances = append(instances, Instance{Name: name, Integration: integration})
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances
 }
 
 // IntegrationList returns a sorted list of the names of the registered integrations.
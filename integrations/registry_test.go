@@ -0,0 +1,105 @@
+package integrations
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type settingsIntegration struct {
+	name string
+}
+
+func (i settingsIntegration) Identify(identification Identification) error { return nil }
+func (i settingsIntegration) Track(event Event) error                      { return nil }
+func (i settingsIntegration) Page(page Page) error                         { return nil }
+func (i settingsIntegration) Enabled() bool {
+	return GetSetting(i.name, "apiKey") != ""
+}
+
+// registerFactories registers the factories of the tests once, whatever the
+// number of runs
+var registerFactories sync.Once
+
+func registerTestFactories() {
+	registerFactories.Do(func() {
+		for _, integrationType := range []string{"test-only-integration-factory", "test-only-integration-retiring"} {
+			RegisterFactory(integrationType, func(name string) Integration {
+				return settingsIntegration{name: name}
+			})
+		}
+	})
+}
+
+func TestConfigureCreatesNamedInstances(t *testing.T) {
+	RegisterSettings("test-only-integration-factory", []Setting{
+		{Name: "apiKey", Env: "TEST_ONLY_FACTORY_API_KEY", Required: true},
+	})
+	registerTestFactories()
+	defer Configure(nil)
+
+	Configure(map[string]map[string]string{
+		"test-only-integration-eu": {"type": "test-only-integration-factory", "apiKey": "eu-key"},
+		"test-only-integration-us": {"type": "test-only-integration-factory", "apiKey": "us-key"},
+	})
+
+	expected := []string{"test-only-integration-eu", "test-only-integration-us"}
+	if list := IntegrationList(); !reflect.DeepEqual(list, expected) {
+		t.Errorf("Expected the instances %v, got %v", expected, list)
+	}
+	eu := GetIntegration("test-only-integration-eu").(settingsIntegration)
+	if eu.name != "test-only-integration-eu" || GetSetting(eu.name, "apiKey") != "eu-key" {
+		t.Errorf("Wrong settings for %v", eu.name)
+	}
+	if GetSetting("test-only-integration-us", "apiKey") != "us-key" {
+		t.Error("Wrong settings for test-only-integration-us")
+	}
+
+	// Instances no longer configured are removed
+	Configure(map[string]map[string]string{
+		"test-only-integration-factory": {"apiKey": "key"},
+	})
+	expected = []string{"test-only-integration-factory"}
+	if list := IntegrationList(); !reflect.DeepEqual(list, expected) {
+		t.Errorf("Expected the instances %v, got %v", expected, list)
+	}
+}
+
+func TestConfigureRetiresRemovedInstances(t *testing.T) {
+	RegisterSettings("test-only-integration-retiring", []Setting{
+		{Name: "apiKey", Env: "TEST_ONLY_RETIRING_API_KEY", Required: true},
+	})
+	registerTestFactories()
+	defer Configure(nil)
+
+	Configure(map[string]map[string]string{
+		"test-only-integration-a": {"type": "test-only-integration-retiring", "apiKey": "a-key"},
+		"test-only-integration-b": {"type": "test-only-integration-retiring", "apiKey": "b-key"},
+	})
+	removed := Configure(map[string]map[string]string{
+		"test-only-integration-b": {"type": "test-only-integration-retiring", "apiKey": "new-b-key"},
+	})
+
+	if !reflect.DeepEqual(removed, []string{"test-only-integration-a"}) {
+		t.Errorf("Expected test-only-integration-a to be removed, got %v", removed)
+	}
+	if list := IntegrationList(); !reflect.DeepEqual(list, []string{"test-only-integration-b"}) {
+		t.Errorf("Removed instances should not get new messages, got %v", list)
+	}
+	if GetIntegration("test-only-integration-a") == nil || GetSetting("test-only-integration-a", "apiKey") != "a-key" {
+		t.Error("Removed instances should be kept with their settings until drained")
+	}
+	if GetSetting("test-only-integration-b", "apiKey") != "new-b-key" {
+		t.Error("Kept instances should get their new settings")
+	}
+
+	Drained("test-only-integration-a")
+	if GetIntegration("test-only-integration-a") != nil {
+		t.Error("Drained instances should be forgotten")
+	}
+	for _, name := range RetiredList() {
+		if name == "test-only-integration-a" {
+			t.Error("Drained instances should not be listed as retired")
+		}
+	}
+}
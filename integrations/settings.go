@@ -0,0 +1,143 @@
+package integrations
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// TypeSetting is the setting holding the type of an instance, when its name is
+// not the name of the integration (e.g. intercom-eu of type intercom)
+const TypeSetting = "type"
+
+// Setting declares a configuration value of an integration, like its API key
+type Setting struct {
+	// Name of the setting in the configuration file (e.g. apiKey)
+	Name string
+
+	// Env is the environment variable holding the setting when there is no
+	// configuration file
+	Env string
+
+	// Required settings need to be set for the integration to work
+	Required bool
+}
+
+var (
+	settingsMu sync.RWMutex
+	// declared settings, per integration
+	settings = make(map[string][]Setting)
+	// values from the configuration file, nil when using the environment
+	configured map[string]map[string]string
+	// values of the retired instances, kept until they're drained
+	retainedSettings = make(map[string]map[string]string)
+)
+
+// RegisterSettings declares the settings of an integration type, so they can
+// be read with GetSetting and validated in the configuration file.
+// Integrations call it in their init(), along with RegisterFactory.
+func RegisterSettings(integrationName string, declared []Setting) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings[integrationName] = declared
+}
+
+// Settings returns the settings declared by the integration type, nil when it
+// declared none.
+func Settings(integrationName string) []Setting {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return settings[integrationName]
+}
+
+// SettingsList returns the integration types that declared settings, sorted
+// alphabetically
+func SettingsList() []string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Configure sets the values of the settings, per instance, as read from the
+// configuration file, and creates the instances from the registered
+// factories. A nil values goes back to the environment variables, with a
+// single instance of each integration, named after it.
+//
+// It can be called again to reload the configuration: the instances are
+// replaced at once, and the names of the ones removed are returned. Those keep
+// their settings and can still be retrieved with GetIntegration, until
+// Drained is called.
+func Configure(values map[string]map[string]string) (removed []string) {
+	created := instantiate(values)
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	integrationsMu.Lock()
+	defer integrationsMu.Unlock()
+
+	previous := configured
+	if values == nil {
+		configured = nil
+	} else {
+		configured = make(map[string]map[string]string, len(values))
+		for name, integrationValues := range values {
+			configured[name] = copySettings(integrationValues)
+		}
+	}
+
+	removed = swap(created)
+	for _, name := range removed {
+		retainedSettings[name] = currentSettings(previous, name)
+	}
+	for name := range created {
+		delete(retainedSettings, name)
+	}
+	return
+}
+
+// currentSettings returns the values of the settings of the instance, from
+// configured values or from the environment. The caller holds settingsMu.
+func currentSettings(values map[string]map[string]string, name string) map[string]string {
+	if values != nil {
+		return copySettings(values[name])
+	}
+	current := make(map[string]string)
+	for _, setting := range settings[name] {
+		current[setting.Name] = os.Getenv(setting.Env)
+	}
+	return current
+}
+
+func copySettings(values map[string]string) map[string]string {
+	copied := make(map[string]string, len(values))
+	for k, v := range values {
+		copied[k] = v
+	}
+	return copied
+}
+
+// GetSetting returns the value of a setting of the integration instance. It
+// comes from the configuration file when there is one, and from the
+// environment variable of the setting otherwise, the instance being named
+// after its integration. Retired instances keep the values they had.
+func GetSetting(integrationName string, name string) string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if retained, ok := retainedSettings[integrationName]; ok {
+		return retained[name]
+	}
+	if configured != nil {
+		return configured[integrationName][name]
+	}
+	for _, setting := range settings[integrationName] {
+		if setting.Name == name {
+			return os.Getenv(setting.Env)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package integrations
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetSetting(t *testing.T) {
+	RegisterSettings("test-only-integration-settings", []Setting{
+		{Name: "apiKey", Env: "TEST_ONLY_SETTINGS_API_KEY", Required: true},
+	})
+	os.Setenv("TEST_ONLY_SETTINGS_API_KEY", "from-env")
+	defer os.Unsetenv("TEST_ONLY_SETTINGS_API_KEY")
+
+	if value := GetSetting("test-only-integration-settings", "apiKey"); value != "from-env" {
+		t.Errorf("Expected the environment variable without configuration, got %q", value)
+	}
+
+	Configure(map[string]map[string]string{
+		"test-only-integration-settings": {"apiKey": "from-config"},
+	})
+	defer Configure(nil)
+	if value := GetSetting("test-only-integration-settings", "apiKey"); value != "from-config" {
+		t.Errorf("Expected the configured value, got %q", value)
+	}
+	if value := GetSetting("test-only-integration-other", "apiKey"); value != "" {
+		t.Errorf("Integrations missing from the configuration should have no settings, got %q", value)
+	}
+}
@@ -3,30 +3,139 @@ package main
 import (
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/config"
+	"github.com/jipiboily/forwardlytics/deadletter"
+	"github.com/jipiboily/forwardlytics/dedup"
+	"github.com/jipiboily/forwardlytics/delivery"
 	"github.com/jipiboily/forwardlytics/handlers"
+	"github.com/jipiboily/forwardlytics/integrations"
 	_ "github.com/jipiboily/forwardlytics/integrations/drift"
 	_ "github.com/jipiboily/forwardlytics/integrations/drip"
 	_ "github.com/jipiboily/forwardlytics/integrations/intercom"
 	_ "github.com/jipiboily/forwardlytics/integrations/mixpanel"
+	"github.com/jipiboily/forwardlytics/queue"
+	"github.com/jipiboily/forwardlytics/sources"
 
 	_ "github.com/jipiboily/forwardlytics/errortracker"
 )
 
 func main() {
-	if os.Getenv("FORWARDLYTICS_API_KEY") == "" {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Error loading the configuration")
+	}
+	// Only the API needs a key, commands like replay don't
+	if sources.Len() == 0 {
 		logrus.Fatal("You need to set FORWARDLYTICS_API_KEY")
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+	if cfg.DeadLetterDir != "" {
+		store, err := deadletter.Open(cfg.DeadLetterDir)
+		if err != nil {
+			logrus.WithField("err", err).Fatal("Error opening the dead letters")
+		}
+		delivery.DeadLetters = store
+	}
+
+	handlers.Dedup = dedupWindow(cfg.Dedup)
+
+	if cfg.Queue.Dir != "" {
+		q, err := queue.Open(cfg.Queue.Dir)
+		if err != nil {
+			logrus.WithField("err", err).Fatal("Error opening the queue")
+		}
+		handlers.Queue = q
+		delivery.Work(q, cfg.Queue.Workers)
+		logrus.Infof("Queueing messages in %v, %v pending", cfg.Queue.Dir, q.Len())
+	}
+
+	handlers.SignatureSkew, err = time.ParseDuration(cfg.SignatureSkew)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Invalid signatureSkew")
+	}
+	handlers.PixelMaxAge, err = time.ParseDuration(cfg.PixelMaxAge)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Invalid pixelMaxAge")
+	}
+	handlers.TrustedProxies, err = cfg.TrustedProxyList()
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Invalid trustedProxies")
+	}
+
+	reloadOnSignal(cfg)
+
+	http.Handle("/identify", authenticated(handlers.Identify))
+	http.Handle("/track", handlers.PublicMiddleware(integrations.TypeTrack, authenticated(handlers.Track)))
+	http.Handle("/page", handlers.PublicMiddleware(integrations.TypePage, authenticated(handlers.Page)))
+	http.Handle("/alias", authenticated(handlers.Alias))
+	http.Handle("/group", authenticated(handlers.Group))
+	http.Handle("/batch", authenticated(handlers.Batch))
+	http.HandleFunc("/pixel.gif", handlers.Pixel)
+	http.Handle("/v1/", handlers.SegmentAuthMiddleware(http.HandlerFunc(handlers.Segment)))
+	http.Handle("/dead-letters", admin(handlers.DeadLetters))
+	http.Handle("/dead-letters/", admin(handlers.DeadLetters))
+	http.Handle("/admin/reload", admin(handlers.Reload))
+	http.Handle("/admin/metrics", admin(handlers.Metrics))
+	http.Handle("/admin/breakers", admin(handlers.Breakers))
+	logrus.Infof("Forwardlytics started on port %v", cfg.Port)
+	logrus.Fatal(http.ListenAndServe(":"+cfg.Port, nil))
+}
+
+// loadConfig reads the configuration file, or the environment variables when
+// there is none, and configures the integrations, sources, retries and
+// delivery with it
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		return nil, err
+	}
+	list, err := cfg.SourceList()
+	if err != nil {
+		return nil, err
 	}
+	if err = delivery.Configure(cfg.Delivery); err != nil {
+		return nil, err
+	}
+	integrations.Configure(cfg.Integrations)
+	sources.Configure(list)
+	delivery.Retries = cfg.Retries
+	return cfg, nil
+}
 
-	http.Handle("/identify", handlers.AuthMiddleware(http.HandlerFunc(handlers.Identify)))
-	http.Handle("/track", handlers.AuthMiddleware(http.HandlerFunc(handlers.Track)))
-	http.Handle("/page", handlers.AuthMiddleware(http.HandlerFunc(handlers.Page)))
-	logrus.Infof("Forwardlytics started on port %v", port)
-	logrus.Fatal(http.ListenAndServe(":"+port, nil))
+// authenticated only lets the requests with a valid API key or signature
+// through
+func authenticated(handler http.HandlerFunc) http.Handler {
+	return handlers.SignatureMiddleware(handlers.AuthMiddleware(handler))
+}
+
+// admin only lets the requests of the default source through
+func admin(handler http.HandlerFunc) http.Handler {
+	return handlers.SignatureMiddleware(handlers.AdminMiddleware(handler))
+}
+
+// dedupWindow remembers the IDs of the messages received recently, on disk
+// when a directory is configured
+func dedupWindow(cfg config.Dedup) *dedup.Window {
+	ttl, err := time.ParseDuration(cfg.Window)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Invalid dedup window")
+	}
+	if cfg.Dir == "" {
+		return dedup.New(cfg.Size, ttl)
+	}
+	window, err := dedup.Open(cfg.Dir, cfg.Size, ttl)
+	if err != nil {
+		logrus.WithField("err", err).Fatal("Error opening the dedup window")
+	}
+	return window
 }
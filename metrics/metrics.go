@@ -0,0 +1,47 @@
+package metrics
+
+import "sync"
+
+var (
+	countersMu sync.Mutex
+	counters   = make(map[string]map[string]int64)
+)
+
+// Add adds n to the counter with that name and label, like the number of
+// rate limited requests of a source
+func Add(name string, label string, n int64) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	if counters[name] == nil {
+		counters[name] = make(map[string]int64)
+	}
+	counters[name][label] += n
+}
+
+// Get returns the value of the counter with that name and label
+func Get(name string, label string) int64 {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	return counters[name][label]
+}
+
+// Snapshot returns a copy of all the counters, by name and label
+func Snapshot() map[string]map[string]int64 {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	snapshot := make(map[string]map[string]int64, len(counters))
+	for name, labels := range counters {
+		snapshot[name] = make(map[string]int64, len(labels))
+		for label, value := range labels {
+			snapshot[name][label] = value
+		}
+	}
+	return snapshot
+}
+
+// Reset sets every counter back to zero. It's meant for tests.
+func Reset() {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	counters = make(map[string]map[string]int64)
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	defer Reset()
+	Add("test.requests", "web", 1)
+	Add("test.requests", "web", 2)
+	Add("test.requests", "mobile", 1)
+
+	if got := Get("test.requests", "web"); got != 3 {
+		t.Errorf("Expected 3 requests from web, got %d", got)
+	}
+
+	snapshot := Snapshot()
+	expected := map[string]int64{"web": 3, "mobile": 1}
+	if !reflect.DeepEqual(snapshot["test.requests"], expected) {
+		t.Errorf("Expected %v, got %v", expected, snapshot["test.requests"])
+	}
+
+	// The snapshot is a copy
+	snapshot["test.requests"]["web"] = 0
+	if got := Get("test.requests", "web"); got != 3 {
+		t.Errorf("Changing the snapshot shouldn't change the counter, got %d", got)
+	}
+}
@@ -0,0 +1,457 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+// ErrClosed is returned when using a queue that was closed
+var ErrClosed = errors.New("queue: closed")
+
+const logName = "queue.log"
+
+// Largest record we accept when reading the log back, in bytes.
+const maxRecordSize = 16 * 1024 * 1024
+
+// compactAfter is how many records the log holds before it's compacted while
+// running, once most of them are not needed anymore
+var compactAfter = 1000
+
+// Queue is a durable, append-only log of the messages accepted by the API.
+// A message is written and synced to disk before Enqueue returns, and stays in
+// the log until every one of its destinations acknowledged it, so that
+// restarting the process never loses a message.
+type Queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dir     string
+	file    *os.File
+	entries map[string]*Entry
+	// IDs of the entries waiting to be picked up by a worker, oldest first
+	ready []string
+	// IDs of the entries, oldest first, including some that were acknowledged
+	// since the log was last compacted
+	order []string
+	// records counts the records in the log
+	records int
+	closed  bool
+}
+
+// Entry is a message waiting in the queue, along with the integrations it
+// still needs to be delivered to.
+type Entry struct {
+	ID           string               `json:"id"`
+	Message      integrations.Message `json:"message"`
+	Destinations []string             `json:"destinations"`
+	EnqueuedAt   int64                `json:"enqueuedAt"`
+	// Starts counts the deliveries to each destination that were started and
+	// never acknowledged, like when the process crashed during them
+	Starts map[string]int `json:"starts,omitempty"`
+}
+
+// record is a single line of the log
+type record struct {
+	Op          string `json:"op"`
+	Entry       *Entry `json:"entry,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Integration string `json:"integration,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+const (
+	opEnqueue = "enqueue"
+	opStart    = "start"
+	opPostpone = "postpone"
+	opAck      = "ack"
+)
+
+// Open loads the queue stored in dir, creating it if needed. Entries that were
+// not fully acknowledged before the last shutdown are ready to be delivered
+// again.
+func Open(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{dir: dir, entries: make(map[string]*Entry)}
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	file, err := q.compact()
+	if err != nil {
+		return nil, err
+	}
+	q.file = file
+	return q, nil
+}
+
+// Enqueue durably stores the message for delivery to the destinations and
+// returns the ID of the new entry.
+func (q *Queue) Enqueue(message integrations.Message, destinations []string) (id string, err error) {
+	id, err = integrations.NewID()
+	if err != nil {
+		return
+	}
+	entry := &Entry{
+		ID:           id,
+		Message:      message,
+		Destinations: destinations,
+		EnqueuedAt:   time.Now().Unix(),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return "", ErrClosed
+	}
+	if len(destinations) == 0 {
+		// Nothing to deliver, no need to keep it around.
+		return
+	}
+	if err = q.write(record{Op: opEnqueue, Entry: entry}); err != nil {
+		return "", err
+	}
+	q.entries[id] = entry
+	q.ready = append(q.ready, id)
+	q.order = append(q.order, id)
+	q.cond.Signal()
+	return
+}
+
+// Next blocks until an entry is ready to be delivered, and returns it. The
+// boolean is false once the queue is closed.
+func (q *Queue) Next() (Entry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.ready) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return Entry{}, false
+	}
+	id := q.ready[0]
+	q.ready = q.ready[1:]
+	entry := *q.entries[id]
+	entry.Destinations = append([]string(nil), entry.Destinations...)
+	if entry.Starts != nil {
+		starts := make(map[string]int, len(entry.Starts))
+		for integration, count := range entry.Starts {
+			starts[integration] = count
+		}
+		entry.Starts = starts
+	}
+	return entry, true
+}
+
+// Start records that the delivery of the entry to the integration started.
+// Until it's acknowledged, the start is counted in the Starts of the entry,
+// even after a restart, so that an entry crashing the process every time can
+// be told apart.
+func (q *Queue) Start(id string, integration string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	entry, ok := q.entries[id]
+	if !ok {
+		return nil
+	}
+	// Not synced, it only has to survive the process, which the page cache
+	// does
+	line, err := json.Marshal(record{Op: opStart, ID: id, Integration: integration})
+	if err != nil {
+		return err
+	}
+	if _, err = q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	entry.start(integration)
+	return nil
+}
+
+// Postpone records that the delivery of the entry to the integration stopped
+// before calling it, to be started again later, like when the integration
+// asked to wait. It no longer counts as started.
+func (q *Queue) Postpone(id string, integration string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	entry, ok := q.entries[id]
+	if !ok || entry.Starts[integration] == 0 {
+		return nil
+	}
+	// Not synced either, losing it only counts one more start
+	line, err := json.Marshal(record{Op: opPostpone, ID: id, Integration: integration})
+	if err != nil {
+		return err
+	}
+	if _, err = q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	entry.postpone(integration)
+	return nil
+}
+
+// Ack records that the integration is done with the entry, along with the
+// resulting delivery status. The entry is dropped from the queue once all of
+// its destinations acknowledged it.
+func (q *Queue) Ack(id string, integration string, status string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	entry, ok := q.entries[id]
+	if !ok {
+		return nil
+	}
+	if err := q.write(record{Op: opAck, ID: id, Integration: integration, Status: status}); err != nil {
+		return err
+	}
+	entry.ack(integration)
+	if len(entry.Destinations) == 0 {
+		delete(q.entries, id)
+	}
+
+	// Everything was delivered, so the log can start over.
+	if len(q.entries) == 0 {
+		if err := q.file.Truncate(0); err != nil {
+			return err
+		}
+		q.order = q.order[:0]
+		q.records = 0
+		return q.file.Sync()
+	}
+	// Some entries are always pending under steady traffic, or while an
+	// integration is down, so the log is compacted without waiting for it
+	// to be empty
+	if q.records >= compactAfter && q.records > 2*len(q.entries) {
+		file, err := q.compact()
+		if err != nil {
+			return err
+		}
+		q.file.Close()
+		q.file = file
+	}
+	return nil
+}
+
+// Len returns the number of entries still waiting for at least one
+// integration.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Pending returns the number of entries still waiting for the integration,
+// including the ones being delivered.
+func (q *Queue) Pending(integration string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := 0
+	for _, entry := range q.entries {
+		for _, destination := range entry.Destinations {
+			if destination == integration {
+				pending++
+				break
+			}
+		}
+	}
+	return pending
+}
+
+// Close stops the queue. Workers waiting on Next are released.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	return q.file.Close()
+}
+
+func (q *Queue) path() string {
+	return filepath.Join(q.dir, logName)
+}
+
+// write appends the record to the log and waits for it to hit the disk
+func (q *Queue) write(r record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = q.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	return q.file.Sync()
+}
+
+// load replays the log to rebuild the pending entries
+func (q *Queue) load() error {
+	file, err := os.Open(q.path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// Most likely a record that was being written when the process
+			// died, it was never acknowledged to the client.
+			logrus.WithError(err).WithField("record", scanner.Text()).Warn("Skipping unreadable record in the queue log")
+			continue
+		}
+		switch r.Op {
+		case opEnqueue:
+			if r.Entry == nil {
+				continue
+			}
+			q.entries[r.Entry.ID] = r.Entry
+			q.ready = append(q.ready, r.Entry.ID)
+			q.order = append(q.order, r.Entry.ID)
+		case opStart:
+			if entry, ok := q.entries[r.ID]; ok {
+				entry.start(r.Integration)
+			}
+		case opPostpone:
+			if entry, ok := q.entries[r.ID]; ok {
+				entry.postpone(r.Integration)
+			}
+		case opAck:
+			entry, ok := q.entries[r.ID]
+			if !ok {
+				continue
+			}
+			entry.ack(r.Integration)
+			if len(entry.Destinations) == 0 {
+				delete(q.entries, r.ID)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ready := q.ready[:0]
+	for _, id := range q.ready {
+		if _, ok := q.entries[id]; ok {
+			ready = append(ready, id)
+		}
+	}
+	q.ready = ready
+	return nil
+}
+
+// compact rewrites the log so it only holds the pending entries, in the order
+// they were enqueued, and returns it open for the next records
+func (q *Queue) compact() (*os.File, error) {
+	tmpPath := q.path() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	order := make([]string, 0, len(q.entries))
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, id := range q.order {
+		entry, ok := q.entries[id]
+		if !ok {
+			continue
+		}
+		if err = encoder.Encode(record{Op: opEnqueue, Entry: entry}); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+		order = append(order, id)
+	}
+	if err = writer.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, q.path()); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = syncDir(q.dir); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	q.order = order
+	q.records = len(order)
+	return tmp, nil
+}
+
+// syncDir makes sure a rename in the directory is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (e *Entry) start(integration string) {
+	if e.Starts == nil {
+		e.Starts = make(map[string]int)
+	}
+	e.Starts[integration]++
+}
+
+func (e *Entry) postpone(integration string) {
+	if e.Starts[integration]--; e.Starts[integration] <= 0 {
+		delete(e.Starts, integration)
+	}
+	if len(e.Starts) == 0 {
+		e.Starts = nil
+	}
+}
+
+// ack removes the integration from the destinations still waiting for the
+// entry
+func (e *Entry) ack(integration string) {
+	e.Destinations = remove(e.Destinations, integration)
+	delete(e.Starts, integration)
+	if len(e.Starts) == 0 {
+		e.Starts = nil
+	}
+}
+
+func remove(list []string, value string) []string {
+	kept := list[:0]
+	for _, v := range list {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,292 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "forwardlytics-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testMessage() integrations.Message {
+	return integrations.Message{
+		Type: integrations.TypeTrack,
+		Event: &integrations.Event{
+			Name:      "account.created",
+			UserID:    "123",
+			Timestamp: 1234567,
+		},
+	}
+}
+
+func TestEnqueueAndNext(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	id, err := q.Enqueue(testMessage(), []string{"drip", "intercom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok := q.Next()
+	if !ok {
+		t.Fatal("Expected an entry to be ready")
+	}
+	if entry.ID != id {
+		t.Errorf("Expected entry %v, got %v", id, entry.ID)
+	}
+	if entry.Message.Event.Name != "account.created" {
+		t.Errorf("Expected the event to be account.created, was: %v", entry.Message.Event.Name)
+	}
+	if len(entry.Destinations) != 2 {
+		t.Errorf("Expected 2 destinations, got %v", entry.Destinations)
+	}
+}
+
+func TestEnqueueWithoutDestinations(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	_, err = q.Enqueue(testMessage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("Expected nothing to be queued, queue length is %v", q.Len())
+	}
+}
+
+func TestPendingEntriesSurviveRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered, err := q.Enqueue(testMessage(), []string{"drip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := q.Enqueue(testMessage(), []string{"drip", "intercom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Ack(delivered, "drip", "accepted"); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Ack(pending, "drip", "accepted"); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if q.Len() != 1 {
+		t.Fatalf("Expected 1 pending entry after restart, got %v", q.Len())
+	}
+	entry, _ := q.Next()
+	if entry.ID != pending {
+		t.Errorf("Expected entry %v to be pending, got %v", pending, entry.ID)
+	}
+	if len(entry.Destinations) != 1 || entry.Destinations[0] != "intercom" {
+		t.Errorf("Expected only intercom to be left, got %v", entry.Destinations)
+	}
+}
+
+func TestUnacknowledgedStartsSurviveRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := q.Enqueue(testMessage(), []string{"drip", "intercom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, integration := range []string{"drip", "intercom", "drip", "drip"} {
+		if err = q.Start(id, integration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = q.Postpone(id, "drip"); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Ack(id, "intercom", "accepted"); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// Twice, the starts being compacted the first time
+	for i := 0; i < 2; i++ {
+		q, err = Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, _ := q.Next()
+		q.Close()
+		if len(entry.Starts) != 1 || entry.Starts["drip"] != 2 {
+			t.Errorf("Expected the 2 starts of drip that were not postponed to be counted, got %v", entry.Starts)
+		}
+	}
+}
+
+func TestLogIsCompactedWhileAnEntryStaysPending(t *testing.T) {
+	defer func(previous int) { compactAfter = previous }(compactAfter)
+	compactAfter = 10
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stuck, err := q.Enqueue(testMessage(), []string{"drip", "intercom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Ack(stuck, "intercom", "accepted"); err != nil {
+		t.Fatal(err)
+	}
+	var maxSize int64
+	for i := 0; i < 100; i++ {
+		id, err := q.Enqueue(testMessage(), []string{"drip"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Start(id, "drip"); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Ack(id, "drip", "accepted"); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(dir, logName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize {
+			maxSize = info.Size()
+		}
+	}
+	last, err := q.Enqueue(testMessage(), []string{"drip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each round writes 3 records, of at most 200 bytes
+	if maxSize > int64(compactAfter+3)*200 {
+		t.Errorf("Expected the log to stay under %d bytes, got %d", (compactAfter+3)*200, maxSize)
+	}
+	q.Close()
+
+	q, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() != 2 {
+		t.Fatalf("Expected 2 pending entries after restart, got %v", q.Len())
+	}
+	entry, _ := q.Next()
+	if entry.ID != stuck || len(entry.Destinations) != 1 || entry.Destinations[0] != "drip" {
+		t.Errorf("Expected entry %v to be pending for drip only, got %v for %v", stuck, entry.ID, entry.Destinations)
+	}
+	if entry, _ = q.Next(); entry.ID != last {
+		t.Errorf("Expected entry %v to be pending, got %v", last, entry.ID)
+	}
+}
+
+func TestOpenSkipsTruncatedRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Enqueue(testMessage(), []string{"drip"}); err != nil {
+		t.Fatal(err)
+	}
+	q.file.Write([]byte(`{"op":"enqueue","entry":{"id":"abc`))
+	q.Close()
+
+	q, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() != 1 {
+		t.Errorf("Expected 1 pending entry, got %v", q.Len())
+	}
+}
+
+func TestNextReturnsWhenClosed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.Next()
+		done <- ok
+	}()
+	q.Close()
+	if <-done {
+		t.Error("Next should not return an entry once closed")
+	}
+}
+
+func TestPending(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	id, err := q.Enqueue(testMessage(), []string{"drip", "intercom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Enqueue(testMessage(), []string{"drip"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Ack(id, "intercom", "accepted"); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := q.Pending("drip"); pending != 2 {
+		t.Errorf("Expected 2 messages pending for drip, got %v", pending)
+	}
+	if pending := q.Pending("intercom"); pending != 0 {
+		t.Errorf("Expected no message pending for intercom, got %v", pending)
+	}
+}
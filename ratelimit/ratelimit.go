@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the buckets that filled back up are removed, so
+// that keys seen once don't stay in memory
+const sweepInterval = time.Minute
+
+// Limiter is a token bucket per key: each key can make burst calls at once,
+// then rate calls per second on average.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// bucket holds the tokens a key has left, as of a given time
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// New returns a limiter allowing rate calls per second, and burst at once. A
+// burst lower than 1 is set to the rate, so that a key can make at least one
+// call.
+func New(rate float64, burst int) *Limiter {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   b,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the key, and tells if there was one.
+// When there wasn't, it returns how long until there is.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.tokens(b, now)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Len returns the number of keys the limiter tracks
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// tokens returns the tokens of the bucket at that time, refilled since it was
+// last used
+func (l *Limiter) tokens(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+}
+
+// sweep removes the full buckets, which are the same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if l.tokens(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
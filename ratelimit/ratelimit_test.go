@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Now()
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("web"); !ok {
+			t.Fatalf("Call %d should be allowed by the burst", i+1)
+		}
+	}
+	ok, wait := l.Allow("web")
+	if ok {
+		t.Fatal("The bucket should be empty after the burst")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for the next token, got %v", wait)
+	}
+	if ok, _ := l.Allow("mobile"); !ok {
+		t.Error("Each key should have its own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("web"); !ok {
+		t.Error("A token should be back after 500ms")
+	}
+	if ok, _ := l.Allow("web"); ok {
+		t.Error("Only one token should be back after 500ms")
+	}
+}
+
+func TestAllowRefillsUpToTheBurst(t *testing.T) {
+	now := time.Now()
+	l := New(10, 2)
+	l.now = func() time.Time { return now }
+	l.Allow("web")
+
+	now = now.Add(time.Hour)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("web"); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Expected the bucket to refill up to the burst of 2, got %d calls", allowed)
+	}
+}
+
+func TestNewWithoutBurst(t *testing.T) {
+	l := New(0.5, 0)
+	if ok, _ := l.Allow("web"); !ok {
+		t.Error("A rate below 1 should still allow one call")
+	}
+	if ok, _ := l.Allow("web"); ok {
+		t.Error("The burst should be a single call")
+	}
+}
+
+func TestSweepRemovesFullBuckets(t *testing.T) {
+	now := time.Now()
+	l := New(1, 1)
+	l.now = func() time.Time { return now }
+	l.Allow("web")
+	l.Allow("mobile")
+
+	now = now.Add(2 * sweepInterval)
+	l.Allow("mobile")
+	if l.Len() != 1 {
+		t.Errorf("Expected only the bucket in use to be kept, got %d", l.Len())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/config"
+	"github.com/jipiboily/forwardlytics/delivery"
+	"github.com/jipiboily/forwardlytics/handlers"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/sources"
+)
+
+// reloading makes sure a single reload happens at a time, and holds the
+// configuration the process started with, as only the integrations, sources
+// and delivery settings are reloaded
+var reloading struct {
+	sync.Mutex
+	started *config.Config
+}
+
+// reload reads the configuration again and swaps the integrations, sources
+// and delivery settings at once.
+// Messages already given to the removed ones are still delivered, as they're
+// drained in the background. Other settings only apply after a restart. The
+// current configuration is kept when the new one is invalid.
+func reload() error {
+	reloading.Lock()
+	defer reloading.Unlock()
+
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		logrus.WithField("err", err).Error("Invalid configuration, keeping the current one")
+		return err
+	}
+
+	list, err := cfg.SourceList()
+	if err == nil {
+		err = delivery.Configure(cfg.Delivery)
+	}
+	if err != nil {
+		logrus.WithField("err", err).Error("Invalid configuration, keeping the current one")
+		return err
+	}
+	removed := integrations.Configure(cfg.Integrations)
+	sources.Configure(list)
+	delivery.Drain(handlers.Queue, removed)
+	logrus.WithField("integrations", integrations.IntegrationList()).WithField("removed", removed).Info("Configuration reloaded")
+	if changed := restartNeeded(reloading.started, cfg); len(changed) != 0 {
+		logrus.WithField("settings", changed).Warn("Those settings changed, restart to apply them")
+	}
+	return nil
+}
+
+// restartNeeded returns the settings that can't be reloaded and changed
+// since the process started
+func restartNeeded(current *config.Config, cfg *config.Config) (changed []string) {
+	if current == nil {
+		return nil
+	}
+	settings := []struct {
+		name             string
+		current, updated interface{}
+	}{
+		{"port", current.Port, cfg.Port},
+		{"retries", current.Retries, cfg.Retries},
+		{"deadLetterDir", current.DeadLetterDir, cfg.DeadLetterDir},
+		{"queue", current.Queue, cfg.Queue},
+		{"dedup", current.Dedup, cfg.Dedup},
+		{"signatureSkew", current.SignatureSkew, cfg.SignatureSkew},
+		{"pixelMaxAge", current.PixelMaxAge, cfg.PixelMaxAge},
+		{"trustedProxies", current.TrustedProxies, cfg.TrustedProxies},
+	}
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.current, setting.updated) {
+			changed = append(changed, setting.name)
+		}
+	}
+	return
+}
+
+// reloadOnSignal reloads the configuration every time the process gets
+// SIGHUP. It returns right away.
+func reloadOnSignal(cfg *config.Config) {
+	reloading.Lock()
+	reloading.started = cfg
+	reloading.Unlock()
+	handlers.Reloader = reload
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			logrus.Info("Got SIGHUP, reloading the configuration")
+			reload()
+		}
+	}()
+}
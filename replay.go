@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/deadletter"
+	"github.com/jipiboily/forwardlytics/delivery"
+)
+
+const replayUsage = `Usage: forwardlytics replay [options]
+
+Sends the messages integrations failed to receive to them again, reading the
+dead letters from the deadLetterDir of the configuration, or DEAD_LETTER_DIR.
+Replayed messages are removed from the dead letters once accepted.
+
+Options:
+`
+
+// replay runs the replay subcommand and returns the exit code
+func replay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, replayUsage)
+		flags.PrintDefaults()
+	}
+	integration := flags.String("integration", "", "only the dead letters of this integration")
+	id := flags.String("id", "", "only the dead letter with this ID")
+	since := flags.String("since", "", "only the dead letters that failed at or after this time (unix timestamp or RFC 3339)")
+	until := flags.String("until", "", "only the dead letters that failed at or before this time (unix timestamp or RFC 3339)")
+	list := flags.Bool("list", false, "list the dead letters instead of replaying them")
+	inspect := flags.Bool("inspect", false, "print the dead letters, with their message, instead of replaying them")
+	discard := flags.Bool("discard", false, "discard the dead letters instead of replaying them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading the configuration:", err)
+		return 1
+	}
+	if cfg.DeadLetterDir == "" {
+		fmt.Fprintln(os.Stderr, "You need to set DEAD_LETTER_DIR")
+		return 1
+	}
+	store, err := deadletter.Open(cfg.DeadLetterDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the dead letters:", err)
+		return 1
+	}
+
+	filter := deadletter.Filter{Integration: *integration, ID: *id}
+	if filter.Since, err = deadletter.ParseTime(*since); err != nil {
+		fmt.Fprintln(os.Stderr, "-since:", err)
+		return 2
+	}
+	if filter.Until, err = deadletter.ParseTime(*until); err != nil {
+		fmt.Fprintln(os.Stderr, "-until:", err)
+		return 2
+	}
+
+	letters, err := store.List(filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing the dead letters:", err)
+		return 1
+	}
+
+	switch {
+	case *list:
+		for _, letter := range letters {
+			failedAt := time.Unix(letter.FailedAt, 0).UTC().Format(time.RFC3339)
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", letter.ID, letter.Integration, failedAt, letter.Message.Type, letter.Error)
+		}
+	case *inspect:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		for _, letter := range letters {
+			encoder.Encode(letter)
+		}
+	case *discard:
+		for _, letter := range letters {
+			if err := store.Remove(letter.Integration, letter.ID); err != nil {
+				fmt.Fprintf(os.Stderr, "Error discarding %s: %s\n", letter.ID, err)
+				return 1
+			}
+		}
+		fmt.Printf("Discarded %d dead letters\n", len(letters))
+	default:
+		failed := 0
+		for _, letter := range letters {
+			status := delivery.Replay(store, letter)
+			if status.Status != delivery.StatusAccepted {
+				failed++
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", letter.ID, letter.Integration, status.Status, status.Error)
+		}
+		fmt.Printf("Replayed %d dead letters, %d failed\n", len(letters), failed)
+		if failed > 0 {
+			return 1
+		}
+	}
+	return 0
+}
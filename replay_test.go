@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReplayWithoutAPIKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwardlytics-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, value := range map[string]string{"FORWARDLYTICS_CONFIG": "", "FORWARDLYTICS_API_KEY": "", "DEAD_LETTER_DIR": dir} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	if code := replay([]string{"-list"}); code != 0 {
+		t.Errorf("Expected the dead letters to be listed without an API key, got exit code %d", code)
+	}
+}
@@ -0,0 +1,448 @@
+package sources
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jipiboily/forwardlytics/integrations"
+	"github.com/jipiboily/forwardlytics/ratelimit"
+)
+
+// Default is the name of the source using the apiKey at the top of the
+// configuration, or FORWARDLYTICS_API_KEY
+const Default = "default"
+
+// Source is an application sending messages to Forwardlytics, with its own API
+// key, integrations and rules
+type Source struct {
+	// Name of the source, attached to every message it sends
+	Name string
+
+	// Keys the source calls the API with, several of them being valid at
+	// once while rotating them
+	Keys []Key
+
+	// RequireSignature only accepts requests signed with one of the keys,
+	// rather than holding it
+	RequireSignature bool
+
+	// Integrations are the instances receiving the messages of the source, all
+	// of them when empty
+	Integrations []string
+
+	// Rules transform the messages of the source, in order
+	Rules []Rule
+
+	// RateLimit limits how fast the source can call the API
+	RateLimit RateLimit
+
+	// Limiters of the requests by key, and of the messages by user, nil
+	// when unlimited
+	keyLimiter  *ratelimit.Limiter
+	userLimiter *ratelimit.Limiter
+}
+
+// RateLimit limits the requests of each key of a source, and optionally the
+// messages about each user, with token buckets
+type RateLimit struct {
+	// Rate is the number of requests per second each key can make, on
+	// average. Unlimited when 0.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the number of requests a key can make at once, Rate when 0
+	Burst int `yaml:"burst"`
+
+	// UserRate is the number of messages per second about each user, on
+	// average. Unlimited when 0.
+	UserRate float64 `yaml:"userRate"`
+
+	// UserBurst is the number of messages about a user at once, UserRate
+	// when 0
+	UserBurst int `yaml:"userBurst"`
+}
+
+// Validate returns the problems of the rate limit
+func (l RateLimit) Validate() (problems []string) {
+	if l.Rate < 0 || l.UserRate < 0 {
+		problems = append(problems, "rate and userRate can't be negative")
+	}
+	if l.Burst < 0 || l.UserBurst < 0 {
+		problems = append(problems, "burst and userBurst can't be negative")
+	}
+	if (l.Burst != 0 && l.Rate == 0) || (l.UserBurst != 0 && l.UserRate == 0) {
+		problems = append(problems, "a burst needs a rate")
+	}
+	return
+}
+
+// Key is an API key of a source
+type Key struct {
+	// ID names the key in the logs, without revealing it
+	ID string
+
+	// Secret is the key itself, sent by the clients
+	Secret string
+
+	// ExpiresAt is when the key stops being valid, never when zero
+	ExpiresAt time.Time
+
+	// Public keys are embedded in web pages, so anyone can read them. They
+	// can only send the Types of messages, from pages on the Origins, and
+	// can't sign requests.
+	Public bool
+
+	// Origins of the pages using the public key, like https://example.com
+	Origins []string
+
+	// Types of messages the public key can send, all the PublicTypes when
+	// empty
+	Types []string
+}
+
+// PublicTypes are the types of messages public keys can send at most. The
+// others change who the users are, which a leaked key shouldn't allow.
+var PublicTypes = []string{integrations.TypeTrack, integrations.TypePage}
+
+// Expired tells if the key can no longer be used at the given time
+func (k Key) Expired(at time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !at.Before(k.ExpiresAt)
+}
+
+// Allows tells if the key can send messages of that type. Only public keys
+// are limited.
+func (k Key) Allows(messageType string) bool {
+	if !k.Public {
+		return true
+	}
+	if !contains(PublicTypes, messageType) {
+		return false
+	}
+	return len(k.Types) == 0 || contains(k.Types, messageType)
+}
+
+// AllowsOrigin tells if the key can be used by pages of that origin. Only
+// public keys are limited.
+func (k Key) AllowsOrigin(origin string) bool {
+	return !k.Public || (origin != "" && contains(k.Origins, origin))
+}
+
+// now is replaced in tests
+var now = time.Now
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = make(map[string]*Source)
+)
+
+// Configure replaces the sources at once. The sources keeping the same rate
+// limit keep their buckets, so reloading doesn't reset them.
+func Configure(list []*Source) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	byName := make(map[string]*Source, len(list))
+	for _, source := range list {
+		if previous, ok := sources[source.Name]; ok && previous.RateLimit == source.RateLimit {
+			source.keyLimiter, source.userLimiter = previous.keyLimiter, previous.userLimiter
+		} else {
+			source.keyLimiter, source.userLimiter = nil, nil
+			if source.RateLimit.Rate > 0 {
+				source.keyLimiter = ratelimit.New(source.RateLimit.Rate, source.RateLimit.Burst)
+			}
+			if source.RateLimit.UserRate > 0 {
+				source.userLimiter = ratelimit.New(source.RateLimit.UserRate, source.RateLimit.UserBurst)
+			}
+		}
+		byName[source.Name] = source
+	}
+	sources = byName
+}
+
+// Get returns the source with that name, nil when there is none
+func Get(name string) *Source {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	return sources[name]
+}
+
+// Len returns the number of sources
+func Len() int {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	return len(sources)
+}
+
+// AllowedOrigin tells if a public key that didn't expire can be used by pages
+// of that origin
+func AllowedOrigin(origin string) bool {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	at := now()
+	for _, source := range sources {
+		for _, key := range source.Keys {
+			if key.Public && !key.Expired(at) && key.AllowsOrigin(origin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticate returns the source using the API key, along with the ID of the
+// key. The source is nil when no source has that key, or when it expired.
+func Authenticate(apiKey string) (*Source, string) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	if apiKey == "" {
+		return nil, ""
+	}
+	at := now()
+	for _, source := range sources {
+		for _, key := range source.Keys {
+			if key.Secret == "" || subtle.ConstantTimeCompare([]byte(key.Secret), []byte(apiKey)) != 1 {
+				continue
+			}
+			if key.Expired(at) {
+				logrus.WithField("source", source.Name).WithField("keyID", key.ID).WithField("expiredAt", key.ExpiresAt).Warn("Expired API key used")
+				return nil, ""
+			}
+			return source, key.ID
+		}
+	}
+	return nil, ""
+}
+
+// Sign returns the signature of a request made at timestamp with that body:
+// the hex encoded HMAC-SHA256 of the timestamp, a dot and the body, keyed with
+// the secret of the key.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature tells if the signature was made with one of the keys of the
+// source that didn't expire, and returns the ID of that key. Public keys are
+// known by anyone, so they can't sign.
+func (s *Source) VerifySignature(timestamp string, body []byte, signature string) (string, bool) {
+	at := now()
+	for _, key := range s.Keys {
+		if key.Secret == "" || key.Public || !hmac.Equal([]byte(Sign(key.Secret, timestamp, body)), []byte(signature)) {
+			continue
+		}
+		if key.Expired(at) {
+			logrus.WithField("source", s.Name).WithField("keyID", key.ID).WithField("expiredAt", key.ExpiresAt).Warn("Expired API key used to sign")
+			return "", false
+		}
+		return key.ID, true
+	}
+	return "", false
+}
+
+// Key returns the key of the source with that ID
+func (s *Source) Key(id string) (Key, bool) {
+	for _, key := range s.Keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// AllowRequest tells if the key can make another request, and how long to
+// wait otherwise
+func (s *Source) AllowRequest(keyID string) (bool, time.Duration) {
+	if s == nil || s.keyLimiter == nil {
+		return true, 0
+	}
+	return s.keyLimiter.Allow(keyID)
+}
+
+// AllowMessage tells if another message about the user of the message can be
+// sent, and how long to wait otherwise. Anonymous users are limited by their
+// anonymous ID, and messages without any user only with their requests.
+func (s *Source) AllowMessage(message integrations.Message) (bool, time.Duration) {
+	if s == nil || s.userLimiter == nil {
+		return true, 0
+	}
+	user := message.UserKey()
+	if user == "" {
+		return true, 0
+	}
+	return s.userLimiter.Allow(user)
+}
+
+// Enabled tells if the integration receives the messages of the source. A nil
+// source, like for messages queued before sources existed, sends to all of
+// them.
+func (s *Source) Enabled(integration string) bool {
+	if s == nil || len(s.Integrations) == 0 {
+		return true
+	}
+	for _, name := range s.Integrations {
+		if name == integration {
+			return true
+		}
+	}
+	return false
+}
+
+// Transform applies the rules of the source to the message, and tells if it
+// should be kept. A nil source keeps every message untouched.
+func (s *Source) Transform(message integrations.Message) bool {
+	if s == nil {
+		return true
+	}
+	for _, rule := range s.Rules {
+		if !rule.matches(message) {
+			continue
+		}
+		if rule.Drop {
+			return false
+		}
+		rule.apply(message)
+	}
+	return true
+}
+
+// Rule transforms the messages it matches. A rule without types nor events
+// matches every message.
+type Rule struct {
+	// Types of the messages the rule applies to, all of them when empty
+	Types []string `yaml:"types"`
+
+	// Events the rule applies to, by name of the event or page, all of them
+	// when empty
+	Events []string `yaml:"events"`
+
+	// Drop the message, the following rules are not applied
+	Drop bool `yaml:"drop"`
+
+	// Name renames the event or page
+	Name string `yaml:"name"`
+
+	// Rename renames properties or traits, from the key to the value
+	Rename map[string]string `yaml:"rename"`
+
+	// Remove removes properties or traits
+	Remove []string `yaml:"remove"`
+
+	// Set sets properties or traits, replacing the ones sent
+	Set map[string]string `yaml:"set"`
+}
+
+// Validate returns the problems of the rule
+func (r Rule) Validate() (problems []string) {
+	for _, messageType := range r.Types {
+		switch messageType {
+		case integrations.TypeIdentify, integrations.TypeTrack, integrations.TypePage, integrations.TypeAlias, integrations.TypeGroup:
+		default:
+			problems = append(problems, fmt.Sprintf("unknown type %q, expecting identify, track, page, alias or group", messageType))
+		}
+	}
+	if r.Drop && (r.Name != "" || len(r.Rename) != 0 || len(r.Remove) != 0 || len(r.Set) != 0) {
+		problems = append(problems, "a rule dropping messages can't transform them")
+	}
+	return
+}
+
+func (r Rule) matches(message integrations.Message) bool {
+	if len(r.Types) != 0 && !contains(r.Types, message.Type) {
+		return false
+	}
+	if len(r.Events) != 0 && !contains(r.Events, name(message)) {
+		return false
+	}
+	return true
+}
+
+func (r Rule) apply(message integrations.Message) {
+	if r.Name != "" {
+		switch {
+		case message.Event != nil:
+			message.Event.Name = r.Name
+		case message.Page != nil:
+			message.Page.Name = r.Name
+		}
+	}
+
+	if len(r.Rename) == 0 && len(r.Remove) == 0 && len(r.Set) == 0 {
+		return
+	}
+	fields := fields(message)
+	if fields == nil {
+		return
+	}
+	for from, to := range r.Rename {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+	for _, key := range r.Remove {
+		delete(fields, key)
+	}
+	for key, value := range r.Set {
+		fields[key] = value
+	}
+}
+
+// name returns the name of the event or page, empty for other messages
+func name(message integrations.Message) string {
+	switch {
+	case message.Event != nil:
+		return message.Event.Name
+	case message.Page != nil:
+		return message.Page.Name
+	}
+	return ""
+}
+
+// fields returns the properties or traits of the message, created when
+// missing
+func fields(message integrations.Message) map[string]interface{} {
+	switch {
+	case message.Identification != nil:
+		if message.Identification.UserTraits == nil {
+			message.Identification.UserTraits = make(map[string]interface{})
+		}
+		return message.Identification.UserTraits
+	case message.Event != nil:
+		if message.Event.Properties == nil {
+			message.Event.Properties = make(map[string]interface{})
+		}
+		return message.Event.Properties
+	case message.Page != nil:
+		if message.Page.Properties == nil {
+			message.Page.Properties = make(map[string]interface{})
+		}
+		return message.Page.Properties
+	case message.Alias != nil:
+		if message.Alias.UserTraits == nil {
+			message.Alias.UserTraits = make(map[string]interface{})
+		}
+		return message.Alias.UserTraits
+	case message.Group != nil:
+		if message.Group.Traits == nil {
+			message.Group.Traits = make(map[string]interface{})
+		}
+		return message.Group.Traits
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
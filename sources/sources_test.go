@@ -0,0 +1,230 @@
+package sources
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jipiboily/forwardlytics/integrations"
+)
+
+func TestAuthenticate(t *testing.T) {
+	Configure([]*Source{
+		{Name: "web", Keys: []Key{{ID: "web-1", Secret: "web-key"}}},
+		{Name: "mobile", Keys: []Key{{ID: "mobile-1", Secret: "mobile-key"}}},
+	})
+	defer Configure(nil)
+
+	if source, keyID := Authenticate("mobile-key"); source == nil || source.Name != "mobile" || keyID != "mobile-1" {
+		t.Errorf("Expected the mobile source with key mobile-1, got %v and %q", source, keyID)
+	}
+	if source, _ := Authenticate("other-key"); source != nil {
+		t.Errorf("Expected no source for an unknown key, got %v", source)
+	}
+	if source, _ := Authenticate(""); source != nil {
+		t.Errorf("Expected no source without a key, got %v", source)
+	}
+}
+
+func TestAuthenticateWhileRotatingKeys(t *testing.T) {
+	rotation := time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC)
+	Configure([]*Source{{Name: "web", Keys: []Key{
+		{ID: "new", Secret: "new-key"},
+		{ID: "old", Secret: "old-key", ExpiresAt: rotation},
+	}}})
+	defer Configure(nil)
+	defer func() { now = time.Now }()
+
+	now = func() time.Time { return rotation.Add(-time.Hour) }
+	for secret, expectedID := range map[string]string{"new-key": "new", "old-key": "old"} {
+		if source, keyID := Authenticate(secret); source == nil || keyID != expectedID {
+			t.Errorf("Expected %v to be valid as %v, got %v and %q", secret, expectedID, source, keyID)
+		}
+	}
+
+	now = func() time.Time { return rotation }
+	if source, _ := Authenticate("old-key"); source != nil {
+		t.Error("The old key should have expired")
+	}
+	if source, _ := Authenticate("new-key"); source == nil {
+		t.Error("The new key should still be valid")
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	source := &Source{Name: "web", Integrations: []string{"intercom-eu"}}
+	if !source.Enabled("intercom-eu") || source.Enabled("mixpanel") {
+		t.Error("Only the integrations of the source should be enabled")
+	}
+
+	var unknown *Source
+	if !unknown.Enabled("mixpanel") || !(&Source{}).Enabled("mixpanel") {
+		t.Error("Every integration should be enabled without a list")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	source := &Source{Rules: []Rule{
+		{Events: []string{"debug.ping"}, Drop: true},
+		{Types: []string{integrations.TypeTrack}, Events: []string{"signup"}, Name: "account.created"},
+		{Types: []string{integrations.TypeTrack}, Rename: map[string]string{"plan_name": "plan"}, Remove: []string{"password"}, Set: map[string]string{"app": "web"}},
+	}}
+
+	message := integrations.Message{Type: integrations.TypeTrack, Event: &integrations.Event{
+		Name:       "signup",
+		Properties: map[string]interface{}{"plan_name": "pro", "password": "secret"},
+	}}
+	if !source.Transform(message) {
+		t.Fatal("The message should be kept")
+	}
+	if message.Event.Name != "account.created" {
+		t.Errorf("Expected the event to be renamed, got %v", message.Event.Name)
+	}
+	expected := map[string]interface{}{"plan": "pro", "app": "web"}
+	if !reflect.DeepEqual(message.Event.Properties, expected) {
+		t.Errorf("Expected the properties %v, got %v", expected, message.Event.Properties)
+	}
+
+	dropped := integrations.Message{Type: integrations.TypePage, Page: &integrations.Page{Name: "debug.ping"}}
+	if source.Transform(dropped) {
+		t.Error("The message should be dropped")
+	}
+
+	identification := integrations.Message{Type: integrations.TypeIdentify, Identification: &integrations.Identification{UserID: "123"}}
+	if !source.Transform(identification) || identification.Identification.UserTraits != nil {
+		t.Error("Rules for other types should not apply")
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	rule := Rule{Types: []string{"screen"}, Drop: true, Name: "renamed"}
+	expected := []string{
+		`unknown type "screen", expecting identify, track, page, alias or group`,
+		"a rule dropping messages can't transform them",
+	}
+	if problems := rule.Validate(); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	source := &Source{Name: "server", Keys: []Key{
+		{ID: "new", Secret: "new-key"},
+		{ID: "old", Secret: "old-key", ExpiresAt: time.Now().Add(-time.Hour)},
+	}}
+	body := []byte(`{"name":"account.created"}`)
+
+	if keyID, ok := source.VerifySignature("1459468800", body, Sign("new-key", "1459468800", body)); !ok || keyID != "new" {
+		t.Errorf("Expected the signature to be verified with the new key, got %q", keyID)
+	}
+	if _, ok := source.VerifySignature("1459468801", body, Sign("new-key", "1459468800", body)); ok {
+		t.Error("The signature should cover the timestamp")
+	}
+	if _, ok := source.VerifySignature("1459468800", []byte("{}"), Sign("new-key", "1459468800", body)); ok {
+		t.Error("The signature should cover the body")
+	}
+	if _, ok := source.VerifySignature("1459468800", body, Sign("old-key", "1459468800", body)); ok {
+		t.Error("Signatures made with expired keys should be rejected")
+	}
+}
+
+func TestPublicKeys(t *testing.T) {
+	public := Key{ID: "browser", Secret: "public-key", Public: true, Origins: []string{"https://example.com"}}
+	pagesOnly := Key{ID: "landing", Secret: "landing-key", Public: true, Origins: []string{"https://landing.example.com"}, Types: []string{"page"}}
+	secret := Key{ID: "server", Secret: "server-key"}
+	Configure([]*Source{{Name: "web", Keys: []Key{public, pagesOnly, secret}}})
+	defer Configure(nil)
+
+	tests := []struct {
+		key         Key
+		messageType string
+		allowed     bool
+	}{
+		{public, "track", true},
+		{public, "page", true},
+		{public, "identify", false},
+		{public, "alias", false},
+		{pagesOnly, "page", true},
+		{pagesOnly, "track", false},
+		{secret, "identify", true},
+	}
+	for _, test := range tests {
+		if allowed := test.key.Allows(test.messageType); allowed != test.allowed {
+			t.Errorf("Expected %s to allow %s: %v, got %v", test.key.ID, test.messageType, test.allowed, allowed)
+		}
+	}
+
+	if !public.AllowsOrigin("https://example.com") || public.AllowsOrigin("https://evil.com") || public.AllowsOrigin("") {
+		t.Error("Public keys should only be allowed from their origins")
+	}
+	if !secret.AllowsOrigin("") {
+		t.Error("Other keys should be allowed from anywhere")
+	}
+	if !AllowedOrigin("https://landing.example.com") || AllowedOrigin("https://evil.com") {
+		t.Error("Expected the origins of public keys to be allowed, and only them")
+	}
+
+	body := []byte("{}")
+	if _, ok := Get("web").VerifySignature("1459468800", body, Sign("public-key", "1459468800", body)); ok {
+		t.Error("Public keys shouldn't sign requests")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 2, UserRate: 1}
+	Configure([]*Source{{Name: "web", RateLimit: limit}})
+	defer Configure(nil)
+	source := Get("web")
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := source.AllowRequest("web-1"); !ok {
+			t.Fatalf("Request %d should be allowed by the burst", i+1)
+		}
+	}
+	if ok, wait := source.AllowRequest("web-1"); ok || wait <= 0 {
+		t.Errorf("The third request should wait, got %v and %v", ok, wait)
+	}
+	if ok, _ := source.AllowRequest("web-2"); !ok {
+		t.Error("Each key should have its own limit")
+	}
+
+	event := integrations.Message{Type: integrations.TypeTrack, Event: &integrations.Event{UserID: "123"}}
+	if ok, _ := source.AllowMessage(event); !ok {
+		t.Error("The first message about the user should be allowed")
+	}
+	if ok, _ := source.AllowMessage(event); ok {
+		t.Error("The second message about the user should wait")
+	}
+	anonymous := integrations.Message{Type: integrations.TypeTrack, Event: &integrations.Event{AnonymousID: "f4b5c3"}}
+	if ok, _ := source.AllowMessage(anonymous); !ok {
+		t.Error("The first message about the anonymous user should be allowed")
+	}
+	if ok, _ := source.AllowMessage(anonymous); ok {
+		t.Error("The second message about the anonymous user should wait")
+	}
+	other := integrations.Message{Type: integrations.TypeTrack, Event: &integrations.Event{AnonymousID: "a9c1e7"}}
+	if ok, _ := source.AllowMessage(other); !ok {
+		t.Error("Each anonymous user should have its own limit")
+	}
+
+	// Reloading the same limit keeps the buckets
+	Configure([]*Source{{Name: "web", RateLimit: limit}})
+	if ok, _ := Get("web").AllowRequest("web-1"); ok {
+		t.Error("Reloading shouldn't reset the buckets")
+	}
+	Configure([]*Source{{Name: "web", RateLimit: RateLimit{Rate: 5}}})
+	if ok, _ := Get("web").AllowRequest("web-1"); !ok {
+		t.Error("Changing the limit should start over")
+	}
+	if ok, _ := (*Source)(nil).AllowRequest("web-1"); !ok {
+		t.Error("A nil source is unlimited")
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	problems := RateLimit{Rate: -1, UserBurst: 10}.Validate()
+	expected := []string{"rate and userRate can't be negative", "a burst needs a rate"}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %q, got %q", expected, problems)
+	}
+}